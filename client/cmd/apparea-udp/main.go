@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/jedevc/apparea/client"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func main() {
+	port := flag.Int("p", 21, "port of the apparea server")
+	identity := flag.String("i", "~/.ssh/id_ed25519", "private key to authenticate with")
+	knownHosts := flag.String("known-hosts", "~/.ssh/known_hosts", "known hosts file used to verify the server")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] user@host local-address\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	parts := strings.SplitN(flag.Arg(0), "@", 2)
+	if len(parts) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	username, host := parts[0], parts[1]
+
+	keyBytes, err := ioutil.ReadFile(expandHome(*identity))
+	if err != nil {
+		log.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostKeyCallback, err := knownhosts.New(expandHome(*knownHosts))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(*port)), &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	fwd, err := client.ForwardUDP(conn, flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fwd.Close()
+
+	log.Printf("Forwarding udp://%s:%d to %s", host, fwd.Port, flag.Arg(1))
+	err = conn.Wait()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	user, err := user.Current()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(user.HomeDir, path[2:])
+}
@@ -0,0 +1,150 @@
+// Package client implements the client side of apparea's extensions to the
+// SSH protocol, which can't be used from a normal SSH client.
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedevc/apparea/server/forward"
+	"github.com/jedevc/apparea/server/helpers"
+	"golang.org/x/crypto/ssh"
+)
+
+const udpIdleTimeout = 2 * time.Minute
+
+// UDPForward delivers datagrams sent to a public UDP port on the server to a
+// local UDP address.
+type UDPForward struct {
+	// Port is the public port allocated by the server.
+	Port uint32
+
+	client    *ssh.Client
+	localAddr *net.UDPAddr
+	channels  <-chan ssh.NewChannel
+
+	lock  sync.Mutex
+	flows map[ssh.Channel]*net.UDPConn
+}
+
+// ForwardUDP requests a public UDP port from the server, and starts
+// delivering the datagrams received on it to localAddr. Each remote source
+// address is given its own local socket, so replies from the local service
+// are routed back to the right visitor.
+//
+// Only one UDP forward may be active on a client at a time.
+func ForwardUDP(client *ssh.Client, localAddr string) (*UDPForward, error) {
+	addr, err := net.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := client.HandleChannelOpen(forward.UDPChannelType)
+	if channels == nil {
+		return nil, fmt.Errorf("udp forward already active")
+	}
+
+	payload := make([]byte, 0)
+	helpers.PackString(&payload, "0.0.0.0")
+	helpers.PackInt(&payload, 0)
+	ok, resp, err := client.SendRequest(forward.UDPForwardRequestType, true, payload)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("udp forward request denied by server")
+	}
+	port, err := helpers.UnpackInt(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	fwd := &UDPForward{
+		Port:      port,
+		client:    client,
+		localAddr: addr,
+		channels:  channels,
+		flows:     make(map[ssh.Channel]*net.UDPConn),
+	}
+	go fwd.serve()
+
+	return fwd, nil
+}
+
+func (fwd *UDPForward) serve() {
+	for newChannel := range fwd.channels {
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+
+		conn, err := net.DialUDP("udp", nil, fwd.localAddr)
+		if err != nil {
+			log.Printf("could not dial %s: %s", fwd.localAddr, err)
+			ch.Close()
+			continue
+		}
+
+		fwd.lock.Lock()
+		fwd.flows[ch] = conn
+		fwd.lock.Unlock()
+
+		go fwd.handleFlow(ch, conn)
+	}
+}
+
+func (fwd *UDPForward) handleFlow(ch ssh.Channel, conn *net.UDPConn) {
+	var once sync.Once
+	closer := func() {
+		ch.Close()
+		conn.Close()
+
+		fwd.lock.Lock()
+		delete(fwd.flows, ch)
+		fwd.lock.Unlock()
+	}
+
+	go func() {
+		for {
+			datagram, err := helpers.ReadFrame(ch, forward.MaxDatagramSize)
+			if err != nil {
+				break
+			}
+			conn.Write(datagram)
+		}
+		once.Do(closer)
+	}()
+
+	buf := make([]byte, forward.MaxDatagramSize)
+	for {
+		// the server expires idle flows, but expire them here too in case
+		// the local service is the only one talking
+		conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		err = helpers.WriteFrame(ch, buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	once.Do(closer)
+}
+
+// Close closes all active flows. The public port is released when the SSH
+// connection is closed.
+func (fwd *UDPForward) Close() {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	for ch, conn := range fwd.flows {
+		ch.Close()
+		conn.Close()
+	}
+	fwd.flows = make(map[ssh.Channel]*net.UDPConn)
+}
@@ -3,6 +3,10 @@ module github.com/jedevc/apparea
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/andybalholm/brotli v1.0.0
+	github.com/pkg/sftp v1.12.0
 	github.com/urfave/cli/v2 v2.2.0
-	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 )
@@ -0,0 +1,117 @@
+// Package audit writes an append-only log of security relevant events, one
+// JSON object per line, suitable for shipping to a log collector.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types written to the audit log.
+const (
+	AuthSuccess    = "auth.success"
+	AuthFailure    = "auth.failure"
+	AuthBan        = "auth.ban"
+	AuthUnban      = "auth.unban"
+	ForwardCreate  = "forward.create"
+	ForwardReject  = "forward.reject"
+	ForwardCancel  = "forward.cancel"
+	PrivateConnect = "private.connect"
+	PrivateReject  = "private.reject"
+	SessionEnd     = "session.end"
+	Admin          = "admin"
+)
+
+// Event is a single entry in the audit log. Fields that don't apply to an
+// event are omitted.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Username    string    `json:"username,omitempty"`
+	Login       string    `json:"login,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	KeyID       string    `json:"key_id,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	Request     string    `json:"request,omitempty"`
+	Forward     string    `json:"forward,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+
+	// Duration is the length of a session, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// Logger appends events to an audit log. A nil Logger discards all events,
+// so callers don't need to check whether auditing is enabled.
+type Logger struct {
+	lock   sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// Open opens the audit log at path for appending, creating it if needed.
+func Open(path string) (*Logger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{w: f, closer: f}, nil
+}
+
+// New creates a logger that writes events to w.
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Log writes the event, filling in its time if unset. Failures to write are
+// reported to the server log, since there's nobody else to tell.
+func (l *Logger) Log(event Event) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Could not encode audit event: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	// a single write per event keeps lines whole, even with several
+	// processes appending to the same file
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err = l.w.Write(line)
+	if err != nil {
+		log.Printf("Could not write audit event: %s", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// SourceIP returns the IP address of a remote address, without the port.
+func SourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
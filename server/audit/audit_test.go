@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		event    Event
+		expected string
+	}{
+		{
+			Event{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Type: AuthFailure, Login: "alice.web", Method: "publickey", SourceIP: "10.0.0.1", Reason: "invalid credentials"},
+			`{"time":"2020-01-02T03:04:05Z","type":"auth.failure","login":"alice.web","method":"publickey","source_ip":"10.0.0.1","reason":"invalid credentials"}`,
+		},
+		{
+			Event{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Type: SessionEnd, Username: "alice", Duration: 1.5},
+			`{"time":"2020-01-02T03:04:05Z","type":"session.end","username":"alice","duration":1.5}`,
+		},
+		{
+			Event{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Type: Admin, Action: "token.revoke", Target: "abc"},
+			`{"time":"2020-01-02T03:04:05Z","type":"admin","action":"token.revoke","target":"abc"}`,
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		New(&buf).Log(test.event)
+		if buf.String() != test.expected+"\n" {
+			t.Errorf("expected %s, got %s", test.expected, buf.String())
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf)
+
+	before := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Log(Event{Type: ForwardCreate, Username: "alice", Forward: "http://alice.apparea.test"})
+		}()
+	}
+	wg.Wait()
+
+	// every event is a whole line, with its time filled in
+	scanner := bufio.NewScanner(&buf)
+	count := 0
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("could not decode %q: %s", scanner.Text(), err)
+		}
+		if event.Type != ForwardCreate || event.Username != "alice" || event.Forward != "http://alice.apparea.test" {
+			t.Errorf("unexpected event %+v", event)
+		}
+		if event.Time.Before(before.Add(-time.Second)) || event.Time.Location() != time.UTC {
+			t.Errorf("expected the time to be filled in, got %s", event.Time)
+		}
+		count++
+	}
+	if count != 10 {
+		t.Errorf("expected 10 events, got %d", count)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apparea-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	for _, event := range []Event{{Type: AuthBan}, {Type: AuthUnban}} {
+		logger, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Log(event)
+		if err := logger.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the log is appended to, not replaced
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", data)
+	}
+	for i, expected := range []string{AuthBan, AuthUnban} {
+		var event Event
+		if err := json.Unmarshal(lines[i], &event); err != nil || event.Type != expected {
+			t.Errorf("line %d: expected a %s event, got %q (%v)", i, expected, lines[i], err)
+		}
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the log to only be readable by its owner, got %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+	logger.Log(Event{Type: AuthSuccess})
+	if err := logger.Close(); err != nil {
+		t.Errorf("expected closing a nil logger to succeed, got %s", err)
+	}
+
+	// loggers that aren't files don't need closing
+	if err := New(ioutil.Discard).Close(); err != nil {
+		t.Errorf("expected closing a writer logger to succeed, got %s", err)
+	}
+}
+
+func TestSourceIP(t *testing.T) {
+	tests := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{nil, ""},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2200}, "10.0.0.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2200}, "2001:db8::1"},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 53}, "192.168.1.1"},
+		{&net.UnixAddr{Name: "/run/apparea.sock", Net: "unix"}, "/run/apparea.sock"},
+	}
+	for _, test := range tests {
+		if ip := SourceIP(test.addr); ip != test.expected {
+			t.Errorf("SourceIP(%v) = %q, expected %q", test.addr, ip, test.expected)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrInvalidCredentials = errors.New("Invalid credentials")
+
+// Authenticator decides whether a user may connect with a given public key,
+// and if so, what they are permitted to do.
+type Authenticator interface {
+	Authenticate(username string, key ssh.PublicKey) (*Permissions, error)
+}
+
+// Permissions describes what an authenticated user is allowed to do.
+type Permissions struct {
+	Username string `json:"username"`
+	Admin    bool   `json:"admin,omitempty"`
+
+	// Subdomains restricts the subdomains that the user may forward to, or
+	// allows all subdomains if empty.
+	Subdomains []string `json:"subdomains,omitempty"`
+
+	// TokenID is set for guests who authenticated with an access token,
+	// whose sessions are limited to forwarding.
+	TokenID string `json:"-"`
+}
+
+const (
+	extensionUsername   = "username"
+	extensionAdmin      = "admin"
+	extensionSubdomains = "subdomains"
+	extensionTokenID    = "token-id"
+)
+
+// SSHPermissions encodes the permissions into the extensions of an
+// ssh.Permissions so they are available on the established connection.
+func (perms Permissions) SSHPermissions() *ssh.Permissions {
+	extensions := map[string]string{
+		extensionUsername: perms.Username,
+	}
+	if perms.Admin {
+		extensions[extensionAdmin] = "true"
+	}
+	if len(perms.Subdomains) > 0 {
+		extensions[extensionSubdomains] = strings.Join(perms.Subdomains, ",")
+	}
+	if perms.Guest() {
+		extensions[extensionTokenID] = perms.TokenID
+	}
+
+	return &ssh.Permissions{
+		Extensions: extensions,
+	}
+}
+
+// PermissionsFromSSH decodes permissions previously encoded with
+// SSHPermissions.
+func PermissionsFromSSH(sshPerms *ssh.Permissions) Permissions {
+	if sshPerms == nil {
+		return Permissions{}
+	}
+
+	perms := Permissions{
+		Username: sshPerms.Extensions[extensionUsername],
+		Admin:    sshPerms.Extensions[extensionAdmin] == "true",
+		TokenID:  sshPerms.Extensions[extensionTokenID],
+	}
+	if subdomains := sshPerms.Extensions[extensionSubdomains]; len(subdomains) > 0 {
+		perms.Subdomains = strings.Split(subdomains, ",")
+	}
+	return perms
+}
+
+// Guest reports whether the permissions were granted by an access token,
+// rather than to the user themselves.
+func (perms Permissions) Guest() bool {
+	return len(perms.TokenID) > 0
+}
+
+// AllowsSubdomain reports whether the permissions allow forwarding to the
+// given subdomain, where the empty string is the user's own domain.
+func (perms Permissions) AllowsSubdomain(subdomain string) bool {
+	if len(perms.Subdomains) == 0 {
+		return true
+	}
+	for _, allowed := range perms.Subdomains {
+		if allowed == subdomain {
+			return true
+		}
+	}
+	return false
+}
+
+// DirectoryAuthenticator authenticates users against a directory of per-user
+// key files, where each file is named after a user and is in the
+// authorized_keys format. Files are read on every authentication, so keys
+// can be changed without restarting the server.
+type DirectoryAuthenticator struct {
+	Directory string
+}
+
+func (auth DirectoryAuthenticator) Authenticate(username string, key ssh.PublicKey) (*Permissions, error) {
+	if !IsValidUsername(username) || strings.Contains(username, ".") {
+		return nil, ErrInvalidCredentials
+	}
+
+	keyBytes, err := ioutil.ReadFile(filepath.Join(auth.Directory, username))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	user := User{
+		Username: username,
+	}
+	for len(keyBytes) > 0 {
+		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(keyBytes)
+		if err != nil {
+			break
+		}
+		user.Keys = append(user.Keys, pubKey)
+		keyBytes = rest
+	}
+
+	if !user.CheckKey(key) {
+		return nil, ErrInvalidCredentials
+	}
+	return &Permissions{
+		Username: username,
+	}, nil
+}
+
+// WebhookAuthenticator delegates authentication to an external HTTP service.
+//
+// For every authentication attempt, a JSON object containing the username,
+// the key (in authorized_keys format) and its fingerprint is POSTed to the
+// URL. A 200 response allows the user to connect, with the response body
+// optionally containing a JSON Permissions object; any other status denies
+// the attempt.
+type WebhookAuthenticator struct {
+	URL    string
+	Client *http.Client
+}
+
+type webhookRequest struct {
+	Username    string `json:"username"`
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (auth WebhookAuthenticator) Authenticate(username string, key ssh.PublicKey) (*Permissions, error) {
+	client := auth.Client
+	if client == nil {
+		client = &http.Client{
+			Timeout: 10 * time.Second,
+		}
+	}
+
+	body, err := json.Marshal(webhookRequest{
+		Username:    username,
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Post(auth.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("auth webhook error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrInvalidCredentials
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("auth webhook error: %w", err)
+	}
+
+	perms := Permissions{}
+	if len(bytes.TrimSpace(respBody)) > 0 {
+		err = json.Unmarshal(respBody, &perms)
+		if err != nil {
+			return nil, fmt.Errorf("auth webhook returned invalid permissions: %w", err)
+		}
+	}
+	perms.Username = username
+
+	return &perms, nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func generateKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	allowed := generateKey(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("could not decode webhook request: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.Username != "alice" || req.Fingerprint != ssh.FingerprintSHA256(allowed) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(Permissions{
+			Admin:      true,
+			Subdomains: []string{"api"},
+		})
+	}))
+	defer server.Close()
+
+	auth := WebhookAuthenticator{
+		URL: server.URL,
+	}
+
+	perms, err := auth.Authenticate("alice", allowed)
+	if err != nil {
+		t.Fatalf("expected alice to be allowed, got %s", err)
+	}
+	if perms.Username != "alice" || !perms.Admin {
+		t.Errorf("unexpected permissions %+v", perms)
+	}
+	if !perms.AllowsSubdomain("api") || perms.AllowsSubdomain("web") {
+		t.Errorf("unexpected subdomain permissions %+v", perms.Subdomains)
+	}
+
+	if _, err := auth.Authenticate("bob", allowed); err != ErrInvalidCredentials {
+		t.Errorf("expected bob to be denied, got %v", err)
+	}
+	if _, err := auth.Authenticate("alice", generateKey(t)); err != ErrInvalidCredentials {
+		t.Errorf("expected unknown key to be denied, got %v", err)
+	}
+}
+
+func TestPermissionsRoundTrip(t *testing.T) {
+	perms := Permissions{
+		Username:   "alice",
+		Admin:      true,
+		Subdomains: []string{"api", "web"},
+	}
+
+	decoded := PermissionsFromSSH(perms.SSHPermissions())
+	if decoded.Username != perms.Username || decoded.Admin != perms.Admin || len(decoded.Subdomains) != 2 {
+		t.Errorf("expected %+v, got %+v", perms, decoded)
+	}
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKeyLine is a single line of an authorized_keys file. Lines that
+// aren't keys (blank lines and comments) have a nil key, and are written back
+// untouched.
+type authorizedKeyLine struct {
+	raw      []byte
+	key      ssh.PublicKey
+	username string
+}
+
+// editAuthorizedKeys locks and parses the authorized_keys file in the config
+// directory, passes its lines to edit, and atomically writes back the lines
+// it returns.
+func editAuthorizedKeys(configDirectory string, edit func([]authorizedKeyLine) ([]authorizedKeyLine, error)) error {
+	path := filepath.Join(configDirectory, "authorized_keys")
+
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var lines []authorizedKeyLine
+	for i, raw := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		line := authorizedKeyLine{raw: raw}
+
+		trimmed := bytes.TrimSpace(raw)
+		if len(trimmed) > 0 && trimmed[0] != '#' {
+			// refuse to rewrite a file we don't understand, since we'd lose
+			// whatever is on this line
+			line.key, line.username, _, _, err = ssh.ParseAuthorizedKey(trimmed)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %w", path, i+1, err)
+			}
+		}
+		lines = append(lines, line)
+	}
+	if len(data) == 0 {
+		lines = nil
+	}
+
+	lines, err = edit(lines)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line.raw)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(path, buf.Bytes(), info.Mode().Perm())
+}
+
+// AddUserKeys adds the keys in keyBytes (in the authorized_keys format) to
+// the authorized_keys file in the config directory for the given username,
+// preserving any key options. It returns the number of keys added.
+func AddUserKeys(configDirectory string, username string, keyBytes []byte) (int, error) {
+	// the username is split on dots to find the subdomain, so it can't
+	// contain any itself
+	if !IsValidUsername(username) || strings.Contains(username, ".") {
+		return 0, fmt.Errorf("invalid username %q", username)
+	}
+
+	var added []authorizedKeyLine
+	for len(bytes.TrimSpace(keyBytes)) > 0 {
+		key, _, options, rest, err := ssh.ParseAuthorizedKey(keyBytes)
+		if err != nil {
+			return 0, err
+		}
+		keyBytes = rest
+
+		raw := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(key), []byte("\n"))
+		if len(options) > 0 {
+			raw = append([]byte(strings.Join(options, ",")+" "), raw...)
+		}
+		raw = append(raw, []byte(" "+username)...)
+
+		added = append(added, authorizedKeyLine{
+			raw:      raw,
+			key:      key,
+			username: username,
+		})
+	}
+	if len(added) == 0 {
+		return 0, fmt.Errorf("no keys found")
+	}
+
+	err := editAuthorizedKeys(configDirectory, func(lines []authorizedKeyLine) ([]authorizedKeyLine, error) {
+		for _, line := range lines {
+			if line.key == nil {
+				continue
+			}
+			for _, add := range added {
+				if bytes.Equal(line.key.Marshal(), add.key.Marshal()) {
+					return nil, fmt.Errorf("key %s already belongs to %q", ssh.FingerprintSHA256(add.key), line.username)
+				}
+			}
+		}
+		return append(lines, added...), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(added), nil
+}
+
+// RemoveUser removes all of a user's keys from the authorized_keys file in
+// the config directory, returning the number of keys removed.
+func RemoveUser(configDirectory string, username string) (int, error) {
+	if !IsValidUsername(username) || strings.Contains(username, ".") {
+		return 0, fmt.Errorf("invalid username %q", username)
+	}
+
+	removed := 0
+	err := editAuthorizedKeys(configDirectory, func(lines []authorizedKeyLine) ([]authorizedKeyLine, error) {
+		kept := lines[:0]
+		for _, line := range lines {
+			if line.key != nil && line.username == username {
+				removed++
+				continue
+			}
+			kept = append(kept, line)
+		}
+		if removed == 0 {
+			return nil, fmt.Errorf("no such user %q", username)
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+// RevokeKey removes the key with the given SHA256 fingerprint from the
+// authorized_keys file in the config directory, returning the username it
+// belonged to.
+func RevokeKey(configDirectory string, fingerprint string) (string, error) {
+	username := ""
+	err := editAuthorizedKeys(configDirectory, func(lines []authorizedKeyLine) ([]authorizedKeyLine, error) {
+		for i, line := range lines {
+			if line.key != nil && ssh.FingerprintSHA256(line.key) == fingerprint {
+				username = line.username
+				return append(lines[:i], lines[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("no key with fingerprint %s", fingerprint)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
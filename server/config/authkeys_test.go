@@ -0,0 +1,47 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRemoveUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apparea-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	authKeyPath := filepath.Join(dir, "authorized_keys")
+	if err := ioutil.WriteFile(authKeyPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddUserKeys(dir, "alice", ssh.MarshalAuthorizedKey(generateKey(t))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		removed  int
+	}{
+		{"", 0},
+		{"alice.devbox", 0},
+		{"../alice", 0},
+		{"bob", 0},
+		{"alice", 1},
+		{"alice", 0},
+	}
+	for _, test := range tests {
+		removed, err := RemoveUser(dir, test.username)
+		if test.removed == 0 && err == nil {
+			t.Errorf("RemoveUser(%q): expected an error", test.username)
+		}
+		if removed != test.removed {
+			t.Errorf("RemoveUser(%q): expected %d key(s) removed, got %d", test.username, test.removed, removed)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// supportedCriticalOptions are the certificate critical options that are
+// understood by the server. The source-address option is enforced by the ssh
+// package itself when it is returned in the connection's permissions.
+var supportedCriticalOptions = []string{"source-address"}
+
+// authenticateCertificate checks that a user certificate is signed by one of
+// the trusted user certificate authorities, that it is currently valid, and
+// that its principals include the username.
+func (config *Config) authenticateCertificate(username string, cert *ssh.Certificate) (*Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+
+	checker := ssh.CertChecker{
+		SupportedCriticalOptions: supportedCriticalOptions,
+		IsUserAuthority:          config.isUserAuthority,
+		IsRevoked:                config.isRevoked,
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, fmt.Errorf("certificate signed by unrecognized authority")
+	}
+	err := checker.CheckCert(username, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Permissions{
+		Username: username,
+	}, nil
+}
+
+func (config *Config) isUserAuthority(auth ssh.PublicKey) bool {
+	return containsKey(config.TrustedUserCAKeys, auth) && !containsKey(config.RevokedKeys, auth)
+}
+
+// isRevoked reports whether the certificate's key has been revoked.
+func (config *Config) isRevoked(cert *ssh.Certificate) bool {
+	return containsKey(config.RevokedKeys, cert.Key)
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	keyBytes := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), keyBytes) {
+			return true
+		}
+	}
+	return false
+}
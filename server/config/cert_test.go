@@ -0,0 +1,214 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func generateSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// handshake connects to a server using the config over loopback, returning
+// the permissions of the connection, or the server's error.
+func handshake(t *testing.T, config *Config, login string, signer ssh.Signer) (*ssh.Permissions, error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		perms *ssh.Permissions
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		sshConn, _, _, err := ssh.NewServerConn(conn, config.SSHConfig)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer sshConn.Close()
+		results <- result{perms: sshConn.Permissions}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            login,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		client.Close()
+	}
+
+	r := <-results
+	return r.perms, r.err
+}
+
+func TestCertificates(t *testing.T) {
+	ca := generateSigner(t)
+	revokedCA := generateSigner(t)
+	untrustedCA := generateSigner(t)
+	revokedKey := generateSigner(t)
+
+	config, err := NewConfig(Users{}, generateSigner(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TrustedUserCAKeys = []ssh.PublicKey{ca.PublicKey(), revokedCA.PublicKey()}
+	config.RevokedKeys = []ssh.PublicKey{revokedCA.PublicKey(), revokedKey.PublicKey()}
+	config.Admins = []string{"admin"}
+
+	now := uint64(time.Now().Unix())
+	valid := func(cert *ssh.Certificate) {}
+
+	tests := []struct {
+		name    string
+		login   string
+		ca      ssh.Signer
+		key     ssh.Signer
+		modify  func(cert *ssh.Certificate)
+		allowed bool
+	}{
+		{"valid", "alice", ca, nil, valid, true},
+		{"subdomain login", "alice.api", ca, nil, valid, true},
+		{"other principal", "bob", ca, nil, valid, false},
+		{"second principal", "carol", ca, nil, func(cert *ssh.Certificate) {
+			cert.ValidPrincipals = []string{"alice", "carol"}
+		}, true},
+		{"no principals", "alice", ca, nil, func(cert *ssh.Certificate) {
+			cert.ValidPrincipals = nil
+		}, false},
+		{"expired", "alice", ca, nil, func(cert *ssh.Certificate) {
+			cert.ValidAfter, cert.ValidBefore = now-7200, now-3600
+		}, false},
+		{"not yet valid", "alice", ca, nil, func(cert *ssh.Certificate) {
+			cert.ValidAfter, cert.ValidBefore = now+3600, now+7200
+		}, false},
+		{"matching source address", "alice", ca, nil, func(cert *ssh.Certificate) {
+			cert.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8,127.0.0.1/32"}
+		}, true},
+		{"other source address", "alice", ca, nil, func(cert *ssh.Certificate) {
+			cert.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"}
+		}, false},
+		{"unsupported critical option", "alice", ca, nil, func(cert *ssh.Certificate) {
+			cert.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+		}, false},
+		{"host certificate", "alice", ca, nil, func(cert *ssh.Certificate) {
+			cert.CertType = ssh.HostCert
+		}, false},
+		{"untrusted authority", "alice", untrustedCA, nil, valid, false},
+		{"revoked authority", "alice", revokedCA, nil, valid, false},
+		{"revoked key", "alice", ca, revokedKey, valid, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := test.key
+			if key == nil {
+				key = generateSigner(t)
+			}
+			cert := &ssh.Certificate{
+				Key:             key.PublicKey(),
+				CertType:        ssh.UserCert,
+				KeyId:           "alice-laptop",
+				ValidPrincipals: []string{"alice"},
+				ValidAfter:      now - 60,
+				ValidBefore:     now + 3600,
+			}
+			test.modify(cert)
+			if err := cert.SignCert(rand.Reader, test.ca); err != nil {
+				t.Fatal(err)
+			}
+			signer, err := ssh.NewCertSigner(cert, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sshPerms, err := handshake(t, config, test.login, signer)
+			if !test.allowed {
+				if err == nil {
+					t.Fatal("expected certificate to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected certificate to be accepted, got %s", err)
+			}
+
+			username, _, _ := SplitUsername(test.login)
+			perms := PermissionsFromSSH(sshPerms)
+			if perms.Username != username || perms.Admin || perms.Guest() {
+				t.Errorf("unexpected permissions %+v", perms)
+			}
+			if fp := sshPerms.Extensions["pubkey-fp"]; fp != ssh.FingerprintSHA256(key.PublicKey()) {
+				t.Errorf("expected the fingerprint of the certified key, got %q", fp)
+			}
+			if id := sshPerms.Extensions["cert-key-id"]; id != "alice-laptop" {
+				t.Errorf("expected the certificate's key id, got %q", id)
+			}
+			for opt, value := range cert.CriticalOptions {
+				if sshPerms.CriticalOptions[opt] != value {
+					t.Errorf("expected critical option %s=%s, got %q", opt, value, sshPerms.CriticalOptions[opt])
+				}
+			}
+		})
+	}
+}
+
+func TestCertificateAdmin(t *testing.T) {
+	ca := generateSigner(t)
+	config, err := NewConfig(Users{}, generateSigner(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TrustedUserCAKeys = []ssh.PublicKey{ca.PublicKey()}
+	config.Admins = []string{"admin"}
+
+	key := generateSigner(t)
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"admin"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPerms, err := handshake(t, config, "admin", signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms := PermissionsFromSSH(sshPerms); !perms.Admin || perms.Username != "admin" {
+		t.Errorf("expected admin permissions, got %+v", perms)
+	}
+}
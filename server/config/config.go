@@ -2,56 +2,134 @@ package config
 
 import (
 	"bytes"
-	"log"
 	"os/user"
 	"path/filepath"
 	"regexp"
 	"strings"
 
+	"github.com/jedevc/apparea/server/audit"
+	"github.com/jedevc/apparea/server/throttle"
 	"golang.org/x/crypto/ssh"
 )
 
 var IsValidUsername = regexp.MustCompile(`^([a-zA-Z0-9]+)(\.[a-zA-Z0-9]+)*$`).MatchString
 
-var configDirectory string
-
-func init() {
+// DefaultDirectory returns the default location of the config directory,
+// ~/.apparea.
+func DefaultDirectory() (string, error) {
 	user, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	configDirectory = filepath.Join(user.HomeDir, ".apparea")
+	return filepath.Join(user.HomeDir, ".apparea"), nil
 }
 
 type Config struct {
-	Users     Users
-	SSHConfig *ssh.ServerConfig `json:"-"`
+	Users         Users
+	Authenticator Authenticator     `json:"-"`
+	SSHConfig     *ssh.ServerConfig `json:"-"`
+
+	// TrustedUserCAKeys are the certificate authorities trusted to sign user
+	// certificates, which are accepted for any username in their principals.
+	TrustedUserCAKeys []ssh.PublicKey `json:"-"`
+
+	// RevokedKeys are refused in certificates, either as the certified key
+	// or as the authority that signed it.
+	RevokedKeys []ssh.PublicKey `json:"-"`
+
+	// Tokens contains the single-use guest access tokens, accepted using
+	// keyboard-interactive or password authentication.
+	Tokens *TokenStore `json:"-"`
+
+	// HostKeys are the server's active host keys, and NextHostKeys are
+	// advertised to clients ahead of rotating to them.
+	HostKeys     []ssh.Signer `json:"-"`
+	NextHostKeys []ssh.Signer `json:"-"`
+
+	// Admins are granted admin permissions, regardless of how they
+	// authenticated.
+	Admins []string `json:"-"`
+
+	// Audit records authentication failures, if set.
+	Audit *audit.Logger `json:"-"`
+
+	// Throttle blocks and bans sources with repeated authentication
+	// failures, if set.
+	Throttle *throttle.Tracker `json:"-"`
 }
 
-type Users map[string]User
+// NewConfig creates a config from an in-memory set of users and host keys,
+// without touching the filesystem. By default, users are authenticated
+// against the provided users, but this can be changed by replacing the
+// config's Authenticator.
+func NewConfig(users Users, hostKeys ...ssh.Signer) (*Config, error) {
+	config := &Config{
+		Users:         users,
+		Authenticator: users,
+		HostKeys:      hostKeys,
+	}
 
-func (users Users) LookupUser(username string) (User, []string, bool) {
-	if !IsValidUsername(username) {
-		return User{}, nil, false
+	sshConfig, err := makeSSHServerConfig(config, hostKeys)
+	if err != nil {
+		return nil, err
 	}
+	config.SSHConfig = sshConfig
 
-	userParts := strings.Split(username, ".")
-	if len(userParts) == 0 {
+	return config, nil
+}
+
+func (config *Config) isAdmin(username string) bool {
+	for _, admin := range config.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitUsername splits a login name of the form "user.sub" into the base
+// username and the requested subdomain parts, ordered from outermost to
+// innermost.
+func SplitUsername(login string) (string, []string, bool) {
+	if !IsValidUsername(login) {
+		return "", nil, false
+	}
+
+	parts := strings.Split(login, ".")
+	username, parts := parts[0], parts[1:]
+	for i := 0; i < len(parts)/2; i++ {
+		j := len(parts) - 1 - i
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return username, parts, true
+}
+
+type Users map[string]User
+
+func (users Users) LookupUser(login string) (User, []string, bool) {
+	username, parts, ok := SplitUsername(login)
+	if !ok {
 		return User{}, nil, false
 	}
 
-	user, ok := users[userParts[0]]
+	user, ok := users[username]
 	if !ok {
 		return User{}, nil, false
 	}
 
-	userParts = userParts[1:]
-	for i := 0; i < len(userParts)/2; i++ {
-		j := len(userParts) - 1
-		userParts[i], userParts[j] = userParts[j], userParts[i]
+	return user, parts, true
+}
+
+func (users Users) Authenticate(username string, key ssh.PublicKey) (*Permissions, error) {
+	user, ok := users[username]
+	if !ok || !user.CheckKey(key) {
+		return nil, ErrInvalidCredentials
 	}
-	return user, userParts, true
+
+	return &Permissions{
+		Username: username,
+	}, nil
 }
 
 type User struct {
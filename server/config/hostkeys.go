@@ -0,0 +1,259 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyTypes are the types of host key generated for the server.
+var HostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+const (
+	hostKeyDirectory        = "hostkeys"
+	nextHostKeyDirectory    = "hostkeys/next"
+	retiredHostKeyDirectory = "hostkeys/retired"
+
+	// legacyHostKeyFilename is the single rsa key created by older versions
+	legacyHostKeyFilename = "id_rsa"
+)
+
+// GenerateHostKey generates a new private key of the given type, returning
+// it PEM encoded.
+func GenerateHostKey(keyType string) ([]byte, ssh.PublicKey, error) {
+	var private crypto.Signer
+	var block *pem.Block
+
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		bs, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		private = key
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: bs}
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		bs, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		private = key
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: bs}
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, nil, err
+		}
+		private = key
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return nil, nil, fmt.Errorf("unknown host key type %q", keyType)
+	}
+
+	public, err := ssh.NewPublicKey(private.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(block), public, nil
+}
+
+func hostKeyFilename(keyType string) string {
+	return fmt.Sprintf("ssh_host_%s_key", keyType)
+}
+
+// writeHostKey generates a new host key of the given type into the
+// directory, along with its public key.
+func writeHostKey(directory string, keyType string) error {
+	err := os.MkdirAll(directory, os.ModeDir|0o700)
+	if err != nil {
+		return err
+	}
+
+	private, public, err := GenerateHostKey(keyType)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(directory, hostKeyFilename(keyType))
+	err = writeFileAtomic(path, private, 0o600)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".pub", ssh.MarshalAuthorizedKey(public), 0o644)
+}
+
+// loadHostKeyDirectory loads all the private host keys in a directory,
+// which may not exist.
+func loadHostKeyDirectory(directory string) ([]ssh.Signer, error) {
+	paths, err := filepath.Glob(filepath.Join(directory, "ssh_host_*_key"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var signers []ssh.Signer
+	for _, path := range paths {
+		signer, err := loadHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	privateBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load server private key: %w", err)
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse server private key %s: %w", path, err)
+	}
+
+	return private, nil
+}
+
+// loadHostKeys loads the server's active host keys, and the next host keys
+// which are advertised to clients ahead of a rotation.
+func loadHostKeys(configDirectory string) ([]ssh.Signer, []ssh.Signer, error) {
+	var active []ssh.Signer
+
+	// support the single rsa key created by older versions, which is loaded
+	// first so that it's overridden by newer keys of the same type
+	legacyPath := filepath.Join(configDirectory, legacyHostKeyFilename)
+	if _, err := os.Stat(legacyPath); err == nil {
+		legacy, err := loadHostKey(legacyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		active = append(active, legacy)
+	}
+
+	keys, err := loadHostKeyDirectory(filepath.Join(configDirectory, hostKeyDirectory))
+	if err != nil {
+		return nil, nil, err
+	}
+	active = append(active, keys...)
+
+	next, err := loadHostKeyDirectory(filepath.Join(configDirectory, nextHostKeyDirectory))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return active, next, nil
+}
+
+// HostKeys lists the public keys of the active and next host keys in the
+// config directory.
+func HostKeys(configDirectory string) ([]ssh.PublicKey, []ssh.PublicKey, error) {
+	active, next, err := loadHostKeys(configDirectory)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return publicKeys(active), publicKeys(next), nil
+}
+
+func publicKeys(signers []ssh.Signer) []ssh.PublicKey {
+	keys := make([]ssh.PublicKey, 0, len(signers))
+	for _, signer := range signers {
+		keys = append(keys, signer.PublicKey())
+	}
+	return keys
+}
+
+// RotateHostKeys generates a new set of next host keys. These are advertised
+// to clients (using the hostkeys-00@openssh.com extension) alongside the
+// active keys, so that clients can learn them before they are promoted.
+func RotateHostKeys(configDirectory string) error {
+	for _, keyType := range HostKeyTypes {
+		err := writeHostKey(filepath.Join(configDirectory, nextHostKeyDirectory), keyType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PromoteHostKeys replaces the active host keys with the next host keys. The
+// previously active keys are moved into the retired directory.
+func PromoteHostKeys(configDirectory string) error {
+	nextDir := filepath.Join(configDirectory, nextHostKeyDirectory)
+	activeDir := filepath.Join(configDirectory, hostKeyDirectory)
+	retiredDir := filepath.Join(configDirectory, retiredHostKeyDirectory)
+
+	next, err := filepath.Glob(filepath.Join(nextDir, "ssh_host_*_key"))
+	if err != nil {
+		return err
+	}
+	if len(next) == 0 {
+		return fmt.Errorf("no host keys to promote (use rotate first)")
+	}
+
+	err = os.MkdirAll(retiredDir, os.ModeDir|0o700)
+	if err != nil {
+		return err
+	}
+
+	retire := func(path string) error {
+		for _, p := range []string{path, path + ".pub"} {
+			err := os.Rename(p, filepath.Join(retiredDir, filepath.Base(p)))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	active, err := filepath.Glob(filepath.Join(activeDir, "ssh_host_*_key"))
+	if err != nil {
+		return err
+	}
+	for _, path := range active {
+		err := retire(path)
+		if err != nil {
+			return err
+		}
+	}
+	legacyPath := filepath.Join(configDirectory, legacyHostKeyFilename)
+	if _, err := os.Stat(legacyPath); err == nil {
+		err := retire(legacyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range next {
+		for _, p := range []string{path, path + ".pub"} {
+			err := os.Rename(p, filepath.Join(activeDir, filepath.Base(p)))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func marshalKeys(keys []ssh.PublicKey) []string {
+	marshalled := make([]string, 0, len(keys))
+	for _, key := range keys {
+		marshalled = append(marshalled, string(key.Marshal()))
+	}
+	return marshalled
+}
+
+func TestRotateHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apparea-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := InitializeConfigs(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	legacy, legacyKey, err := GenerateHostKey("rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, legacyHostKeyFilename), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	active, next, err := HostKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != len(HostKeyTypes)+1 || len(next) != 0 {
+		t.Fatalf("expected %d active keys and no next keys, got %d and %d", len(HostKeyTypes)+1, len(active), len(next))
+	}
+	if string(active[0].Marshal()) != string(legacyKey.Marshal()) {
+		t.Error("expected the legacy key to be loaded first")
+	}
+
+	if err := PromoteHostKeys(dir); err == nil {
+		t.Error("expected promoting without rotating first to fail")
+	}
+
+	// rotating advertises new keys, without changing the active keys
+	if err := RotateHostKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+	rotatedActive, rotatedNext, err := HostKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotatedNext) != len(HostKeyTypes) {
+		t.Fatalf("expected %d next keys, got %d", len(HostKeyTypes), len(rotatedNext))
+	}
+	if got, expected := marshalKeys(rotatedActive), marshalKeys(active); len(got) != len(expected) {
+		t.Fatalf("expected the active keys to be kept, got %d", len(got))
+	} else {
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("active key %d changed after rotating", i)
+			}
+		}
+	}
+
+	// promoting makes the next keys active, and retires the old ones
+	if err := PromoteHostKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+	promotedActive, promotedNext, err := HostKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(promotedNext) != 0 {
+		t.Errorf("expected no next keys after promoting, got %d", len(promotedNext))
+	}
+	if got, expected := marshalKeys(promotedActive), marshalKeys(rotatedNext); len(got) != len(expected) {
+		t.Fatalf("expected the next keys to be active, got %d keys", len(got))
+	} else {
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("active key %d isn't the promoted key", i)
+			}
+		}
+	}
+
+	retired, err := loadHostKeyDirectory(filepath.Join(dir, retiredHostKeyDirectory))
+	if err != nil || len(retired) != len(HostKeyTypes) {
+		t.Errorf("expected %d retired keys, got %d (%v)", len(HostKeyTypes), len(retired), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, retiredHostKeyDirectory, legacyHostKeyFilename)); err != nil {
+		t.Errorf("expected the legacy key to be retired: %s", err)
+	}
+}
@@ -1,14 +1,33 @@
 package config
 
 import (
+	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 )
 
-func InitializeConfigs(force bool) error {
-	if force {
-		err := os.RemoveAll(configDirectory)
+// InitializeConfigs creates the host keys and an empty authorized_keys in the
+// config directory. Existing host keys (including the legacy id_rsa, and any
+// next or retired keys) and authorized_keys are only replaced when force is
+// set, and other files in the directory, like the state database and audit
+// log, are always kept.
+func InitializeConfigs(configDirectory string, force bool) error {
+	hostKeyPath := filepath.Join(configDirectory, hostKeyDirectory)
+	legacyPath := filepath.Join(configDirectory, legacyHostKeyFilename)
+	authKeyPath := filepath.Join(configDirectory, "authorized_keys")
+
+	for _, path := range []string{hostKeyPath, legacyPath, legacyPath + ".pub", authKeyPath} {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !force {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+		err = os.RemoveAll(path)
 		if err != nil {
 			return err
 		}
@@ -19,18 +38,14 @@ func InitializeConfigs(force bool) error {
 		return err
 	}
 
-	cmd := exec.Command(
-		"ssh-keygen",
-		"-N", "",
-		"-f", filepath.Join(configDirectory, "id_rsa"),
-		"-t", "rsa", "-b", "4096")
-	err = cmd.Run()
-	if err != nil {
-		return err
+	for _, keyType := range HostKeyTypes {
+		err = writeHostKey(hostKeyPath, keyType)
+		if err != nil {
+			return err
+		}
 	}
 
-	authKeyPath := filepath.Join(configDirectory, "authorized_keys")
-	authKeyFile, err := os.Create(authKeyPath)
+	authKeyFile, err := os.OpenFile(authKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
 	if err != nil {
 		return err
 	}
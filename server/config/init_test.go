@@ -0,0 +1,80 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitializeConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apparea-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := InitializeConfigs(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadHostKeyDirectory(filepath.Join(dir, hostKeyDirectory))
+	if err != nil || len(keys) != len(HostKeyTypes) {
+		t.Fatalf("expected %d host keys, got %d (%v)", len(HostKeyTypes), len(keys), err)
+	}
+
+	authKeyPath := filepath.Join(dir, "authorized_keys")
+	statePath := filepath.Join(dir, "state.db")
+	for _, path := range []string{authKeyPath, statePath} {
+		if err := ioutil.WriteFile(path, []byte("data"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// running setup again must not touch a live config
+	if err := InitializeConfigs(dir, false); err == nil {
+		t.Fatal("expected setup to refuse to overwrite the existing config")
+	}
+	again, err := loadHostKeyDirectory(filepath.Join(dir, hostKeyDirectory))
+	if err != nil || len(again) != len(keys) {
+		t.Fatalf("expected the host keys to be kept, got %d (%v)", len(again), err)
+	}
+	for i := range keys {
+		if string(keys[i].PublicKey().Marshal()) != string(again[i].PublicKey().Marshal()) {
+			t.Errorf("host key %d was replaced", i)
+		}
+	}
+	if data, _ := ioutil.ReadFile(authKeyPath); string(data) != "data" {
+		t.Errorf("expected authorized_keys to be kept, got %q", data)
+	}
+
+	// forcing replaces the keys and users, but nothing else, including the
+	// legacy key, which would otherwise still be loaded
+	legacy, _, err := GenerateHostKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, legacyHostKeyFilename), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RotateHostKeys(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitializeConfigs(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	active, next, err := HostKeys(dir)
+	if err != nil || len(active) != len(HostKeyTypes) || len(next) != 0 {
+		t.Fatalf("expected only %d new host keys, got %d active and %d next (%v)", len(HostKeyTypes), len(active), len(next), err)
+	}
+	for i := range keys {
+		if string(keys[i].PublicKey().Marshal()) == string(active[i].Marshal()) {
+			t.Errorf("host key %d was kept", i)
+		}
+	}
+	if data, _ := ioutil.ReadFile(authKeyPath); len(data) != 0 {
+		t.Errorf("expected authorized_keys to be emptied, got %q", data)
+	}
+	if data, _ := ioutil.ReadFile(statePath); string(data) != "data" {
+		t.Errorf("expected state.db to be kept, got %q", data)
+	}
+}
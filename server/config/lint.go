@@ -0,0 +1,50 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LintAuthorizedKeys checks the contents of an authorized_keys file for
+// problems that ParseUsers accepts, but that are almost certainly mistakes:
+// keys that can't be parsed, usernames that can't be logged in as, and keys
+// that are listed more than once.
+func LintAuthorizedKeys(authKeyBytes []byte) []string {
+	var problems []string
+
+	seen := make(map[string]string)
+	for i, line := range bytes.Split(authKeyBytes, []byte("\n")) {
+		lineno := i + 1
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, username, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: could not parse key: %s", lineno, err))
+			continue
+		}
+
+		// the username is split on dots to find the subdomain, so a dotted
+		// username could never log in
+		if len(username) == 0 {
+			problems = append(problems, fmt.Sprintf("line %d: missing username", lineno))
+		} else if !IsValidUsername(username) || strings.Contains(username, ".") {
+			problems = append(problems, fmt.Sprintf("line %d: invalid username %q", lineno, username))
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if previous, ok := seen[fingerprint]; ok {
+			problems = append(problems, fmt.Sprintf("line %d: duplicate key %s (already used on %s)", lineno, fingerprint, previous))
+		} else {
+			seen[fingerprint] = fmt.Sprintf("line %d by %q", lineno, username)
+		}
+	}
+
+	return problems
+}
@@ -4,33 +4,67 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 
+	"github.com/jedevc/apparea/server/audit"
 	"golang.org/x/crypto/ssh"
 )
 
-func LoadConfig() (config Config, err error) {
-	config.Users, err = loadUsers()
+// LoadConfig loads the config from the config directory. The users in
+// authorized_keys are only loaded (and the file only required) for the file
+// authentication backend, since other backends look up users themselves.
+func LoadConfig(configDirectory string, auth AuthSettings) (*Config, error) {
+	var users Users
+	if auth.Backend == "file" {
+		var err error
+		users, err = LoadUsers(configDirectory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hostKeys, nextHostKeys, err := loadHostKeys(configDirectory)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	config.SSHConfig, err = makeSSHServerConfig(config.Users)
+	config, err := NewConfig(users, hostKeys...)
 	if err != nil {
-		return
+		return nil, err
 	}
+	config.NextHostKeys = nextHostKeys
+
+	config.TrustedUserCAKeys, err = loadKeyFile(filepath.Join(configDirectory, "trusted_user_ca_keys"))
+	if err != nil {
+		return nil, err
+	}
+	config.RevokedKeys, err = loadKeyFile(filepath.Join(configDirectory, "revoked_keys"))
+	if err != nil {
+		return nil, err
+	}
+
+	config.Tokens = NewTokenStore(filepath.Join(configDirectory, "tokens.json"))
 
-	return
+	return config, nil
 }
 
-func loadUsers() (map[string]User, error) {
+// LoadUsers loads the users from the authorized_keys file in the config
+// directory.
+func LoadUsers(configDirectory string) (Users, error) {
 	authKeyPath := filepath.Join(configDirectory, "authorized_keys")
 	authKeyBytes, err := ioutil.ReadFile(authKeyPath)
 	if err != nil {
 		return nil, err
 	}
 
-	users := make(map[string]User)
+	return ParseUsers(authKeyBytes)
+}
+
+// ParseUsers parses users from the contents of an authorized_keys file, where
+// the comment field of each key contains the username.
+func ParseUsers(authKeyBytes []byte) (Users, error) {
+	users := make(Users)
 	for len(authKeyBytes) > 0 {
 		pubKey, comment, _, rest, err := ssh.ParseAuthorizedKey(authKeyBytes)
 		if err != nil {
@@ -55,32 +89,137 @@ func loadUsers() (map[string]User, error) {
 	return users, nil
 }
 
-func makeSSHServerConfig(users Users) (*ssh.ServerConfig, error) {
+// loadKeyFile loads an optional file of keys, like trusted_user_ca_keys, in
+// the authorized_keys format.
+func loadKeyFile(path string) ([]ssh.PublicKey, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(keyBytes) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		keyBytes = rest
+	}
+
+	return keys, nil
+}
+
+func (config *Config) tokenCallback(c ssh.ConnMetadata, secret string) (*ssh.Permissions, error) {
+	username, _, ok := SplitUsername(c.User())
+	if !ok {
+		config.authFailure(c, "token", "", "invalid username")
+		return nil, ErrInvalidCredentials
+	}
+
+	perms, err := config.authenticateToken(username, secret)
+	if err != nil {
+		if err != ErrInvalidCredentials {
+			log.Printf("Authentication error for %s (%s): %s", c.User(), c.RemoteAddr(), err)
+		}
+		config.authFailure(c, "token", "", err.Error())
+		return nil, ErrInvalidCredentials
+	}
+
+	return perms.SSHPermissions(), nil
+}
+
+// authFailure records a failed authentication attempt in the audit log.
+// Sources are throttled by the server once the connection is over, since a
+// client may try several keys before one is accepted.
+func (config *Config) authFailure(c ssh.ConnMetadata, method string, fingerprint string, reason string) {
+	config.Audit.Log(audit.Event{
+		Type:        audit.AuthFailure,
+		Login:       c.User(),
+		Method:      method,
+		Fingerprint: fingerprint,
+		SourceIP:    audit.SourceIP(c.RemoteAddr()),
+		Reason:      reason,
+	})
+}
+
+func makeSSHServerConfig(config *Config, hostKeys []ssh.Signer) (*ssh.ServerConfig, error) {
+	if len(hostKeys) == 0 {
+		return nil, fmt.Errorf("no host keys provided")
+	}
+
 	sshConfig := &ssh.ServerConfig{
 		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			user, _, ok := users.LookupUser(c.User())
-			if ok && user.CheckKey(key) {
-				return &ssh.Permissions{
-					Extensions: map[string]string{
-						"pubkey-fp": ssh.FingerprintSHA256(key),
-					},
-				}, nil
+			username, _, ok := SplitUsername(c.User())
+			if !ok {
+				config.authFailure(c, "publickey", ssh.FingerprintSHA256(key), "invalid username")
+				return nil, ErrInvalidCredentials
 			}
-			return nil, fmt.Errorf("Invalid credentials")
+
+			if cert, ok := key.(*ssh.Certificate); ok {
+				perms, err := config.authenticateCertificate(username, cert)
+				if err != nil {
+					log.Printf("Certificate rejected for %s (%s): %s", c.User(), c.RemoteAddr(), err)
+					config.authFailure(c, "certificate", ssh.FingerprintSHA256(cert.Key), err.Error())
+					return nil, ErrInvalidCredentials
+				}
+
+				perms.Admin = perms.Admin || config.isAdmin(perms.Username)
+				sshPerms := perms.SSHPermissions()
+				sshPerms.CriticalOptions = make(map[string]string, len(cert.CriticalOptions))
+				for opt, value := range cert.CriticalOptions {
+					sshPerms.CriticalOptions[opt] = value
+				}
+				sshPerms.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(cert.Key)
+				sshPerms.Extensions["cert-key-id"] = cert.KeyId
+				return sshPerms, nil
+			}
+
+			if config.Authenticator == nil {
+				config.authFailure(c, "publickey", ssh.FingerprintSHA256(key), "no authenticator")
+				return nil, ErrInvalidCredentials
+			}
+
+			perms, err := config.Authenticator.Authenticate(username, key)
+			if err != nil {
+				if err != ErrInvalidCredentials {
+					log.Printf("Authentication error for %s (%s): %s", c.User(), c.RemoteAddr(), err)
+				}
+				config.authFailure(c, "publickey", ssh.FingerprintSHA256(key), err.Error())
+				return nil, ErrInvalidCredentials
+			}
+
+			perms.Admin = perms.Admin || config.isAdmin(perms.Username)
+			sshPerms := perms.SSHPermissions()
+			sshPerms.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(key)
+			return sshPerms, nil
 		},
-	}
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if config.Tokens == nil {
+				return nil, ErrInvalidCredentials
+			}
 
-	privateBytes, err := ioutil.ReadFile(filepath.Join(configDirectory, "id_rsa"))
-	if err != nil {
-		log.Fatalf("Could not load server private key: %s", err)
-	}
+			answers, err := client(c.User(), "Enter your apparea guest access token.", []string{"Token: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 {
+				return nil, ErrInvalidCredentials
+			}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		log.Fatalf("Could not parse server private key: %s", err)
+			return config.tokenCallback(c, answers[0])
+		},
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return config.tokenCallback(c, string(password))
+		},
 	}
 
-	sshConfig.AddHostKey(private)
+	for _, hostKey := range hostKeys {
+		sshConfig.AddHostKey(hostKey)
+	}
 
 	return sshConfig, nil
 }
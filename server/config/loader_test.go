@@ -0,0 +1,42 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apparea-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := InitializeConfigs(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "authorized_keys")); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the file backend reads users from authorized_keys
+	tests := []struct {
+		backend string
+		ok      bool
+	}{
+		{"file", false},
+		{"directory", true},
+		{"webhook", true},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(dir, AuthSettings{Backend: test.backend})
+		if test.ok && err != nil {
+			t.Errorf("%s: expected config to load without authorized_keys, got %s", test.backend, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected missing authorized_keys to be an error", test.backend)
+		}
+	}
+}
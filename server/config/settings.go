@@ -0,0 +1,314 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jedevc/apparea/server/forward"
+)
+
+// Settings is the declarative configuration of the server process, usually
+// loaded from a TOML file. The users, host keys and other credentials still
+// live in the config directory.
+type Settings struct {
+	Hostname        string   `toml:"hostname"`
+	ConfigDir       string   `toml:"config_dir"`
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+
+	SSH    SSHSettings   `toml:"ssh"`
+	HTTP   HTTPSettings  `toml:"http"`
+	TLS    TLSSettings   `toml:"tls"`
+	Auth   AuthSettings  `toml:"auth"`
+	Limits LimitSettings `toml:"limits"`
+	Log    LogSettings   `toml:"log"`
+	State  StateSettings `toml:"state"`
+	Audit  AuditSettings `toml:"audit"`
+	Sites  SitesSettings `toml:"sites"`
+
+	// Visitors restricts the addresses that may reach each user's public
+	// tunnels, by username.
+	Visitors map[string]VisitorSettings `toml:"visitors"`
+
+	ProxyProtocol ProxyProtocolSettings `toml:"proxy_protocol"`
+}
+
+type SSHSettings struct {
+	Bind             string   `toml:"bind"`
+	HandshakeTimeout Duration `toml:"handshake_timeout"`
+}
+
+type HTTPSettings struct {
+	Bind           string   `toml:"bind"`
+	ReadTimeout    Duration `toml:"read_timeout"`
+	WriteTimeout   Duration `toml:"write_timeout"`
+	MaxHeaderBytes int      `toml:"max_header_bytes"`
+
+	// MaxCacheBytes limits the total size of the response caches of all
+	// tunnels that enable caching, or disables caching when zero.
+	MaxCacheBytes int64 `toml:"max_cache_bytes"`
+}
+
+// TLSSettings configures an optional HTTPS listener, terminated by the
+// server itself rather than a reverse proxy in front of it.
+type TLSSettings struct {
+	Bind string `toml:"bind"`
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+}
+
+type AuthSettings struct {
+	Backend   string `toml:"backend"`
+	Directory string `toml:"directory"`
+	Webhook   string `toml:"webhook"`
+
+	// Admins are the usernames granted admin permissions.
+	Admins []string `toml:"admins"`
+}
+
+// LimitSettings bound the resources used by clients. Zero means unlimited.
+type LimitSettings struct {
+	MaxSessions           int `toml:"max_sessions"`
+	MaxForwardsPerSession int `toml:"max_forwards_per_session"`
+	MaxUnauthenticated    int `toml:"max_unauthenticated"`
+
+	// BanAfter is the number of authentication failures after which a
+	// source IP is banned for BanDuration.
+	BanAfter    int      `toml:"ban_after"`
+	BanDuration Duration `toml:"ban_duration"`
+}
+
+type LogSettings struct {
+	// File is the path that logs are appended to, or empty for stderr.
+	File string `toml:"file"`
+}
+
+type StateSettings struct {
+	// Path is the location of the state database, which defaults to
+	// state.db in the config directory.
+	Path string `toml:"path"`
+}
+
+type AuditSettings struct {
+	// File is the path of the audit log, which defaults to audit.log in the
+	// config directory.
+	File string `toml:"file"`
+}
+
+// SitesSettings configure the static sites that users upload over SFTP.
+type SitesSettings struct {
+	// Enabled turns on SFTP uploads and site hosting, which are off by
+	// default.
+	Enabled bool `toml:"enabled"`
+
+	// Directory is where the sites are stored, which defaults to sites in
+	// the config directory.
+	Directory string `toml:"directory"`
+
+	// Quota limits the total size of each user's sites in bytes, or is zero
+	// for no limit.
+	Quota int64 `toml:"quota"`
+}
+
+// VisitorSettings are lists of networks, in CIDR notation, that visitors
+// must (Allow) or must not (Deny) connect from.
+type VisitorSettings struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+// ProxyProtocolSettings enable reading the original client's address from
+// PROXY protocol headers sent by the Trusted load balancers (a list of
+// addresses or CIDR networks), on the given Listeners ("ssh", "http",
+// "https" and "tcp", for raw tcp forwards).
+type ProxyProtocolSettings struct {
+	Trusted   []string `toml:"trusted"`
+	Listeners []string `toml:"listeners"`
+}
+
+// Duration is a time.Duration that is written as a string, like "30s", in
+// the settings file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// DefaultSettings returns the settings used when no settings file is given.
+func DefaultSettings() Settings {
+	return Settings{
+		Hostname:        "apparea.dev",
+		ShutdownTimeout: Duration{30 * time.Second},
+		SSH: SSHSettings{
+			Bind:             ":2200",
+			HandshakeTimeout: Duration{30 * time.Second},
+		},
+		HTTP: HTTPSettings{
+			Bind:           ":8000",
+			ReadTimeout:    Duration{10 * time.Second},
+			WriteTimeout:   Duration{10 * time.Second},
+			MaxHeaderBytes: 1 << 20,
+			MaxCacheBytes:  forward.DefaultMaxCacheSize,
+		},
+		Auth: AuthSettings{
+			Backend: "file",
+		},
+		Limits: LimitSettings{
+			MaxUnauthenticated: 64,
+			BanAfter:           20,
+			BanDuration:        Duration{15 * time.Minute},
+		},
+		Sites: SitesSettings{
+			Quota: 100 << 20,
+		},
+	}
+}
+
+// LoadSettings reads a settings file on top of the default settings. Unknown
+// keys are rejected, so that typos don't silently fall back to defaults.
+func LoadSettings(path string) (Settings, error) {
+	settings := DefaultSettings()
+
+	meta, err := toml.DecodeFile(path, &settings)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return settings, err
+		}
+		return settings, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return settings, fmt.Errorf("unknown settings in %s: %s", path, strings.Join(keys, ", "))
+	}
+
+	return settings, nil
+}
+
+// Validate checks that the settings are usable, returning the first problem
+// found.
+func (s Settings) Validate() error {
+	if len(s.Hostname) == 0 {
+		return fmt.Errorf("hostname must not be empty")
+	}
+	if strings.ContainsAny(s.Hostname, "/: ") {
+		return fmt.Errorf("invalid hostname %q", s.Hostname)
+	}
+
+	if err := validateBind("ssh.bind", s.SSH.Bind); err != nil {
+		return err
+	}
+	if err := validateBind("http.bind", s.HTTP.Bind); err != nil {
+		return err
+	}
+
+	durations := []struct {
+		name  string
+		value Duration
+	}{
+		{"shutdown_timeout", s.ShutdownTimeout},
+		{"ssh.handshake_timeout", s.SSH.HandshakeTimeout},
+		{"http.read_timeout", s.HTTP.ReadTimeout},
+		{"http.write_timeout", s.HTTP.WriteTimeout},
+		{"limits.ban_duration", s.Limits.BanDuration},
+	}
+	for _, d := range durations {
+		if d.value.Duration < 0 {
+			return fmt.Errorf("%s must not be negative", d.name)
+		}
+	}
+	if s.HTTP.MaxHeaderBytes < 0 {
+		return fmt.Errorf("http.max_header_bytes must not be negative")
+	}
+	if s.HTTP.MaxCacheBytes < 0 {
+		return fmt.Errorf("http.max_cache_bytes must not be negative")
+	}
+	if s.Sites.Quota < 0 {
+		return fmt.Errorf("sites.quota must not be negative")
+	}
+	if s.Limits.MaxSessions < 0 {
+		return fmt.Errorf("limits.max_sessions must not be negative")
+	}
+	if s.Limits.MaxForwardsPerSession < 0 {
+		return fmt.Errorf("limits.max_forwards_per_session must not be negative")
+	}
+	if s.Limits.MaxUnauthenticated < 0 {
+		return fmt.Errorf("limits.max_unauthenticated must not be negative")
+	}
+	if s.Limits.BanAfter < 0 {
+		return fmt.Errorf("limits.ban_after must not be negative")
+	}
+
+	if len(s.TLS.Bind) > 0 {
+		if err := validateBind("tls.bind", s.TLS.Bind); err != nil {
+			return err
+		}
+		if len(s.TLS.Cert) == 0 || len(s.TLS.Key) == 0 {
+			return fmt.Errorf("tls.bind requires both tls.cert and tls.key")
+		}
+	} else if len(s.TLS.Cert) > 0 || len(s.TLS.Key) > 0 {
+		return fmt.Errorf("tls.cert and tls.key require tls.bind")
+	}
+
+	for username, visitors := range s.Visitors {
+		for _, cidrs := range [][]string{visitors.Allow, visitors.Deny} {
+			if _, err := forward.ParseCIDRs(cidrs); err != nil {
+				return fmt.Errorf("visitors.%s: %w", username, err)
+			}
+		}
+	}
+
+	if _, err := forward.ParseCIDRs(s.ProxyProtocol.Trusted); err != nil {
+		return fmt.Errorf("proxy_protocol.trusted: %w", err)
+	}
+	for _, listener := range s.ProxyProtocol.Listeners {
+		switch listener {
+		case "ssh", "http", "https", "tcp":
+		default:
+			return fmt.Errorf("unknown proxy_protocol listener %q", listener)
+		}
+	}
+	if len(s.ProxyProtocol.Listeners) > 0 && len(s.ProxyProtocol.Trusted) == 0 {
+		return fmt.Errorf("proxy_protocol.listeners requires proxy_protocol.trusted")
+	}
+
+	switch s.Auth.Backend {
+	case "file":
+	case "directory":
+		if len(s.Auth.Directory) == 0 {
+			return fmt.Errorf("directory authentication requires auth.directory")
+		}
+	case "webhook":
+		if len(s.Auth.Webhook) == 0 {
+			return fmt.Errorf("webhook authentication requires auth.webhook")
+		}
+	default:
+		return fmt.Errorf("unknown authentication backend %q", s.Auth.Backend)
+	}
+
+	return nil
+}
+
+func validateBind(name string, address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid %s address %q: %w", name, address, err)
+	}
+	if len(port) == 0 {
+		return fmt.Errorf("invalid %s address %q: missing port", name, address)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSettings(t *testing.T, contents string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "apparea-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "apparea.toml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSettings(t *testing.T) {
+	path := writeSettings(t, `
+hostname = "example.com"
+
+[http]
+read_timeout = "1m"
+
+[limits]
+ban_after = 5
+
+[visitors.alice]
+allow = ["10.0.0.0/8"]
+`)
+	settings, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := DefaultSettings()
+	if settings.Hostname != "example.com" {
+		t.Errorf("expected hostname example.com, got %q", settings.Hostname)
+	}
+	if settings.HTTP.ReadTimeout.Duration != time.Minute {
+		t.Errorf("expected http.read_timeout 1m, got %s", settings.HTTP.ReadTimeout)
+	}
+	if settings.Limits.BanAfter != 5 {
+		t.Errorf("expected limits.ban_after 5, got %d", settings.Limits.BanAfter)
+	}
+	if len(settings.Visitors["alice"].Allow) != 1 {
+		t.Errorf("expected visitors for alice, got %v", settings.Visitors)
+	}
+
+	// everything else keeps its default
+	if settings.HTTP.Bind != defaults.HTTP.Bind || settings.HTTP.WriteTimeout != defaults.HTTP.WriteTimeout {
+		t.Errorf("expected the other http settings to be defaults, got %+v", settings.HTTP)
+	}
+	if settings.Limits.BanDuration != defaults.Limits.BanDuration || settings.Limits.MaxUnauthenticated != defaults.Limits.MaxUnauthenticated {
+		t.Errorf("expected the other limits to be defaults, got %+v", settings.Limits)
+	}
+	if settings.Auth.Backend != "file" {
+		t.Errorf("expected the file auth backend, got %q", settings.Auth.Backend)
+	}
+}
+
+func TestLoadSettingsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{"unknown key", `hostnme = "example.com"`, "hostnme"},
+		{"unknown section key", "[http]\nbnd = \":80\"", "http.bnd"},
+		{"unknown section", "[tunnels]\nmax = 1", "tunnels"},
+		{"invalid duration", "[http]\nread_timeout = \"forever\"", "could not parse"},
+		{"wrong type", "[limits]\nban_after = \"lots\"", "could not parse"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadSettings(writeSettings(t, test.contents))
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected an error containing %q, got %v", test.expected, err)
+			}
+		})
+	}
+
+	if _, err := LoadSettings(filepath.Join(os.TempDir(), "apparea-missing.toml")); !os.IsNotExist(err) {
+		t.Errorf("expected a missing settings file to be reported, got %v", err)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	if err := DefaultSettings().Validate(); err != nil {
+		t.Fatalf("expected the default settings to be valid, got %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *Settings)
+		valid  bool
+	}{
+		{"empty hostname", func(s *Settings) { s.Hostname = "" }, false},
+		{"hostname with port", func(s *Settings) { s.Hostname = "example.com:80" }, false},
+		{"ssh bind without port", func(s *Settings) { s.SSH.Bind = "localhost" }, false},
+		{"http bind with empty port", func(s *Settings) { s.HTTP.Bind = "localhost:" }, false},
+		{"negative timeout", func(s *Settings) { s.HTTP.ReadTimeout.Duration = -time.Second }, false},
+		{"negative shutdown timeout", func(s *Settings) { s.ShutdownTimeout.Duration = -time.Second }, false},
+		{"negative header bytes", func(s *Settings) { s.HTTP.MaxHeaderBytes = -1 }, false},
+		{"negative cache", func(s *Settings) { s.HTTP.MaxCacheBytes = -1 }, false},
+		{"no cache", func(s *Settings) { s.HTTP.MaxCacheBytes = 0 }, true},
+		{"negative quota", func(s *Settings) { s.Sites.Quota = -1 }, false},
+		{"negative sessions", func(s *Settings) { s.Limits.MaxSessions = -1 }, false},
+		{"negative forwards", func(s *Settings) { s.Limits.MaxForwardsPerSession = -1 }, false},
+		{"negative ban after", func(s *Settings) { s.Limits.BanAfter = -1 }, false},
+		{"tls", func(s *Settings) {
+			s.TLS = TLSSettings{Bind: ":443", Cert: "cert.pem", Key: "key.pem"}
+		}, true},
+		{"tls without key", func(s *Settings) {
+			s.TLS = TLSSettings{Bind: ":443", Cert: "cert.pem"}
+		}, false},
+		{"tls without bind", func(s *Settings) {
+			s.TLS = TLSSettings{Cert: "cert.pem", Key: "key.pem"}
+		}, false},
+		{"visitors", func(s *Settings) {
+			s.Visitors = map[string]VisitorSettings{"alice": {Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}}
+		}, true},
+		{"invalid visitors", func(s *Settings) {
+			s.Visitors = map[string]VisitorSettings{"alice": {Deny: []string{"10.0.0.0/33"}}}
+		}, false},
+		{"proxy protocol", func(s *Settings) {
+			s.ProxyProtocol = ProxyProtocolSettings{Trusted: []string{"10.0.0.0/8"}, Listeners: []string{"ssh", "http"}}
+		}, true},
+		{"proxy protocol without trusted", func(s *Settings) {
+			s.ProxyProtocol = ProxyProtocolSettings{Listeners: []string{"ssh"}}
+		}, false},
+		{"unknown proxy protocol listener", func(s *Settings) {
+			s.ProxyProtocol = ProxyProtocolSettings{Trusted: []string{"10.0.0.0/8"}, Listeners: []string{"udp"}}
+		}, false},
+		{"directory backend", func(s *Settings) {
+			s.Auth = AuthSettings{Backend: "directory", Directory: "/etc/apparea/users"}
+		}, true},
+		{"directory backend without directory", func(s *Settings) { s.Auth.Backend = "directory" }, false},
+		{"webhook backend without url", func(s *Settings) { s.Auth.Backend = "webhook" }, false},
+		{"unknown backend", func(s *Settings) { s.Auth.Backend = "ldap" }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := DefaultSettings()
+			test.modify(&settings)
+			err := settings.Validate()
+			if test.valid && err != nil {
+				t.Errorf("expected the settings to be valid, got %s", err)
+			} else if !test.valid && err == nil {
+				t.Error("expected the settings to be invalid")
+			}
+		})
+	}
+}
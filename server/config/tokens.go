@@ -0,0 +1,210 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token is a single-use guest access token, allowing a guest to connect as
+// the token's username using keyboard-interactive or password
+// authentication, limited to the token's subdomains.
+type Token struct {
+	ID         string    `json:"id"`
+	Hash       string    `json:"hash"`
+	Username   string    `json:"username"`
+	Subdomains []string  `json:"subdomains,omitempty"`
+	Expires    time.Time `json:"expires"`
+}
+
+func (token Token) Expired(now time.Time) bool {
+	return !now.Before(token.Expires)
+}
+
+// TokenStore persists guest access tokens to a JSON file. Only a hash of
+// each token's secret is stored.
+type TokenStore struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+func NewTokenStore(path string) *TokenStore {
+	return &TokenStore{
+		Path: path,
+	}
+}
+
+// Create mints a new token for the username, valid for the given duration,
+// and returns the token's secret, which is never stored.
+func (store *TokenStore) Create(username string, subdomains []string, ttl time.Duration) (string, Token, error) {
+	if !IsValidUsername(username) || strings.Contains(username, ".") {
+		return "", Token{}, fmt.Errorf("invalid username %q", username)
+	}
+
+	id, err := randomHex(4)
+	if err != nil {
+		return "", Token{}, err
+	}
+	secret, err := randomHex(16)
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	token := Token{
+		ID:         id,
+		Hash:       hashToken(secret),
+		Username:   username,
+		Subdomains: subdomains,
+		Expires:    time.Now().Add(ttl),
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	tokens, err := store.load()
+	if err != nil {
+		return "", Token{}, err
+	}
+	tokens = append(tokens, token)
+	err = store.save(tokens)
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	return secret, token, nil
+}
+
+// List returns all tokens that have not yet expired or been used.
+func (store *TokenStore) List() ([]Token, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.load()
+}
+
+// Revoke removes the token with the given id.
+func (store *TokenStore) Revoke(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	tokens, err := store.load()
+	if err != nil {
+		return err
+	}
+
+	for i, token := range tokens {
+		if token.ID == id {
+			tokens = append(tokens[:i], tokens[i+1:]...)
+			return store.save(tokens)
+		}
+	}
+	return fmt.Errorf("no such token %q", id)
+}
+
+// Consume checks the secret against the username's tokens, and if it
+// matches an unexpired token, removes the token so it cannot be reused.
+func (store *TokenStore) Consume(username string, secret string) (*Token, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	tokens, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hashToken(secret)
+	for i, token := range tokens {
+		if token.Username != username {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+			continue
+		}
+
+		tokens = append(tokens[:i], tokens[i+1:]...)
+		err = store.save(tokens)
+		if err != nil {
+			return nil, err
+		}
+		return &token, nil
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// load reads all unexpired tokens from the store.
+func (store *TokenStore) load() ([]Token, error) {
+	data, err := ioutil.ReadFile(store.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var tokens []Token
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse tokens: %w", err)
+	}
+
+	now := time.Now()
+	valid := tokens[:0]
+	for _, token := range tokens {
+		if !token.Expired(now) {
+			valid = append(valid, token)
+		}
+	}
+	return valid, nil
+}
+
+func (store *TokenStore) save(tokens []Token) error {
+	if tokens == nil {
+		tokens = []Token{}
+	}
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.Path, data, 0o600)
+}
+
+func (config *Config) authenticateToken(username string, secret string) (*Permissions, error) {
+	if config.Tokens == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	token, err := config.Tokens.Consume(username, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Permissions{
+		Username:   token.Username,
+		Subdomains: token.Subdomains,
+		TokenID:    token.ID,
+	}, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	bs := make([]byte, n)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
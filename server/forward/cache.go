@@ -0,0 +1,598 @@
+package forward
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxCacheSize is the default limit on the total size of the caches
+// of all tunnels.
+const DefaultMaxCacheSize = 64 << 20
+
+// cacheableStatus are the response statuses that may be stored when the
+// backend gives them an explicit lifetime.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// Cache is an in-memory HTTP cache of a tunnel's responses, following the
+// rules for shared caches (RFC 7234): responses are only stored when the
+// backend allows it, are served while fresh, and are revalidated with their
+// ETag or Last-Modified once stale. Least recently used responses are
+// evicted to keep the cache within its size, and within the budget it
+// shares with other caches.
+type Cache struct {
+	budget  *cacheBudget
+	maxSize int64
+
+	size    int64
+	entries map[string]*cacheEntry
+	vary    map[string]*cacheVariants
+	lru     *list.List
+	closed  bool
+}
+
+// cacheBudget is the memory shared by a set of caches, like those of all of
+// a server's tunnels. Its lock guards each of the caches, so that the least
+// recently used responses of any of them can be evicted to make room.
+type cacheBudget struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+}
+
+// cacheVariants are the request headers that the stored responses for a
+// request URI vary on, and the number of them.
+type cacheVariants struct {
+	names []string
+	count int
+}
+
+type cacheEntry struct {
+	cache   *Cache
+	key     string
+	primary string
+	path    string
+
+	status int
+	header http.Header
+	body   []byte
+
+	// stored is when the response was received, age is its age at the time
+	// (from its Age header), and lifetime is how long it stays fresh
+	stored   time.Time
+	age      time.Duration
+	lifetime time.Duration
+
+	// elem is the entry's place in its cache's list, and budgetElem its
+	// place in the budget's
+	elem       *list.Element
+	budgetElem *list.Element
+}
+
+// cacheResult describes how a response was served, for the client log.
+type cacheResult string
+
+const (
+	cacheHit         cacheResult = "hit"
+	cacheMiss        cacheResult = "miss"
+	cacheRevalidated cacheResult = "revalidated"
+	cacheBypass      cacheResult = "bypass"
+)
+
+// NewCache creates a cache of at most maxSize bytes, with a budget of its
+// own.
+func NewCache(maxSize int64) *Cache {
+	return newCacheBudget(maxSize).newCache(maxSize)
+}
+
+func newCacheBudget(maxSize int64) *cacheBudget {
+	return &cacheBudget{
+		maxSize: maxSize,
+		lru:     list.New(),
+	}
+}
+
+// newCache creates a cache of at most maxSize bytes, that shares the budget
+// with its other caches.
+func (budget *cacheBudget) newCache(maxSize int64) *Cache {
+	return &Cache{
+		budget:  budget,
+		maxSize: maxSize,
+		entries: make(map[string]*cacheEntry),
+		vary:    make(map[string]*cacheVariants),
+		lru:     list.New(),
+	}
+}
+
+// Size returns the total size of the responses in the budget's caches.
+func (budget *cacheBudget) Size() int64 {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	return budget.size
+}
+
+// MaxSize returns the most bytes of responses the cache will hold.
+func (c *Cache) MaxSize() int64 {
+	return c.maxSize
+}
+
+// maxEntrySize is the largest response worth storing, so that one response
+// can't push out everything else.
+func (c *Cache) maxEntrySize() int64 {
+	return c.maxSize / 4
+}
+
+// Size returns the number of responses in the cache, and their total size.
+func (c *Cache) Size() (int, int64) {
+	c.budget.lock.Lock()
+	defer c.budget.lock.Unlock()
+	return len(c.entries), c.size
+}
+
+// Purge removes the stored responses for paths starting with prefix,
+// returning the number removed.
+func (c *Cache) Purge(prefix string) int {
+	c.budget.lock.Lock()
+	defer c.budget.lock.Unlock()
+
+	removed := 0
+	for _, entry := range c.entries {
+		if strings.HasPrefix(entry.path, prefix) {
+			c.remove(entry)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Close removes all of the cache's responses, returning their memory to the
+// budget, and stops it from storing any more.
+func (c *Cache) Close() {
+	c.budget.lock.Lock()
+	defer c.budget.lock.Unlock()
+
+	c.closed = true
+	for _, entry := range c.entries {
+		c.remove(entry)
+	}
+}
+
+// cacheable reports whether the cache may be used for the request at all.
+func cacheable(r *http.Request) bool {
+	if r.Method != "GET" || len(r.Header.Get("Range")) > 0 {
+		return false
+	}
+	return !parseCacheControl(r.Header)["no-store"]
+}
+
+// lookup finds the stored response for a request, if there is one,
+// returning a copy that's safe to use without holding the lock.
+func (c *Cache) lookup(r *http.Request) *cacheEntry {
+	c.budget.lock.Lock()
+	defer c.budget.lock.Unlock()
+
+	primary := r.URL.RequestURI()
+	variants, ok := c.vary[primary]
+	if !ok {
+		return nil
+	}
+	entry, ok := c.entries[cacheKey(primary, variants.names, r.Header)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(entry.elem)
+	c.budget.lru.MoveToFront(entry.budgetElem)
+	return entry.snapshot()
+}
+
+func (entry *cacheEntry) snapshot() *cacheEntry {
+	snapshot := *entry
+	snapshot.header = entry.header.Clone()
+	snapshot.elem = nil
+	snapshot.budgetElem = nil
+	return &snapshot
+}
+
+// fresh reports whether the entry can be served without revalidating it,
+// given the request's own Cache-Control.
+func (entry *cacheEntry) fresh(r *http.Request, now time.Time) bool {
+	directives := parseCacheControl(r.Header)
+	if directives["no-cache"] || (len(r.Header["Cache-Control"]) == 0 && strings.Contains(r.Header.Get("Pragma"), "no-cache")) {
+		return false
+	}
+
+	age := entry.currentAge(now)
+	if maxAge, ok := directiveSeconds(r.Header, "max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < entry.lifetime
+}
+
+func (entry *cacheEntry) currentAge(now time.Time) time.Duration {
+	return entry.age + now.Sub(entry.stored)
+}
+
+// validators returns the conditional headers to revalidate the entry with,
+// or nil if it has no validators.
+func (entry *cacheEntry) validators() http.Header {
+	header := make(http.Header)
+	if etag := entry.header.Get("ETag"); len(etag) > 0 {
+		header.Set("If-None-Match", etag)
+	}
+	if modified := entry.header.Get("Last-Modified"); len(modified) > 0 {
+		header.Set("If-Modified-Since", modified)
+	}
+	if len(header) == 0 {
+		return nil
+	}
+	return header
+}
+
+// response builds a response to a request from the entry. If the visitor
+// already has the response, as shown by their conditional headers, it's a
+// 304 Not Modified instead.
+func (entry *cacheEntry) response(r *http.Request, conditional http.Header, now time.Time) *http.Response {
+	header := entry.header.Clone()
+	header.Set("Age", strconv.Itoa(int(entry.currentAge(now).Seconds())))
+
+	resp := &http.Response{
+		Status:        strconv.Itoa(entry.status) + " " + http.StatusText(entry.status),
+		StatusCode:    entry.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+		Request:       r,
+	}
+	if entry.status == http.StatusOK && notModified(conditional, entry.header) {
+		resp.Status = "304 Not Modified"
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		header.Del("Content-Length")
+	}
+	return resp
+}
+
+// notModified reports whether the visitor's conditional headers match the
+// response they'd get.
+func notModified(conditional http.Header, header http.Header) bool {
+	if match := conditional.Get("If-None-Match"); len(match) > 0 {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if len(etag) == 0 {
+			return false
+		}
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if since := conditional.Get("If-Modified-Since"); len(since) > 0 {
+		sinceTime, err := http.ParseTime(since)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !modified.After(sinceTime)
+	}
+	return false
+}
+
+// refresh updates a stored response with the headers of a 304 Not Modified
+// response from revalidating it, returning a copy of the updated entry.
+func (c *Cache) refresh(stale *cacheEntry, resp *http.Response, now time.Time) *cacheEntry {
+	c.budget.lock.Lock()
+	defer c.budget.lock.Unlock()
+
+	entry, ok := c.entries[stale.key]
+	if !ok {
+		// evicted while revalidating, but still good for this request
+		entry = stale
+	} else {
+		cost := entry.cost()
+		defer func() {
+			c.resize(entry.cost() - cost)
+		}()
+	}
+
+	for k, vs := range resp.Header {
+		if k == "Content-Length" {
+			continue
+		}
+		entry.header[k] = vs
+	}
+	entry.stored = now
+	entry.age, entry.lifetime = freshness(entry.header, now)
+	return entry.snapshot()
+}
+
+// record wraps the body of a response to the request, storing it in the
+// cache once it has been read in full, if the backend allows it.
+func (c *Cache) record(r *http.Request, resp *http.Response, now time.Time) {
+	if !c.storable(r, resp) {
+		return
+	}
+	if resp.ContentLength > c.maxEntrySize() {
+		return
+	}
+
+	// the header is copied now, before it's rewritten for the visitor
+	status, header := resp.StatusCode, resp.Header.Clone()
+	resp.Body = &cacheRecorder{
+		ReadCloser: resp.Body,
+		limit:      c.maxEntrySize(),
+		done: func(body []byte) {
+			if len(resp.Trailer) > 0 {
+				return
+			}
+			c.store(r, status, header, body, now)
+		},
+	}
+}
+
+// storable reports whether a response to the request may be stored.
+func (c *Cache) storable(r *http.Request, resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method != "GET" {
+		return false
+	}
+	directives := parseCacheControl(resp.Header)
+	if directives["no-store"] || directives["private"] {
+		return false
+	}
+	if len(resp.Header.Get("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if len(r.Header.Get("Authorization")) > 0 && !directives["public"] && !directives["s-maxage"] {
+		return false
+	}
+
+	_, lifetime := freshness(resp.Header, time.Now())
+	if lifetime > 0 {
+		return cacheableStatus[resp.StatusCode]
+	}
+	// responses that must always be revalidated are still worth storing, if
+	// they can be
+	hasValidator := len(resp.Header.Get("ETag")) > 0 || len(resp.Header.Get("Last-Modified")) > 0
+	return resp.StatusCode == http.StatusOK && hasValidator
+}
+
+func (c *Cache) store(r *http.Request, status int, header http.Header, body []byte, now time.Time) {
+	c.budget.lock.Lock()
+	defer c.budget.lock.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	primary := r.URL.RequestURI()
+	vary := varyHeaders(header)
+	if variants, ok := c.vary[primary]; ok && !equalStrings(variants.names, vary) {
+		// the backend changed what it varies on, so the other variants
+		// can't be found any more
+		for _, entry := range c.entries {
+			if entry.primary == primary {
+				c.remove(entry)
+			}
+		}
+	}
+
+	entry := &cacheEntry{
+		cache:   c,
+		key:     cacheKey(primary, vary, r.Header),
+		primary: primary,
+		path:    r.URL.Path,
+		status:  status,
+		header:  header,
+		body:    body,
+		stored:  now,
+	}
+	entry.header.Set("Content-Length", strconv.Itoa(len(body)))
+	entry.age, entry.lifetime = freshness(entry.header, now)
+
+	if old, ok := c.entries[entry.key]; ok {
+		c.remove(old)
+	}
+	entry.elem = c.lru.PushFront(entry)
+	entry.budgetElem = c.budget.lru.PushFront(entry)
+	c.entries[entry.key] = entry
+	c.resize(entry.cost())
+	if _, ok := c.vary[primary]; !ok {
+		c.vary[primary] = &cacheVariants{names: vary}
+	}
+	c.vary[primary].count++
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+	// make room in the budget, at the expense of whichever caches were used
+	// least recently
+	for c.budget.size > c.budget.maxSize {
+		entry := c.budget.lru.Back().Value.(*cacheEntry)
+		entry.cache.remove(entry)
+	}
+}
+
+// resize adjusts the size of the cache, and of its budget.
+func (c *Cache) resize(delta int64) {
+	c.size += delta
+	c.budget.size += delta
+}
+
+func (c *Cache) remove(entry *cacheEntry) {
+	c.lru.Remove(entry.elem)
+	c.budget.lru.Remove(entry.budgetElem)
+	delete(c.entries, entry.key)
+	c.resize(-entry.cost())
+
+	if variants := c.vary[entry.primary]; variants != nil {
+		if variants.count--; variants.count <= 0 {
+			delete(c.vary, entry.primary)
+		}
+	}
+}
+
+// cost approximates the memory used by an entry.
+func (entry *cacheEntry) cost() int64 {
+	cost := int64(len(entry.body) + len(entry.key))
+	for k, vs := range entry.header {
+		for _, v := range vs {
+			cost += int64(len(k) + len(v))
+		}
+	}
+	return cost
+}
+
+// cacheRecorder keeps a copy of a response body as it's read, calling done
+// with it if the body is read to the end without exceeding the limit.
+type cacheRecorder struct {
+	io.ReadCloser
+
+	limit    int64
+	buf      bytes.Buffer
+	overflow bool
+	done     func(body []byte)
+}
+
+func (rec *cacheRecorder) Read(p []byte) (int, error) {
+	n, err := rec.ReadCloser.Read(p)
+	if !rec.overflow {
+		if int64(rec.buf.Len()+n) > rec.limit {
+			rec.overflow = true
+			rec.buf = bytes.Buffer{}
+		} else {
+			rec.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !rec.overflow && rec.done != nil {
+		rec.done(rec.buf.Bytes())
+		rec.done = nil
+	}
+	return n, err
+}
+
+// freshness returns the age of a response when it was received, and how
+// long it stays fresh for.
+func freshness(header http.Header, now time.Time) (time.Duration, time.Duration) {
+	var age time.Duration
+	if seconds, err := strconv.Atoi(header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+
+	directives := parseCacheControl(header)
+	if directives["no-cache"] {
+		return age, 0
+	}
+	if lifetime, ok := directiveSeconds(header, "s-maxage"); ok {
+		return age, lifetime
+	}
+	if lifetime, ok := directiveSeconds(header, "max-age"); ok {
+		return age, lifetime
+	}
+	if expires := header.Get("Expires"); len(expires) > 0 {
+		expiresTime, err := http.ParseTime(expires)
+		if err != nil {
+			return age, 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return age, expiresTime.Sub(date)
+	}
+	return age, 0
+}
+
+// parseCacheControl returns the directives in a Cache-Control header.
+func parseCacheControl(header http.Header) map[string]bool {
+	directives := make(map[string]bool)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name := strings.SplitN(strings.TrimSpace(directive), "=", 2)[0]
+			if len(name) > 0 {
+				directives[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return directives
+}
+
+// directiveSeconds returns the value of a Cache-Control directive that
+// takes a number of seconds, like max-age.
+func directiveSeconds(header http.Header, name string) (time.Duration, bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			if len(parts) != 2 || !strings.EqualFold(parts[0], name) {
+				continue
+			}
+			seconds, err := strconv.Atoi(strings.Trim(parts[1], `"`))
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// cacheKey identifies a variant of the response for a path, by the values
+// of the request headers that the response varies on.
+func cacheKey(primary string, vary []string, header http.Header) string {
+	var key strings.Builder
+	key.WriteString(primary)
+	for _, name := range vary {
+		key.WriteByte(0)
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return key.String()
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,392 @@
+package forward
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCacheRequest(t *testing.T, path string, header http.Header) *http.Request {
+	r, err := http.NewRequest("GET", "http://site.apparea.test"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	return r
+}
+
+// storeResponse stores a response with the body in the cache, as if it had
+// just come from the backend.
+func storeResponse(t *testing.T, c *Cache, path string, header http.Header, body string) {
+	r := newCacheRequest(t, path, nil)
+	resp := &http.Response{StatusCode: 200, Header: header, Request: r, ContentLength: int64(len(body))}
+	if !c.storable(r, resp) {
+		t.Fatalf("expected the response for %s to be storable", path)
+	}
+	c.store(r, 200, header.Clone(), []byte(body), time.Now())
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		request  http.Header
+		status   int
+		header   http.Header
+		expected bool
+	}{
+		{"max-age", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"s-maxage", "GET", nil, 200, http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+		{"expires", "GET", nil, 200, http.Header{"Expires": {"Thu, 01 Jan 2099 00:00:00 GMT"}}, true},
+		{"etag", "GET", nil, 200, http.Header{"Etag": {`"v1"`}}, true},
+		{"last-modified", "GET", nil, 200, http.Header{"Last-Modified": {"Thu, 01 Jan 2015 00:00:00 GMT"}}, true},
+		{"no-cache with etag", "GET", nil, 200, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, true},
+		{"not found", "GET", nil, 404, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"no lifetime", "GET", nil, 200, http.Header{}, false},
+		{"expired", "GET", nil, 200, http.Header{"Expires": {"0"}}, false},
+		{"not found with etag", "GET", nil, 404, http.Header{"Etag": {`"v1"`}}, false},
+		{"server error", "GET", nil, 500, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"partial", "GET", nil, 206, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"post", "POST", nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"no-store", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60, no-store"}}, false},
+		{"private", "GET", nil, 200, http.Header{"Cache-Control": {"Private, max-age=60"}}, false},
+		{"cookie", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"id=1"}}, false},
+		{"vary star", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept, *"}}, false},
+		{"authorization", "GET", http.Header{"Authorization": {"Bearer s3cret"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"authorization public", "GET", http.Header{"Authorization": {"Bearer s3cret"}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"authorization s-maxage", "GET", http.Header{"Authorization": {"Bearer s3cret"}}, 200, http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+	}
+	c := NewCache(1 << 20)
+	for _, test := range tests {
+		r := newCacheRequest(t, "/", test.request)
+		r.Method = test.method
+		resp := &http.Response{StatusCode: test.status, Header: test.header, Request: r}
+		if got := c.storable(r, resp); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		header   http.Header
+		expected bool
+	}{
+		{"get", "GET", nil, true},
+		{"no-cache", "GET", http.Header{"Cache-Control": {"no-cache"}}, true},
+		{"head", "HEAD", nil, false},
+		{"post", "POST", nil, false},
+		{"range", "GET", http.Header{"Range": {"bytes=0-99"}}, false},
+		{"no-store", "GET", http.Header{"Cache-Control": {"no-store"}}, false},
+	}
+	for _, test := range tests {
+		r := newCacheRequest(t, "/", test.header)
+		r.Method = test.method
+		if got := cacheable(r); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	c := NewCache(1 << 20)
+	header := http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"accept-language"}}
+	for _, language := range []string{"en", "fr"} {
+		r := newCacheRequest(t, "/page", http.Header{"Accept-Language": {language}})
+		c.store(r, 200, header.Clone(), []byte(language), time.Now())
+	}
+
+	tests := []struct {
+		language string
+		expected string
+	}{
+		{"en", "en"},
+		{"fr", "fr"},
+		{"de", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if len(test.language) > 0 {
+			header.Set("Accept-Language", test.language)
+		}
+		entry := c.lookup(newCacheRequest(t, "/page", header))
+		got := ""
+		if entry != nil {
+			got = string(entry.body)
+		}
+		if got != test.expected {
+			t.Errorf("Accept-Language %q: expected %q, got %q", test.language, test.expected, got)
+		}
+	}
+
+	// varying on something else makes the old variants unreachable, so
+	// they're dropped
+	r := newCacheRequest(t, "/page", http.Header{"Accept-Language": {"en"}, "Accept": {"text/html"}})
+	c.store(r, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept"}}, []byte("html"), time.Now())
+	if n, _ := c.Size(); n != 1 {
+		t.Errorf("expected the old variants to be removed, got %d entries", n)
+	}
+	if entry := c.lookup(newCacheRequest(t, "/page", http.Header{"Accept": {"text/html"}})); entry == nil || string(entry.body) != "html" {
+		t.Errorf("expected the new variant to be found")
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		header   http.Header
+		request  http.Header
+		at       time.Duration
+		expected bool
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, nil, 30 * time.Second, true},
+		{"max-age expired", http.Header{"Cache-Control": {"max-age=60"}}, nil, 90 * time.Second, false},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=600, s-maxage=60"}}, nil, 90 * time.Second, false},
+		{"age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"50"}}, nil, 30 * time.Second, false},
+		{"expires", http.Header{"Date": {now.UTC().Format(http.TimeFormat)}, "Expires": {now.Add(time.Minute).UTC().Format(http.TimeFormat)}}, nil, 30 * time.Second, true},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, nil, 0, false},
+		{"request no-cache", http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{"request pragma", http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Pragma": {"no-cache"}}, 0, false},
+		{"request max-age", http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Cache-Control": {"max-age=10"}}, 30 * time.Second, false},
+		{"request max-age fresh", http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Cache-Control": {"max-age=40"}}, 30 * time.Second, true},
+	}
+	for _, test := range tests {
+		c := NewCache(1 << 20)
+		c.store(newCacheRequest(t, "/", nil), 200, test.header, nil, now)
+		entry := c.lookup(newCacheRequest(t, "/", nil))
+		if entry == nil {
+			t.Fatalf("%s: expected the response to be stored", test.name)
+		}
+		if got := entry.fresh(newCacheRequest(t, "/", test.request), now.Add(test.at)); got != test.expected {
+			t.Errorf("%s: expected fresh %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestCacheNotModified(t *testing.T) {
+	header := http.Header{"Etag": {`W/"v1"`}, "Last-Modified": {"Thu, 01 Jan 2015 00:00:00 GMT"}}
+	tests := []struct {
+		name        string
+		conditional http.Header
+		expected    bool
+	}{
+		{"none", http.Header{}, false},
+		{"etag", http.Header{"If-None-Match": {`"v1"`}}, true},
+		{"weak etag", http.Header{"If-None-Match": {`W/"v1"`}}, true},
+		{"etag list", http.Header{"If-None-Match": {`"v0", "v1"`}}, true},
+		{"etag star", http.Header{"If-None-Match": {"*"}}, true},
+		{"other etag", http.Header{"If-None-Match": {`"v2"`}}, false},
+		// If-None-Match takes precedence
+		{"etag over date", http.Header{"If-None-Match": {`"v2"`}, "If-Modified-Since": {"Thu, 01 Jan 2015 00:00:00 GMT"}}, false},
+		{"same date", http.Header{"If-Modified-Since": {"Thu, 01 Jan 2015 00:00:00 GMT"}}, true},
+		{"later date", http.Header{"If-Modified-Since": {"Fri, 02 Jan 2015 00:00:00 GMT"}}, true},
+		{"earlier date", http.Header{"If-Modified-Since": {"Wed, 31 Dec 2014 00:00:00 GMT"}}, false},
+		{"bad date", http.Header{"If-Modified-Since": {"yesterday"}}, false},
+	}
+	for _, test := range tests {
+		if got := notModified(test.conditional, header); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestCacheRefresh(t *testing.T) {
+	c := NewCache(1 << 20)
+	then := time.Now().Add(-time.Hour)
+	c.store(newCacheRequest(t, "/", nil), 200, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, []byte("body"), then)
+
+	entry := c.lookup(newCacheRequest(t, "/", nil))
+	if entry.fresh(newCacheRequest(t, "/", nil), time.Now()) {
+		t.Fatal("expected the response to need revalidating")
+	}
+	validators := entry.validators()
+	if got := validators.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("expected to revalidate with If-None-Match \"v1\", got %q", got)
+	}
+
+	// the backend says it's unchanged, and now gives it a lifetime
+	now := time.Now()
+	notModified := &http.Response{StatusCode: 304, Header: http.Header{"Cache-Control": {"max-age=60"}, "X-Version": {"1"}}}
+	c.refresh(entry, notModified, now)
+
+	entry = c.lookup(newCacheRequest(t, "/", nil))
+	if !entry.fresh(newCacheRequest(t, "/", nil), now.Add(time.Second)) {
+		t.Error("expected the refreshed response to be fresh")
+	}
+	if got := entry.header.Get("X-Version"); got != "1" {
+		t.Errorf("expected the refreshed headers to be stored, got X-Version %q", got)
+	}
+	if string(entry.body) != "body" {
+		t.Errorf("expected the body to be kept, got %q", entry.body)
+	}
+
+	resp := entry.response(newCacheRequest(t, "/", nil), http.Header{"If-None-Match": {`"v1"`}}, now)
+	if resp.StatusCode != 304 {
+		t.Errorf("expected a visitor with the response to get 304, got %d", resp.StatusCode)
+	}
+	resp = entry.response(newCacheRequest(t, "/", nil), http.Header{}, now)
+	if body, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != 200 || string(body) != "body" {
+		t.Errorf("expected other visitors to get the body, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	body := strings.Repeat("x", 300)
+	found := func(c *Cache, path string) bool {
+		return c.lookup(newCacheRequest(t, path, nil)) != nil
+	}
+
+	// each entry costs a little over 300 bytes, so only two fit
+	c := NewCache(1000)
+	storeResponse(t, c, "/a", header, body)
+	storeResponse(t, c, "/b", header, body)
+	found(c, "/a")
+	storeResponse(t, c, "/c", header, body)
+	if !found(c, "/a") || found(c, "/b") || !found(c, "/c") {
+		t.Errorf("expected the least recently used response to be evicted")
+	}
+	if n, size := c.Size(); n != 2 || size > 1000 {
+		t.Errorf("expected 2 entries within the size, got %d of %d bytes", n, size)
+	}
+
+	// responses too large for the cache aren't recorded at all
+	r := newCacheRequest(t, "/large", nil)
+	resp := &http.Response{StatusCode: 200, Header: header.Clone(), Request: r, ContentLength: -1, Body: ioutil.NopCloser(strings.NewReader(body))}
+	c.record(r, resp, time.Now())
+	io.Copy(ioutil.Discard, resp.Body)
+	if found(c, "/large") {
+		t.Errorf("expected a response larger than a quarter of the cache not to be stored")
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	body := strings.Repeat("x", 300)
+	found := func(c *Cache, path string) bool {
+		return c.lookup(newCacheRequest(t, path, nil)) != nil
+	}
+
+	// tunnels share the server's budget, though each could use all of it
+	server := NewHTTPServer()
+	server.MaxCacheSize = 1000
+	first, second := server.newCache(1000), server.newCache(1000)
+	if first.budget != second.budget {
+		t.Fatal("expected the tunnels to share a budget")
+	}
+
+	storeResponse(t, first, "/a", header, body)
+	storeResponse(t, first, "/b", header, body)
+	found(first, "/a")
+	storeResponse(t, second, "/a", header, body)
+	if !found(first, "/a") || found(first, "/b") || !found(second, "/a") {
+		t.Errorf("expected the least recently used response of any tunnel to be evicted")
+	}
+	if size := first.budget.Size(); size > 1000 {
+		t.Errorf("expected the caches to stay within the budget, got %d bytes", size)
+	}
+
+	// closing a cache returns its share, and it stores nothing more
+	_, firstSize := first.Size()
+	second.Close()
+	if size := first.budget.Size(); size != firstSize {
+		t.Errorf("expected only the first cache's %d bytes in the budget, got %d", firstSize, size)
+	}
+	storeResponse(t, second, "/b", header, body)
+	if found(second, "/b") {
+		t.Errorf("expected a closed cache not to store responses")
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	tests := []struct {
+		prefix   string
+		removed  int
+		remains  []string
+		excludes []string
+	}{
+		{"/static/", 2, []string{"/", "/staticky"}, []string{"/static/app.js", "/static/app.css?v=1"}},
+		{"/static", 3, []string{"/"}, []string{"/static/app.js", "/staticky"}},
+		{"/missing", 0, []string{"/", "/static/app.js"}, nil},
+		{"/", 4, nil, []string{"/", "/static/app.js"}},
+	}
+	for _, test := range tests {
+		c := NewCache(1 << 20)
+		for _, path := range []string{"/", "/static/app.js", "/static/app.css?v=1", "/staticky"} {
+			storeResponse(t, c, path, header, "body")
+		}
+
+		if removed := c.Purge(test.prefix); removed != test.removed {
+			t.Errorf("purge %s: expected %d removed, got %d", test.prefix, test.removed, removed)
+		}
+		for _, path := range test.remains {
+			if c.lookup(newCacheRequest(t, path, nil)) == nil {
+				t.Errorf("purge %s: expected %s to remain", test.prefix, path)
+			}
+		}
+		for _, path := range test.excludes {
+			if c.lookup(newCacheRequest(t, path, nil)) != nil {
+				t.Errorf("purge %s: expected %s to be removed", test.prefix, path)
+			}
+		}
+	}
+}
+
+func TestCachedTunnel(t *testing.T) {
+	var requests int32
+	backend := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/static" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "body")
+	}))
+	url := newConfiguredTunnel(t, backend, Options{CacheSize: 1 << 20})
+
+	tests := []struct {
+		path     string
+		requests int32
+	}{
+		{"/static", 1},
+		{"/static", 1},
+		{"/dynamic", 2},
+		// revalidated, with the backend's 304 turned back into the body
+		{"/dynamic", 3},
+	}
+	for i, test := range tests {
+		resp, err := http.Get(url + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != 200 || string(body) != "body" {
+			t.Errorf("request %d: expected 200 body, got %d %q", i, resp.StatusCode, body)
+		}
+		if got := atomic.LoadInt32(&requests); got != test.requests {
+			t.Errorf("request %d: expected %d backend requests, got %d", i, test.requests, got)
+		}
+	}
+}
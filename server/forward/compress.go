@@ -0,0 +1,147 @@
+package forward
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings are the content encodings that responses can be compressed
+// with, in order of preference.
+var Encodings = []string{"br", "gzip"}
+
+// minCompressSize is the size below which responses aren't worth
+// compressing.
+const minCompressSize = 256
+
+// encoder compresses a response body.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(encoding string, w io.Writer) encoder {
+	switch encoding {
+	case "br":
+		// a low quality, since we're compressing on the fly
+		return brotli.NewWriterLevel(w, 4)
+	default:
+		return gzip.NewWriter(w)
+	}
+}
+
+// negotiateEncoding chooses the preferred encoding, of those allowed, that
+// the visitor accepts, or the empty string if there isn't one.
+func negotiateEncoding(acceptEncoding string, allowed []string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(name) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qualities[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range Encodings {
+		if !containsString(allowed, encoding) {
+			continue
+		}
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// shouldCompress reports whether a response to the request is worth
+// compressing at the edge: one with a body of a compressible type, that the
+// backend hasn't already encoded, and that it allows us to transform.
+func shouldCompress(r *http.Request, resp *http.Response) bool {
+	if r.Method == "HEAD" || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if len(resp.Header.Get("Content-Encoding")) > 0 || len(resp.Header.Get("Content-Range")) > 0 {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minCompressSize {
+		return false
+	}
+	for _, value := range resp.Header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(value), "no-transform") {
+			return false
+		}
+	}
+	return isCompressibleType(resp.Header.Get("Content-Type"))
+}
+
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/x-javascript",
+		"application/xml", "application/wasm", "application/manifest+json",
+		"image/svg+xml", "image/x-icon", "font/ttf", "font/otf":
+		return true
+	}
+	return false
+}
+
+// prepareCompressedHeader adjusts the response header for a body compressed
+// with the encoding.
+func prepareCompressedHeader(header http.Header, encoding string) {
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", encoding)
+	vary := false
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			vary = vary || name == "*" || strings.EqualFold(name, "Accept-Encoding")
+		}
+	}
+	if !vary {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	// the compressed body is no longer byte for byte the same
+	if etag := header.Get("ETag"); len(etag) > 0 && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package forward
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept   string
+		allowed  []string
+		expected string
+	}{
+		{"", Encodings, ""},
+		{"identity", Encodings, ""},
+		{"gzip", Encodings, "gzip"},
+		{"gzip, deflate, br", Encodings, "br"},
+		{"GZIP", Encodings, "gzip"},
+		{"br, gzip", []string{"gzip"}, "gzip"},
+		{"br", []string{"gzip"}, ""},
+		// q-values
+		{"br;q=0.5, gzip;q=0.8", Encodings, "gzip"},
+		{"br; q=0.9, gzip; q=0.9", Encodings, "br"},
+		{"br;q=0, gzip", Encodings, "gzip"},
+		{"br;q=0, gzip;q=0", Encodings, ""},
+		{"gzip;q=bad", Encodings, "gzip"},
+		// wildcards only apply to encodings that aren't named
+		{"*", Encodings, "br"},
+		{"*", []string{"gzip"}, "gzip"},
+		{"br;q=0, *", Encodings, "gzip"},
+		{"gzip;q=0.5, *;q=0.1", Encodings, "gzip"},
+		{"*;q=0", Encodings, ""},
+		{"gzip, *;q=0", Encodings, "gzip"},
+	}
+	for _, test := range tests {
+		if got := negotiateEncoding(test.accept, test.allowed); got != test.expected {
+			t.Errorf("negotiateEncoding(%q, %v) = %q, expected %q", test.accept, test.allowed, got, test.expected)
+		}
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		length   int64
+		header   http.Header
+		expected bool
+	}{
+		{"text", "GET", 200, 1024, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, true},
+		{"json", "POST", 200, 1024, http.Header{"Content-Type": {"application/json"}}, true},
+		{"suffix", "GET", 200, 1024, http.Header{"Content-Type": {"application/ld+json"}}, true},
+		{"unknown length", "GET", 200, -1, http.Header{"Content-Type": {"text/event-stream"}}, true},
+		{"image", "GET", 200, 1024, http.Header{"Content-Type": {"image/png"}}, false},
+		{"no type", "GET", 200, 1024, http.Header{}, false},
+		{"head", "HEAD", 200, 1024, http.Header{"Content-Type": {"text/html"}}, false},
+		// the threshold
+		{"small", "GET", 200, 255, http.Header{"Content-Type": {"text/html"}}, false},
+		{"threshold", "GET", 200, 256, http.Header{"Content-Type": {"text/html"}}, true},
+		{"empty", "GET", 200, 0, http.Header{"Content-Type": {"text/html"}}, false},
+		// the backend has already encoded the response
+		{"encoded", "GET", 200, 1024, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}}, false},
+		{"identity", "GET", 200, 1024, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"identity"}}, false},
+		{"range", "GET", 200, 1024, http.Header{"Content-Type": {"text/html"}, "Content-Range": {"bytes 0-1023/2048"}}, false},
+		// the backend doesn't want the response transformed
+		{"no-transform", "GET", 200, 1024, http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"public, No-Transform"}}, false},
+		{"no-transform later", "GET", 200, 1024, http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"max-age=60", "no-transform"}}, false},
+		{"cache-control", "GET", 200, 1024, http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"no-cache"}}, true},
+		// only complete, successful responses are compressed
+		{"partial", "GET", 206, 1024, http.Header{"Content-Type": {"text/html"}}, false},
+		{"not found", "GET", 404, 1024, http.Header{"Content-Type": {"text/html"}}, false},
+		{"error", "GET", 500, 1024, http.Header{"Content-Type": {"text/html"}}, false},
+		{"redirect", "GET", 302, 1024, http.Header{"Content-Type": {"text/html"}}, false},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, "http://site.apparea.test/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{StatusCode: test.status, ContentLength: test.length, Header: test.header}
+		if got := shouldCompress(r, resp); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestPrepareCompressedHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		expectETag string
+		expectVary []string
+	}{
+		{"plain", http.Header{}, "", []string{"Accept-Encoding"}},
+		{"strong etag", http.Header{"Etag": {`"abc"`}}, `W/"abc"`, []string{"Accept-Encoding"}},
+		{"weak etag", http.Header{"Etag": {`W/"abc"`}}, `W/"abc"`, []string{"Accept-Encoding"}},
+		{"other vary", http.Header{"Vary": {"Cookie"}}, "", []string{"Cookie", "Accept-Encoding"}},
+		{"existing vary", http.Header{"Vary": {"Cookie, accept-encoding"}}, "", []string{"Cookie, accept-encoding"}},
+		{"vary star", http.Header{"Vary": {"*"}}, "", []string{"*"}},
+	}
+	for _, test := range tests {
+		test.header.Set("Content-Length", "1024")
+		prepareCompressedHeader(test.header, "gzip")
+
+		if got := test.header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("%s: expected Content-Encoding gzip, got %q", test.name, got)
+		}
+		if got := test.header.Get("Content-Length"); len(got) > 0 {
+			t.Errorf("%s: expected Content-Length to be removed, got %q", test.name, got)
+		}
+		if got := test.header.Get("ETag"); got != test.expectETag {
+			t.Errorf("%s: expected ETag %q, got %q", test.name, test.expectETag, got)
+		}
+		if got := test.header.Values("Vary"); strings.Join(got, "|") != strings.Join(test.expectVary, "|") {
+			t.Errorf("%s: expected Vary %q, got %q", test.name, test.expectVary, got)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat("compress me, ", 100)
+	backend := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, body)
+	}))
+	url := newConfiguredTunnel(t, backend, Options{Compress: Encodings})
+
+	tests := []struct {
+		path     string
+		accept   string
+		encoding string
+	}{
+		{"/", "gzip, br", "br"},
+		{"/", "gzip", "gzip"},
+		{"/", "", ""},
+		{"/missing", "gzip, br", ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", url+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// setting the header ourselves stops the client from decoding
+		req.Header.Set("Accept-Encoding", test.accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var reader io.Reader = resp.Body
+		switch test.encoding {
+		case "br":
+			reader = brotli.NewReader(resp.Body)
+		case "gzip":
+			reader, err = gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := ioutil.ReadAll(reader)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %q: %s", test.path, test.accept, err)
+		}
+
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%s %q: expected Content-Encoding %q, got %q", test.path, test.accept, test.encoding, encoding)
+		}
+		if string(got) != body {
+			t.Errorf("%s %q: expected the original body, got %d bytes", test.path, test.accept, len(got))
+		}
+		etag := `"v1"`
+		if len(test.encoding) > 0 {
+			etag = `W/"v1"`
+			if vary := resp.Header.Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("%s %q: expected Vary Accept-Encoding, got %q", test.path, test.accept, vary)
+			}
+		}
+		if got := resp.Header.Get("ETag"); got != etag {
+			t.Errorf("%s %q: expected ETag %s, got %s", test.path, test.accept, etag, got)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// IPFilter restricts the addresses of the visitors that may connect to a
+// tunnel. An address is allowed if it's not in any of the Deny networks, and
+// is in one of the Allow networks (if there are any).
+type IPFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseCIDRs parses a list of networks in CIDR notation. Plain IP addresses
+// are treated as a network containing only that address.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (filter IPFilter) Empty() bool {
+	return len(filter.Allow) == 0 && len(filter.Deny) == 0
+}
+
+func (filter IPFilter) Allows(ip net.IP) bool {
+	for _, network := range filter.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(filter.Allow) == 0 {
+		return true
+	}
+	for _, network := range filter.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsVisitor reports whether the visitor's address passes all of the
+// options' filters.
+func (opts Options) AllowsVisitor(addr string) bool {
+	if len(opts.Visitors) == 0 {
+		return true
+	}
+
+	host := addr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, filter := range opts.Visitors {
+		if !filter.Allows(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// awaitOptions returns the options read by current once they're final,
+// holding back the visitor until then.
+func awaitOptions(current func() Options) Options {
+	opts := current()
+	if opts.Pending != nil {
+		<-opts.Pending
+		opts = current()
+	}
+	return opts
+}
+
+// admitVisitor checks that a visitor is allowed by the options, before any
+// channel is opened to the client. Rejected visitors are counted, and logged
+// to the client.
+func admitVisitor(opts Options, addr string, rejected *uint64, clientLog io.Writer) bool {
+	if opts.AllowsVisitor(addr) {
+		return true
+	}
+
+	count := atomic.AddUint64(rejected, 1)
+	fmt.Fprintf(clientLog, "%s [rejected] %s (%d rejected so far)\n", time.Now().Format("2006/01/02 15:04:05"), addr, count)
+	return false
+}
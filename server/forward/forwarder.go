@@ -1,12 +1,21 @@
 package forward
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 type Forwarder interface {
 	Serve() error
 	Close()
+	Shutdown(ctx context.Context) error
+	Configure(Options)
 	AttachClientLog(io.Writer)
 
+	// Matches reports whether the forwarder was created by the forward
+	// request, so that it can be cancelled.
+	Matches(ForwardRequest) bool
+
 	ListenerAddress() string
 	ListenerPort() uint32
 }
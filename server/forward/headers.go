@@ -0,0 +1,89 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// addForwardedHeaders tells the backend about the visitor behind a request,
+// with both the de facto X-Forwarded-* headers and the standard Forwarded
+// header (RFC 7239). Like other proxies, we append to any chain of addresses
+// the visitor sent, and leave it to the backend to decide which to trust.
+func addForwardedHeaders(r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	proto := requestScheme(r)
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip)
+	} else {
+		r.Header.Set("X-Forwarded-For", ip)
+	}
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", r.Host)
+
+	element := "for=" + forwardedNode(ip) + ";host=" + quoteForwarded(r.Host) + ";proto=" + proto
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		r.Header.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+	} else {
+		r.Header.Set("Forwarded", element)
+	}
+}
+
+// requestScheme returns the scheme the visitor used to make a request.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedNode formats an IP address as a node in a Forwarded header, where
+// IPv6 addresses are bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quoteForwarded quotes a value in a Forwarded header if it isn't a valid
+// token, such as a host with a port.
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+	}
+}
+
+// splitAddress splits a "host:port" address into the form used by the
+// originator fields of forwarded channels.
+func splitAddress(addr string) (string, uint32) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	return host, uint32(port)
+}
+
+// tcpAddr returns addr as a *net.TCPAddr, or nil if it isn't one.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	tcp, _ := addr.(*net.TCPAddr)
+	return tcp
+}
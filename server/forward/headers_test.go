@@ -0,0 +1,74 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name          string
+		remote        string
+		host          string
+		tls           bool
+		prior         http.Header
+		forwardedFor  string
+		forwardedHost string
+		proto         string
+		forwarded     string
+	}{
+		{
+			"ipv4", "192.0.2.1:1234", "site.apparea.test", false, nil,
+			"192.0.2.1", "site.apparea.test", "http",
+			"for=192.0.2.1;host=site.apparea.test;proto=http",
+		},
+		{
+			"ipv6 over tls", "[2001:db8::1]:1234", "site.apparea.test", true, nil,
+			"2001:db8::1", "site.apparea.test", "https",
+			`for="[2001:db8::1]";host=site.apparea.test;proto=https`,
+		},
+		{
+			"host with port", "192.0.2.1:1234", "site.apparea.test:8080", false, nil,
+			"192.0.2.1", "site.apparea.test:8080", "http",
+			`for=192.0.2.1;host="site.apparea.test:8080";proto=http`,
+		},
+		{
+			"appended to a chain", "192.0.2.1:1234", "site.apparea.test", false,
+			http.Header{
+				"X-Forwarded-For":   {"198.51.100.1", "203.0.113.1"},
+				"X-Forwarded-Host":  {"spoofed.test"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=198.51.100.1"},
+			},
+			"198.51.100.1, 203.0.113.1, 192.0.2.1", "site.apparea.test", "http",
+			"for=198.51.100.1, for=192.0.2.1;host=site.apparea.test;proto=http",
+		},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("GET", "http://"+test.host+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = test.remote
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if test.prior != nil {
+			r.Header = test.prior
+		}
+
+		addForwardedHeaders(r)
+		expected := map[string]string{
+			"X-Forwarded-For":   test.forwardedFor,
+			"X-Forwarded-Host":  test.forwardedHost,
+			"X-Forwarded-Proto": test.proto,
+			"Forwarded":         test.forwarded,
+		}
+		for name, value := range expected {
+			if got := r.Header.Values(name); len(got) != 1 || got[0] != value {
+				t.Errorf("%s: expected %s %q, got %q", test.name, name, value, got)
+			}
+		}
+	}
+}
@@ -2,41 +2,86 @@ package forward
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/jedevc/apparea/server/helpers"
 	"golang.org/x/crypto/ssh"
 )
 
 type HTTPForwarder struct {
+	// rejected counts the visitors turned away, and is first for alignment
+	// with atomic operations
+	rejected uint64
+
 	Request  ForwardRequest
 	Hostname string
 
 	clientLog io.Writer
 
+	server    *HTTPServer
 	connector *ssh.ServerConn
 	useTLS    bool
+
+	lock    sync.Mutex
+	options Options
+	cache   *Cache
+	active  sync.WaitGroup
+}
+
+// HTTPServer routes incoming HTTP requests to the HTTPForwarder registered
+// for the request's Host.
+type HTTPServer struct {
+	// ReadTimeout, WriteTimeout and MaxHeaderBytes configure the underlying
+	// http.Server, and must be set before the server is first served.
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	MaxHeaderBytes int
+
+	// MaxCacheSize limits the total size of the caches of all tunnels, or
+	// disables caching when zero. It must be set before the first tunnel is
+	// configured.
+	MaxCacheSize int64
+
+	// Fallback optionally handles requests for hosts without a tunnel, which
+	// otherwise get a 404.
+	Fallback http.Handler
+
+	lock     sync.Mutex
+	hosts    map[string]*HTTPForwarder
+	server   *http.Server
+	listener net.Listener
+	closed   bool
+	budget   *cacheBudget
 }
 
-var httpMap = make(map[string]*HTTPForwarder)
-var httpLock sync.Mutex
-var httpServer *http.Server
+func NewHTTPServer() *HTTPServer {
+	return &HTTPServer{
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+		MaxCacheSize:   DefaultMaxCacheSize,
+		hosts:          make(map[string]*HTTPForwarder),
+	}
+}
 
-func httpHandler(w http.ResponseWriter, r *http.Request) {
-	httpLock.Lock()
-	fr, ok := httpMap[r.Host]
-	httpLock.Unlock()
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	fr, ok := s.hosts[r.Host]
+	s.lock.Unlock()
 
 	if !ok {
+		if s.Fallback != nil {
+			s.Fallback.ServeHTTP(w, r)
+			return
+		}
 		w.WriteHeader(404)
 		fmt.Fprintf(w, "site not found")
 		return
@@ -45,29 +90,106 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 	err := fr.handle(w, r)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
 		return
 	}
 }
 
-func ServeHTTP(address string) error {
-	httpServer = &http.Server{
-		Addr:           address,
-		Handler:        http.HandlerFunc(httpHandler),
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+// Serve accepts HTTP connections on the listener until the server is shut
+// down.
+func (s *HTTPServer) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	if s.listener != nil {
+		s.lock.Unlock()
+		return fmt.Errorf("http server already running")
+	}
+	s.listener = listener
+	s.lock.Unlock()
+
+	log.Printf("Listening for HTTP connections on %s...", listener.Addr())
+	return s.serve(listener)
+}
+
+// ServeTLS accepts HTTPS connections on the listener until the server is
+// shut down, terminating TLS with the given config. It may be used
+// alongside Serve, with both listeners routing to the same sites.
+func (s *HTTPServer) ServeTLS(listener net.Listener, config *tls.Config) error {
+	log.Printf("Listening for HTTPS connections on %s...", listener.Addr())
+	return s.serve(tls.NewListener(listener, config))
+}
+
+func (s *HTTPServer) serve(listener net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		listener.Close()
+		return nil
+	}
+	if s.server == nil {
+		s.server = &http.Server{
+			Handler:        s,
+			ReadTimeout:    s.ReadTimeout,
+			WriteTimeout:   s.WriteTimeout,
+			MaxHeaderBytes: s.MaxHeaderBytes,
+		}
+	}
+	server := s.server
+	s.lock.Unlock()
+
+	err := server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting new HTTP connections and waits for in-flight
+// requests to complete, or for the context to expire.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closed = true
+	server := s.server
+	s.lock.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+func (s *HTTPServer) port() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listener == nil {
+		return 80
+	}
+	addr, ok := s.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return 80
+	}
+	return uint32(addr.Port)
+}
+
+// newCache creates a cache of at most size bytes for a tunnel, sharing the
+// server's budget with the caches of all the other tunnels.
+func (s *HTTPServer) newCache(size int64) *Cache {
+	s.lock.Lock()
+	if s.budget == nil {
+		s.budget = newCacheBudget(s.MaxCacheSize)
 	}
+	budget := s.budget
+	s.lock.Unlock()
 
-	log.Printf("Listening for HTTP connections on %s...", address)
-	return httpServer.ListenAndServe()
+	return budget.newCache(size)
 }
 
-func NewHTTPForwarder(hostname string, conn *ssh.ServerConn, req ForwardRequest) *HTTPForwarder {
+func NewHTTPForwarder(server *HTTPServer, hostname string, conn *ssh.ServerConn, req ForwardRequest) *HTTPForwarder {
 	return &HTTPForwarder{
 		Request:   req,
 		Hostname:  hostname,
 		clientLog: ioutil.Discard,
+		server:    server,
 		connector: conn,
 	}
 }
@@ -77,25 +199,60 @@ func (f *HTTPForwarder) UseTLS(use bool) *HTTPForwarder {
 	return f
 }
 
-func (f *HTTPForwarder) AttachClientLog(w io.Writer) {
-	f.clientLog = w
+func (f *HTTPForwarder) Configure(opts Options) {
+	size := opts.CacheSize
+	if size > f.server.MaxCacheSize {
+		size = f.server.MaxCacheSize
+	}
+
+	f.lock.Lock()
+	f.options = opts
+	old := f.cache
+	if size <= 0 {
+		f.cache = nil
+	} else if f.cache == nil || f.cache.MaxSize() != size {
+		f.cache = f.server.newCache(size)
+	}
+	cache := f.cache
+	f.lock.Unlock()
+
+	if old != nil && old != cache {
+		old.Close()
+	}
 }
 
-func (f HTTPForwarder) connect() (io.ReadWriteCloser, error) {
-	remoteAddress, remotePortStr, _ := net.SplitHostPort(f.connector.RemoteAddr().String())
-	remotePort, _ := strconv.Atoi(remotePortStr)
+func (f *HTTPForwarder) currentOptions() Options {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.options
+}
+
+// PurgeCache removes the cached responses for paths starting with prefix,
+// returning the number removed, or false if caching isn't enabled.
+func (f *HTTPForwarder) PurgeCache(prefix string) (int, bool) {
+	f.lock.Lock()
+	cache := f.cache
+	f.lock.Unlock()
+
+	if cache == nil {
+		return 0, false
+	}
+	return cache.Purge(prefix), true
+}
+
+func (f *HTTPForwarder) Matches(fr ForwardRequest) bool {
+	return f.Request.Equal(fr)
+}
 
-	data := make([]byte, 0)
-	helpers.PackString(&data, f.Request.Host)
-	helpers.PackInt(&data, f.Request.Port)
-	helpers.PackString(&data, remoteAddress)
-	helpers.PackInt(&data, uint32(remotePort))
+func (f *HTTPForwarder) AttachClientLog(w io.Writer) {
+	f.clientLog = w
+}
 
-	ch, reqs, err := f.connector.OpenChannel("forwarded-tcpip", data)
+func (f *HTTPForwarder) connect(originAddress string, originPort uint32) (io.ReadWriteCloser, error) {
+	ch, err := f.Request.OpenChannel(f.connector, originAddress, originPort)
 	if err != nil {
 		return nil, fmt.Errorf("could not open channel: %w", err)
 	}
-	go ssh.DiscardRequests(reqs)
 
 	if f.useTLS {
 		res := NewTLSWrapper(ch)
@@ -105,22 +262,45 @@ func (f HTTPForwarder) connect() (io.ReadWriteCloser, error) {
 	return ch, nil
 }
 
+// backendScheme returns the scheme used to talk to the backend.
+func (f *HTTPForwarder) backendScheme() string {
+	if f.useTLS {
+		return "https"
+	}
+	return "http"
+}
+
 func (f *HTTPForwarder) Serve() error {
-	httpLock.Lock()
-	if _, ok := httpMap[f.Hostname]; ok {
-		httpLock.Unlock()
+	f.server.lock.Lock()
+	defer f.server.lock.Unlock()
+
+	if _, ok := f.server.hosts[f.Hostname]; ok {
 		return fmt.Errorf("site name already in use")
 	}
-	httpMap[f.Hostname] = f
-	httpLock.Unlock()
+	f.server.hosts[f.Hostname] = f
 
 	return nil
 }
 
 func (f *HTTPForwarder) Close() {
-	httpLock.Lock()
-	delete(httpMap, f.Hostname)
-	httpLock.Unlock()
+	f.server.lock.Lock()
+	if f.server.hosts[f.Hostname] == f {
+		delete(f.server.hosts, f.Hostname)
+	}
+	f.server.lock.Unlock()
+
+	// free the cache's share of the server's budget
+	f.lock.Lock()
+	cache := f.cache
+	f.lock.Unlock()
+	if cache != nil {
+		cache.Close()
+	}
+}
+
+func (f *HTTPForwarder) Shutdown(ctx context.Context) error {
+	f.Close()
+	return waitGroupContext(ctx, &f.active)
 }
 
 func (f *HTTPForwarder) ListenerAddress() string {
@@ -128,51 +308,221 @@ func (f *HTTPForwarder) ListenerAddress() string {
 }
 
 func (f *HTTPForwarder) ListenerPort() uint32 {
-	parts := strings.Split(httpServer.Addr, ":")
-	if len(parts) == 2 {
-		port, _ := strconv.Atoi(parts[1])
-		return uint32(port)
-	} else {
-		return 80
-	}
+	return f.server.port()
 }
 
-func (f HTTPForwarder) handle(w http.ResponseWriter, r *http.Request) error {
+func (f *HTTPForwarder) handle(w http.ResponseWriter, r *http.Request) error {
+	f.active.Add(1)
+	defer f.active.Done()
+
+	opts := awaitOptions(f.currentOptions)
+	f.lock.Lock()
+	cache := f.cache
+	f.lock.Unlock()
+	if !admitVisitor(opts, r.RemoteAddr, &f.rejected, f.clientLog) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+
 	now := time.Now()
 
-	// connect back
-	tunn, err := f.connect()
+	// prepare request
+	publicHost := r.Host
+	removeHopHeaders(r.Header)
+	addForwardedHeaders(r)
+	var vars ruleVariables
+	if len(opts.RequestHeaders) > 0 || len(opts.ResponseHeaders) > 0 {
+		vars = newRuleVariables(r)
+	}
+	if len(opts.HostHeader) > 0 {
+		rewriteRequestHost(r, opts, f.backendScheme())
+	}
+	applyHeaderRules(r.Header, opts.RequestHeaders, vars)
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// stop Write from adding its own
+		r.Header.Set("User-Agent", "")
+	}
+
+	// get a response, from the cache or the backend, passing on any
+	// informational responses on the way
+	interim := func(code int, header http.Header) {
+		writeInterim(w, code, header)
+	}
+	var resp *http.Response
+	var result cacheResult
+	var err error
+	if cache != nil && cacheable(r) {
+		resp, result, err = f.cachedRoundTrip(cache, r, interim, now)
+	} else {
+		resp, err = f.roundTrip(r, interim)
+		if cache != nil {
+			result = cacheBypass
+		}
+	}
 	if err != nil {
 		return err
 	}
-	defer tunn.Close()
+	defer resp.Body.Close()
 
-	// forward request
-	err = r.Write(tunn)
-	if err != nil {
-		return fmt.Errorf("could not forward request: %w", err)
+	if len(result) > 0 {
+		fmt.Fprintf(f.clientLog, "%s [%d] %s %s (%s)\n", now.Format("2006/01/02 15:04:05"), resp.StatusCode, r.Method, r.URL.Path, result)
+	} else {
+		fmt.Fprintf(f.clientLog, "%s [%d] %s %s\n", now.Format("2006/01/02 15:04:05"), resp.StatusCode, r.Method, r.URL.Path)
 	}
 
-	// read response
-	resp, err := http.ReadResponse(bufio.NewReader(tunn), r)
-	if err != nil {
-		return fmt.Errorf("could not read back response: %w", err)
+	removeHopHeaders(resp.Header)
+	if len(opts.HostHeader) > 0 {
+		rewriteResponseHost(resp.Header, opts.HostHeader, requestScheme(r), publicHost)
 	}
-	defer resp.Body.Close()
+	applyHeaderRules(resp.Header, opts.ResponseHeaders, vars)
 
-	fmt.Fprintf(f.clientLog, "%s [%d] %s %s\n", now.Format("2006/01/02 15:04:05"), resp.StatusCode, r.Method, r.URL.Path)
+	encoding := ""
+	if len(opts.Compress) > 0 && shouldCompress(r, resp) {
+		encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"), opts.Compress)
+	}
+	if len(encoding) > 0 {
+		prepareCompressedHeader(resp.Header, encoding)
+	}
 
 	// copy to response
+	header := w.Header()
 	for k, vs := range resp.Header {
-		for _, v := range vs {
-			w.Header().Set(k, v)
-		}
+		header[k] = append(header[k], vs...)
+	}
+	announced := make(map[string]bool, len(resp.Trailer))
+	for k := range resp.Trailer {
+		header.Add("Trailer", k)
+		announced[k] = true
 	}
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+
+	// bodies of unknown length, like event streams, are flushed as they
+	// arrive rather than buffered
+	var dst io.Writer = w
+	var flush func() error
+	if flusher, ok := w.(http.Flusher); ok && resp.ContentLength == -1 {
+		flush = func() error {
+			flusher.Flush()
+			return nil
+		}
+	}
+	var enc encoder
+	if len(encoding) > 0 {
+		enc = newEncoder(encoding, w)
+		dst = enc
+		if flush != nil {
+			flush = func() error {
+				err := enc.Flush()
+				w.(http.Flusher).Flush()
+				return err
+			}
+		}
+	}
+
+	err = copyBody(dst, resp.Body, flush)
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
 	if err != nil {
-		return fmt.Errorf("could not write copy response: %w", err)
+		// too late to report an error to the visitor
+		log.Printf("Could not copy response for %s: %s", f.Hostname, err)
+		return nil
+	}
+
+	// trailers that weren't announced in the header can still be sent,
+	// with the magic prefix
+	for k, vs := range resp.Trailer {
+		if !announced[k] {
+			k = http.TrailerPrefix + k
+		}
+		header[k] = vs
 	}
 
 	return nil
 }
+
+// roundTrip forwards the request to the backend, and reads back its
+// response, passing informational responses to interim. The connection is
+// closed once the response body is.
+func (f *HTTPForwarder) roundTrip(r *http.Request, interim func(int, http.Header)) (*http.Response, error) {
+	// connect back, on behalf of the visitor
+	tunn, err := f.connect(splitAddress(r.RemoteAddr))
+	if err != nil {
+		return nil, err
+	}
+
+	// the request is written while reading the response, since the backend
+	// may respond without reading all of the request body
+	var writeErr error
+	written := make(chan struct{})
+	go func() {
+		writeErr = r.Write(tunn)
+		close(written)
+	}()
+	closeTunnel := func() {
+		tunn.Close()
+		<-written
+	}
+
+	resp, err := readResponse(bufio.NewReader(tunn), r, interim)
+	if err != nil {
+		closeTunnel()
+		if writeErr != nil {
+			return nil, fmt.Errorf("could not forward request: %w", writeErr)
+		}
+		return nil, fmt.Errorf("could not read back response: %w", err)
+	}
+	resp.Body = &closeHook{ReadCloser: resp.Body, hook: closeTunnel}
+
+	return resp, nil
+}
+
+// cachedRoundTrip serves the request from the cache if it can, revalidating
+// the cached response with the backend if it's stale, and otherwise
+// forwards the request, storing the response if allowed.
+func (f *HTTPForwarder) cachedRoundTrip(cache *Cache, r *http.Request, interim func(int, http.Header), now time.Time) (*http.Response, cacheResult, error) {
+	entry := cache.lookup(r)
+	if entry != nil && entry.fresh(r, now) {
+		return entry.response(r, r.Header, now), cacheHit, nil
+	}
+
+	validators := http.Header(nil)
+	if entry != nil {
+		validators = entry.validators()
+	}
+	if validators == nil {
+		resp, err := f.roundTrip(r, interim)
+		if err != nil {
+			return nil, "", err
+		}
+		removeHopHeaders(resp.Header)
+		cache.record(r, resp, now)
+		return resp, cacheMiss, nil
+	}
+
+	// revalidate with our own validators, keeping the visitor's to decide
+	// whether they need the body
+	conditional := make(http.Header)
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		if values, ok := r.Header[name]; ok {
+			conditional[name] = values
+		}
+		r.Header.Del(name)
+	}
+	for name, values := range validators {
+		r.Header[name] = values
+	}
+
+	resp, err := f.roundTrip(r, interim)
+	if err != nil {
+		return nil, "", err
+	}
+	removeHopHeaders(resp.Header)
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry = cache.refresh(entry, resp, time.Now())
+		return entry.response(r, conditional, now), cacheRevalidated, nil
+	}
+	cache.record(r, resp, now)
+	return resp, cacheMiss, nil
+}
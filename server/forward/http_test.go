@@ -0,0 +1,530 @@
+package forward
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testHostname = "site.apparea.test"
+
+// newTestTunnel publishes backend through an HTTP forward over a real SSH
+// connection, returning the URL of the public HTTP server. Every request to
+// the URL is routed to the tunnel, whatever its Host.
+func newTestTunnel(t *testing.T, backend net.Listener) string {
+	t.Helper()
+	return newConfiguredTunnel(t, backend, Options{})
+}
+
+// newConfiguredTunnel is newTestTunnel, with the tunnel configured with
+// opts.
+func newConfiguredTunnel(t *testing.T, backend net.Listener, opts Options) string {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	// the server side of the ssh connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	serverConns := make(chan *ssh.ServerConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(serverConns)
+			return
+		}
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+		if err != nil {
+			close(serverConns)
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+		serverConns <- serverConn
+	}()
+
+	// the client side, which connects forwarded channels to the backend
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	forwarded := client.HandleChannelOpen("forwarded-tcpip")
+	go func() {
+		for newChannel := range forwarded {
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+
+			conn, err := net.Dial("tcp", backend.Addr().String())
+			if err != nil {
+				ch.Close()
+				continue
+			}
+			go func() {
+				io.Copy(conn, ch)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+			go func() {
+				io.Copy(ch, conn)
+				ch.Close()
+				conn.Close()
+			}()
+		}
+	}()
+
+	serverConn, ok := <-serverConns
+	if !ok {
+		t.Fatal("could not establish ssh connection")
+	}
+
+	httpServer := NewHTTPServer()
+	forwarder := NewHTTPForwarder(httpServer, testHostname, serverConn, ForwardRequest{Host: "0.0.0.0", Port: 80})
+	forwarder.Configure(opts)
+	if err := forwarder.Serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	// route every request to the tunnel, so that tests can use the url
+	// directly
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Host = testHostname
+		httpServer.ServeHTTP(w, r)
+	}))
+	t.Cleanup(public.Close)
+
+	return public.URL
+}
+
+// newTestBackend serves handler on a local listener.
+func newTestBackend(t *testing.T, handler http.Handler) net.Listener {
+	t.Helper()
+
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	return backend.Listener
+}
+
+// newRawBackend serves each connection with handler, for responses that
+// net/http can't produce.
+func newRawBackend(t *testing.T, handler func(net.Conn)) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestMultiValuedHeaders(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Values("X-Multi"); len(got) != 2 || got[0] != "one" || got[1] != "two" {
+			t.Errorf("backend got X-Multi %q", got)
+		}
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Add("Link", "</style.css>; rel=preload")
+		w.Header().Add("Link", "</app.js>; rel=preload")
+	})))
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("X-Multi", "one")
+	req.Header.Add("X-Multi", "two")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Values("Set-Cookie"); len(got) != 2 {
+		t.Errorf("got Set-Cookie %q, want both cookies", got)
+	}
+	if got := resp.Header.Values("Link"); len(got) != 2 {
+		t.Errorf("got Link %q, want both links", got)
+	}
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"X-Visitor-Hop", "Keep-Alive", "Proxy-Authorization", "Upgrade"} {
+			if values := r.Header.Values(name); len(values) > 0 {
+				t.Errorf("backend got hop-by-hop header %s: %q", name, values)
+			}
+		}
+		if got := r.Header.Get("Te"); got != "trailers" {
+			t.Errorf("backend got TE %q, want trailers", got)
+		}
+		if got := r.Header.Get("X-End-To-End"); got != "yes" {
+			t.Errorf("backend got X-End-To-End %q, want yes", got)
+		}
+
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End-To-End", "yes")
+	})))
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Connection", "X-Visitor-Hop")
+	req.Header.Set("X-Visitor-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("X-End-To-End", "yes")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, name := range []string{"X-Backend-Hop", "Keep-Alive"} {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			t.Errorf("visitor got hop-by-hop header %s: %q", name, values)
+		}
+	}
+	if got := resp.Header.Get("X-End-To-End"); got != "yes" {
+		t.Errorf("visitor got X-End-To-End %q, want yes", got)
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "body")
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "late")
+	})))
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "body" {
+		t.Errorf("got body %q, want %q", body, "body")
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Errorf("got X-Checksum trailer %q, want abc123", got)
+	}
+	if got := resp.Trailer.Get("X-Undeclared"); got != "late" {
+		t.Errorf("got X-Undeclared trailer %q, want late", got)
+	}
+}
+
+func TestRequestTrailers(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "upload" {
+			t.Errorf("backend got body %q, want upload", body)
+		}
+		if got := r.Trailer.Get("X-Checksum"); got != "abc123" {
+			t.Errorf("backend got X-Checksum trailer %q, want abc123", got)
+		}
+	})))
+
+	body, writer := io.Pipe()
+	req, _ := http.NewRequest("POST", url, body)
+	req.Trailer = http.Header{"X-Checksum": nil}
+	go func() {
+		io.WriteString(writer, "upload")
+		req.Trailer.Set("X-Checksum", "abc123")
+		writer.Close()
+	}()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestExpectContinue(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})))
+
+	var got100 bool
+	trace := &httptrace.ClientTrace{
+		Got100Continue: func() { got100 = true },
+	}
+	req, _ := http.NewRequest("PUT", url, strings.NewReader("payload"))
+	req.Header.Set("Expect", "100-continue")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !got100 {
+		t.Errorf("visitor didn't get 100 Continue")
+	}
+	if string(body) != "payload" {
+		t.Errorf("got body %q, want payload", body)
+	}
+}
+
+func TestInformationalResponses(t *testing.T) {
+	url := newTestTunnel(t, newRawBackend(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		io.WriteString(conn, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n")
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfinal")
+	}))
+
+	var lock sync.Mutex
+	var codes []int
+	var links []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			lock.Lock()
+			defer lock.Unlock()
+			codes = append(codes, code)
+			links = append(links, header.Get("Link"))
+			return nil
+		},
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "final" {
+		t.Errorf("got %d %q, want the final response", resp.StatusCode, body)
+	}
+	if len(resp.Header.Values("Link")) != 0 {
+		t.Errorf("got Link %q on the final response", resp.Header.Values("Link"))
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !relaysInformational {
+		if len(codes) != 0 {
+			t.Errorf("got informational responses %v, want none", codes)
+		}
+		return
+	}
+	if len(codes) != 1 || codes[0] != http.StatusEarlyHints {
+		t.Fatalf("got informational responses %v, want just 103", codes)
+	}
+	if links[0] != "</style.css>; rel=preload" {
+		t.Errorf("got Link %q on the 103, want the backend's", links[0])
+	}
+}
+
+func TestSwitchingProtocols(t *testing.T) {
+	url := newTestTunnel(t, newRawBackend(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	}))
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %d, want the upgrade to be refused with 502", resp.StatusCode)
+	}
+}
+
+func TestHead(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "42")
+		if r.Method != "HEAD" {
+			io.WriteString(w, strings.Repeat("x", 42))
+		}
+	})))
+
+	resp, err := http.Head(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ContentLength != 42 {
+		t.Errorf("got Content-Length %d, want 42", resp.ContentLength)
+	}
+	if len(body) != 0 {
+		t.Errorf("got body %q for HEAD", body)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "content")
+	})))
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("got status %d, want 304", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); got != `"v1"` {
+		t.Errorf("got ETag %q, want \"v1\"", got)
+	}
+	if len(body) != 0 {
+		t.Errorf("got body %q for 304", body)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	t.Cleanup(func() { once.Do(func() { close(release) }) })
+
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: second\n\n")
+	})))
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the first event must arrive before the backend finishes
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "data: first\n" {
+		t.Errorf("got %q, want the first event", line)
+	}
+	once.Do(func() { close(release) })
+}
+
+func TestRequestFidelity(t *testing.T) {
+	url := newTestTunnel(t, newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if values, ok := r.Header["User-Agent"]; ok {
+			t.Errorf("backend got User-Agent %q, but the visitor sent none", values)
+		}
+		if got := r.URL.RequestURI(); got != "/a%2Fb/c?q=1&q=2" {
+			t.Errorf("backend got request uri %q", got)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %d", r.Method, len(body))
+	})))
+
+	req, _ := http.NewRequest("PATCH", url+"/a%2Fb/c?q=1&q=2", strings.NewReader(strings.Repeat("x", 100000)))
+	req.Header.Set("User-Agent", "")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "PATCH 100000" {
+		t.Errorf("got %q, want the request echoed", body)
+	}
+}
+
+func TestBackendUnavailable(t *testing.T) {
+	url := newTestTunnel(t, newRawBackend(t, func(conn net.Conn) {}))
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build go1.19
+// +build go1.19
+
+package forward
+
+// relaysInformational is whether http.ResponseWriter can send informational
+// (1xx) responses ahead of the final response, which needs Go 1.19.
+const relaysInformational = true
@@ -0,0 +1,241 @@
+package forward
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Options configures the behaviour of a session's forwarders. They're parsed
+// from the command given to the ssh session, for example:
+//
+//	ssh -R 22:localhost:22 user@apparea.dev allow-users=alice,bob
+//	ssh -R 80:localhost:8080 user@apparea.dev allow-ips=10.8.0.0/16
+//	ssh -R 0.0.0.0:0:localhost:25 user@apparea.dev proxy-protocol=v2
+//	ssh -R 80:server.lan:8000 user@apparea.dev host-header=server.lan:8000
+//	ssh -R 80:localhost:8080 user@apparea.dev 'response-header-set="X-Frame-Options: DENY"'
+//
+// Values containing spaces can be quoted with single or double quotes.
+type Options struct {
+	// AllowUsers are the users, besides the owner, that may connect to a
+	// private tunnel.
+	AllowUsers []string
+
+	// Visitors are the filters that a visitor's address must pass to reach
+	// a public tunnel; the owner's (from allow-ips and deny-ips), and any
+	// set by admins.
+	Visitors []IPFilter
+
+	// ProxyProtocol is the version of the PROXY protocol header (1 or 2)
+	// sent ahead of each raw tcp connection, to pass on the visitor's
+	// address, or 0 to send none.
+	ProxyProtocol int
+
+	// HostHeader replaces the Host header of HTTP requests, for backends
+	// that route by hostname, with references to it in responses (in
+	// Location and Set-Cookie headers) rewritten back to the public
+	// hostname. RewriteOrigin also rewrites the Origin and Referer headers
+	// of requests to match.
+	HostHeader    string
+	RewriteOrigin bool
+
+	// RequestHeaders and ResponseHeaders are rules applied, in order, to
+	// the headers of HTTP requests and responses.
+	RequestHeaders  []HeaderRule
+	ResponseHeaders []HeaderRule
+
+	// Compress are the encodings (of Encodings) that HTTP responses may be
+	// compressed with, when the backend didn't compress them itself.
+	Compress []string
+
+	// CacheSize is the size of the cache of HTTP responses, in bytes, or
+	// zero to disable caching. It's limited by the server.
+	CacheSize int64
+
+	// Pending, if set, is closed once the session's options are final.
+	// Visitors are held back until then, so that none slip through before
+	// the owner's filters are applied.
+	Pending <-chan struct{}
+}
+
+func ParseOptions(command string) (Options, error) {
+	opts := Options{}
+	filter := IPFilter{}
+	fields, err := splitCommand(command)
+	if err != nil {
+		return opts, err
+	}
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return opts, fmt.Errorf("invalid option %q", field)
+		}
+		key, value := parts[0], parts[1]
+
+		switch key {
+		case "allow-users":
+			opts.AllowUsers = splitList(value)
+		case "allow-ips":
+			networks, err := ParseCIDRs(splitList(value))
+			if err != nil {
+				return opts, err
+			}
+			filter.Allow = networks
+		case "deny-ips":
+			networks, err := ParseCIDRs(splitList(value))
+			if err != nil {
+				return opts, err
+			}
+			filter.Deny = networks
+		case "proxy-protocol":
+			switch value {
+			case "v1":
+				opts.ProxyProtocol = 1
+			case "v2":
+				opts.ProxyProtocol = 2
+			default:
+				return opts, fmt.Errorf("unknown proxy protocol version %q", value)
+			}
+		case "host-header":
+			if len(value) == 0 || strings.ContainsAny(value, "/ \t") {
+				return opts, fmt.Errorf("invalid host %q", value)
+			}
+			opts.HostHeader = value
+		case "rewrite-origin":
+			rewrite, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid value for rewrite-origin: %q", value)
+			}
+			opts.RewriteOrigin = rewrite
+		case "request-header-add", "request-header-set", "request-header-remove":
+			rule, err := parseHeaderRule(strings.TrimPrefix(key, "request-header-"), value)
+			if err != nil {
+				return opts, err
+			}
+			opts.RequestHeaders = append(opts.RequestHeaders, rule)
+		case "response-header-add", "response-header-set", "response-header-remove":
+			rule, err := parseHeaderRule(strings.TrimPrefix(key, "response-header-"), value)
+			if err != nil {
+				return opts, err
+			}
+			opts.ResponseHeaders = append(opts.ResponseHeaders, rule)
+		case "compress":
+			compress, err := parseCompress(value)
+			if err != nil {
+				return opts, err
+			}
+			opts.Compress = compress
+		case "cache":
+			size, err := parseCacheSize(value)
+			if err != nil {
+				return opts, err
+			}
+			opts.CacheSize = size
+		default:
+			return opts, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if !filter.Empty() {
+		opts.Visitors = append(opts.Visitors, filter)
+	}
+
+	return opts, nil
+}
+
+// parseCompress parses the value of the compress option, which is a list of
+// encodings, or a boolean to enable or disable all of them.
+func parseCompress(value string) ([]string, error) {
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if enabled {
+			return Encodings, nil
+		}
+		return nil, nil
+	}
+
+	encodings := splitList(value)
+	for _, encoding := range encodings {
+		if !containsString(Encodings, encoding) {
+			return nil, fmt.Errorf("unknown encoding %q (expected %s)", encoding, strings.Join(Encodings, " or "))
+		}
+	}
+	return encodings, nil
+}
+
+// parseCacheSize parses the value of the cache option, which is a size (like
+// 16M or 512K), or a boolean to use the largest size the server allows.
+func parseCacheSize(value string) (int64, error) {
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if enabled {
+			return math.MaxInt64, nil
+		}
+		return 0, nil
+	}
+
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid cache size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// splitCommand splits a command into whitespace separated fields, where
+// quoted text (in single or double quotes) is kept in one field.
+func splitCommand(command string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField := false
+	var quote rune
+	for _, c := range command {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inField = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", command)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
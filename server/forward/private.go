@@ -0,0 +1,171 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PrivateRegistry tracks the private tunnels, which are never exposed
+// publicly, and are only reachable by authorized users through direct-tcpip
+// channels on the ssh server.
+type PrivateRegistry struct {
+	lock    sync.Mutex
+	tunnels map[string]*PrivateForwarder
+}
+
+func NewPrivateRegistry() *PrivateRegistry {
+	return &PrivateRegistry{
+		tunnels: make(map[string]*PrivateForwarder),
+	}
+}
+
+// Lookup finds the private tunnel registered for the host and port.
+func (registry *PrivateRegistry) Lookup(host string, port uint32) (*PrivateForwarder, bool) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	f, ok := registry.tunnels[privateKey(host, port)]
+	return f, ok
+}
+
+func privateKey(host string, port uint32) string {
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
+
+type PrivateForwarder struct {
+	Request  ForwardRequest
+	Hostname string
+	Owner    string
+
+	clientLog io.Writer
+
+	registry *PrivateRegistry
+	baseConn *ssh.ServerConn
+
+	lock    sync.Mutex
+	options Options
+	active  sync.WaitGroup
+}
+
+func NewPrivateForwarder(registry *PrivateRegistry, hostname string, owner string, conn *ssh.ServerConn, req ForwardRequest) *PrivateForwarder {
+	return &PrivateForwarder{
+		Request:   req,
+		Hostname:  hostname,
+		Owner:     owner,
+		clientLog: ioutil.Discard,
+		registry:  registry,
+		baseConn:  conn,
+	}
+}
+
+func (f *PrivateForwarder) connect(originAddress string, originPort uint32) (io.ReadWriteCloser, error) {
+	ch, err := f.Request.OpenChannel(f.baseConn, originAddress, originPort)
+	if err != nil {
+		return nil, fmt.Errorf("could not open channel (is the port open?)")
+	}
+
+	return ch, nil
+}
+
+// Allows reports whether the user may connect to the tunnel.
+func (f *PrivateForwarder) Allows(username string) bool {
+	if username == f.Owner {
+		return true
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, allowed := range f.options.AllowUsers {
+		if allowed == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Splice connects the incoming channel to the tunnel's owner, copying data
+// in both directions until either side closes.
+func (f *PrivateForwarder) Splice(incoming io.ReadWriteCloser, originAddress string, originPort uint32, username string) error {
+	outgoing, err := f.connect(originAddress, originPort)
+	if err != nil {
+		incoming.Close()
+		return err
+	}
+
+	fmt.Fprintf(f.clientLog, ">>> Private connection from %s (%s)\n", username, net.JoinHostPort(originAddress, strconv.FormatUint(uint64(originPort), 10)))
+
+	f.active.Add(1)
+	closer := func() {
+		incoming.Close()
+		outgoing.Close()
+		f.active.Done()
+	}
+
+	var once sync.Once
+	go func() {
+		io.Copy(incoming, outgoing)
+		once.Do(closer)
+	}()
+	go func() {
+		io.Copy(outgoing, incoming)
+		once.Do(closer)
+	}()
+
+	return nil
+}
+
+func (f *PrivateForwarder) Serve() error {
+	f.registry.lock.Lock()
+	defer f.registry.lock.Unlock()
+
+	key := privateKey(f.Hostname, f.Request.Port)
+	if _, ok := f.registry.tunnels[key]; ok {
+		return fmt.Errorf("private tunnel name already in use")
+	}
+	f.registry.tunnels[key] = f
+
+	return nil
+}
+
+func (f *PrivateForwarder) Close() {
+	f.registry.lock.Lock()
+	key := privateKey(f.Hostname, f.Request.Port)
+	if f.registry.tunnels[key] == f {
+		delete(f.registry.tunnels, key)
+	}
+	f.registry.lock.Unlock()
+}
+
+func (f *PrivateForwarder) Shutdown(ctx context.Context) error {
+	f.Close()
+	return waitGroupContext(ctx, &f.active)
+}
+
+func (f *PrivateForwarder) Configure(opts Options) {
+	f.lock.Lock()
+	f.options = opts
+	f.lock.Unlock()
+}
+
+func (f *PrivateForwarder) Matches(fr ForwardRequest) bool {
+	return f.Request.Equal(fr)
+}
+
+func (f *PrivateForwarder) AttachClientLog(w io.Writer) {
+	f.clientLog = w
+}
+
+func (f *PrivateForwarder) ListenerAddress() string {
+	return "private://" + privateKey(f.Hostname, f.Request.Port)
+}
+
+func (f *PrivateForwarder) ListenerPort() uint32 {
+	return f.Request.Port
+}
@@ -0,0 +1,139 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// hopHeaders are the headers that only apply to a single connection, and so
+// aren't forwarded (RFC 7230, section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including any listed in
+// the Connection header. A "TE: trailers" header is kept, since it tells
+// the backend that trailers will be passed on.
+func removeHopHeaders(header http.Header) {
+	trailers := false
+	for _, te := range header.Values("Te") {
+		for _, token := range strings.Split(te, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				trailers = true
+			}
+		}
+	}
+
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// readResponse reads the final response to a request, passing any
+// informational (1xx) responses before it to interim. 100 Continue is left
+// out, since the visitor was already sent one when the request body was
+// read, and protocol upgrades are refused, since the upgrade headers never
+// reach the backend.
+func readResponse(br *bufio.Reader, r *http.Request, interim func(code int, header http.Header)) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(br, r)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			resp.Body.Close()
+			return nil, fmt.Errorf("protocol upgrades are not supported")
+		}
+		if resp.StatusCode >= 200 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusContinue && interim != nil {
+			interim(resp.StatusCode, resp.Header)
+		}
+	}
+}
+
+// writeInterim sends an informational response to the visitor, if the
+// ResponseWriter supports it, without leaving its headers behind for the
+// final response.
+func writeInterim(w http.ResponseWriter, code int, header http.Header) {
+	if !relaysInformational {
+		return
+	}
+
+	removeHopHeaders(header)
+	dst := w.Header()
+	for k, vs := range header {
+		dst[k] = vs
+	}
+	w.WriteHeader(code)
+	for k := range header {
+		delete(dst, k)
+	}
+}
+
+// copyBody copies a response body to the visitor, calling flush (if not nil)
+// after every write.
+func copyBody(w io.Writer, body io.Reader, flush func() error) error {
+	if flush == nil {
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// closeHook is a response body that calls hook after it's closed.
+type closeHook struct {
+	io.ReadCloser
+
+	once sync.Once
+	hook func()
+}
+
+func (c *closeHook) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.hook)
+	return err
+}
@@ -1,29 +1,44 @@
 package forward
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"strconv"
 	"sync"
 
-	"github.com/jedevc/apparea/server/helpers"
+	"github.com/jedevc/apparea/server/proxyproto"
 	"golang.org/x/crypto/ssh"
 )
 
 type RawForwarder struct {
+	// rejected counts the visitors turned away, and is first for alignment
+	// with atomic operations
+	rejected uint64
+
 	Request  ForwardRequest
 	Hostname string
 
+	// PreferredPort is tried first when the request asks for any port (port
+	// 0), falling back to a random port if it's unavailable.
+	PreferredPort uint32
+
+	// TrustedProxies are the load balancers that must send a PROXY protocol
+	// header, giving the visitor's address, on each connection.
+	TrustedProxies []*net.IPNet
+
 	clientLog io.Writer
 
 	baseConn *ssh.ServerConn
 
 	lock     sync.Mutex
 	closed   bool
+	options  Options
 	listener net.Listener
+
+	active sync.WaitGroup
 }
 
 func NewRawForwarder(hostname string, conn *ssh.ServerConn, req ForwardRequest) *RawForwarder {
@@ -35,29 +50,31 @@ func NewRawForwarder(hostname string, conn *ssh.ServerConn, req ForwardRequest)
 	}
 }
 
-func (f RawForwarder) connect() (io.ReadWriteCloser, error) {
-	remoteAddress, remotePortStr, _ := net.SplitHostPort(f.baseConn.RemoteAddr().String())
-	remotePort, _ := strconv.Atoi(remotePortStr)
-
-	data := make([]byte, 0)
-	helpers.PackString(&data, f.Request.Host)
-	helpers.PackInt(&data, f.Request.Port)
-	helpers.PackString(&data, remoteAddress)
-	helpers.PackInt(&data, uint32(remotePort))
-
-	ch, reqs, err := f.baseConn.OpenChannel("forwarded-tcpip", data)
+func (f *RawForwarder) connect(originAddress string, originPort uint32) (io.ReadWriteCloser, error) {
+	ch, err := f.Request.OpenChannel(f.baseConn, originAddress, originPort)
 	if err != nil {
 		return nil, fmt.Errorf("could not open channel (is the port open?)")
 	}
-	go ssh.DiscardRequests(reqs)
 
 	return ch, nil
 }
 
 func (f *RawForwarder) Serve() error {
-	ln, err := net.Listen("tcp", f.Request.Address())
+	var ln net.Listener
+	var err error
+	if f.Request.Port == 0 && f.PreferredPort != 0 {
+		preferred := f.Request
+		preferred.Port = f.PreferredPort
+		ln, err = net.Listen("tcp", preferred.ListenAddress())
+	}
+	if ln == nil {
+		ln, err = net.Listen("tcp", f.Request.ListenAddress())
+	}
 	if err != nil {
-		return fmt.Errorf("Could not listen on %s", f.Request.Address())
+		return fmt.Errorf("Could not listen on %s", f.Request.ListenAddress())
+	}
+	if len(f.TrustedProxies) > 0 {
+		ln = proxyproto.NewListener(ln, f.TrustedProxies)
 	}
 	f.listener = ln
 
@@ -75,7 +92,10 @@ func (f *RawForwarder) Serve() error {
 
 			incoming, err := f.listener.Accept()
 			if err != nil {
-				if f.closed {
+				f.lock.Lock()
+				closed := f.closed
+				f.lock.Unlock()
+				if closed {
 					break
 				}
 
@@ -83,17 +103,38 @@ func (f *RawForwarder) Serve() error {
 				continue
 			}
 
-			outgoing, err := f.connect()
+			opts := awaitOptions(f.currentOptions)
+			if !admitVisitor(opts, incoming.RemoteAddr().String(), &f.rejected, f.clientLog) {
+				incoming.Close()
+				continue
+			}
+
+			outgoing, err := f.connect(splitAddress(incoming.RemoteAddr().String()))
 			if err != nil {
 				log.Print("Could not open remote connection")
 				incoming.Close()
 				continue
 			}
+			if opts.ProxyProtocol != 0 {
+				header := proxyproto.Header{
+					Version:     opts.ProxyProtocol,
+					Source:      tcpAddr(incoming.RemoteAddr()),
+					Destination: tcpAddr(incoming.LocalAddr()),
+				}
+				if _, err := header.WriteTo(outgoing); err != nil {
+					log.Printf("Could not write proxy protocol header: %s", err)
+					incoming.Close()
+					outgoing.Close()
+					continue
+				}
+			}
 			closer := func() {
 				incoming.Close()
 				outgoing.Close()
+				f.active.Done()
 			}
 
+			f.active.Add(1)
 			var once sync.Once
 			go func() {
 				io.Copy(incoming, outgoing)
@@ -118,6 +159,27 @@ func (f *RawForwarder) Close() {
 	f.lock.Unlock()
 }
 
+func (f *RawForwarder) Shutdown(ctx context.Context) error {
+	f.Close()
+	return waitGroupContext(ctx, &f.active)
+}
+
+func (f *RawForwarder) Configure(opts Options) {
+	f.lock.Lock()
+	f.options = opts
+	f.lock.Unlock()
+}
+
+func (f *RawForwarder) currentOptions() Options {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.options
+}
+
+func (f *RawForwarder) Matches(fr ForwardRequest) bool {
+	return f.Request.Equal(fr)
+}
+
 func (f *RawForwarder) AttachClientLog(w io.Writer) {
 	f.clientLog = w
 }
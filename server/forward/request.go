@@ -2,14 +2,20 @@ package forward
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 
 	"github.com/jedevc/apparea/server/helpers"
+	"golang.org/x/crypto/ssh"
 )
 
 type ForwardRequest struct {
 	Host string
 	Port uint32
+
+	// SocketPath is set for streamlocal forwards, which forward from a unix
+	// socket on the client instead of a tcp port.
+	SocketPath string
 }
 
 func ParseForwardRequest(payload []byte) (ForwardRequest, error) {
@@ -34,6 +40,123 @@ func ParseForwardRequest(payload []byte) (ForwardRequest, error) {
 	return req, nil
 }
 
+// ParseStreamLocalForwardRequest parses the payload of a
+// streamlocal-forward@openssh.com request.
+func ParseStreamLocalForwardRequest(payload []byte) (ForwardRequest, error) {
+	req := ForwardRequest{}
+
+	path, err := helpers.UnpackString(&payload)
+	if err != nil {
+		return req, err
+	}
+	req.SocketPath = path
+
+	if len(payload) != 0 {
+		return req, fmt.Errorf("Forward request parse error: Unknown excess data")
+	}
+
+	return req, nil
+}
+
+// Equal reports whether both requests forward from the same address or
+// socket.
+func (fr ForwardRequest) Equal(other ForwardRequest) bool {
+	return fr.Host == other.Host && fr.Port == other.Port && fr.SocketPath == other.SocketPath
+}
+
 func (fr ForwardRequest) Address() string {
 	return fr.Host + ":" + strconv.FormatUint(uint64(fr.Port), 10)
 }
+
+// ListenAddress is the address that should be listened on for the request.
+// The bind address is only respected if it's an IP address, since otherwise
+// it names the subdomain to publish on.
+func (fr ForwardRequest) ListenAddress() string {
+	host := ""
+	if net.ParseIP(fr.Host) != nil {
+		host = fr.Host
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(fr.Port), 10))
+}
+
+// IsWildcardHost reports whether the bind address of a forward request
+// doesn't name a specific host, as with the defaults used by ssh clients.
+func IsWildcardHost(host string) bool {
+	switch host {
+	case "", "*", "localhost", "0.0.0.0", "::", "127.0.0.1", "::1":
+		return true
+	default:
+		return false
+	}
+}
+
+// OpenChannel opens a channel back to the client for a connection from the
+// origin address.
+func (fr ForwardRequest) OpenChannel(conn ssh.Conn, originAddress string, originPort uint32) (ssh.Channel, error) {
+	data := make([]byte, 0)
+
+	var channelType string
+	if len(fr.SocketPath) > 0 {
+		channelType = "forwarded-streamlocal@openssh.com"
+		helpers.PackString(&data, fr.SocketPath)
+		helpers.PackString(&data, "")
+	} else {
+		channelType = "forwarded-tcpip"
+		helpers.PackString(&data, fr.Host)
+		helpers.PackInt(&data, fr.Port)
+		helpers.PackString(&data, originAddress)
+		helpers.PackInt(&data, originPort)
+	}
+
+	ch, reqs, err := conn.OpenChannel(channelType, data)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return ch, nil
+}
+
+// DirectRequest is the payload of a direct-tcpip channel open, requesting a
+// connection to a host and port from an originating address.
+type DirectRequest struct {
+	Host string
+	Port uint32
+
+	OriginAddress string
+	OriginPort    uint32
+}
+
+func ParseDirectRequest(payload []byte) (DirectRequest, error) {
+	req := DirectRequest{}
+
+	host, err := helpers.UnpackString(&payload)
+	if err != nil {
+		return req, err
+	}
+	req.Host = host
+
+	port, err := helpers.UnpackInt(&payload)
+	if err != nil {
+		return req, err
+	}
+	req.Port = port
+
+	originAddress, err := helpers.UnpackString(&payload)
+	if err != nil {
+		return req, err
+	}
+	req.OriginAddress = originAddress
+
+	originPort, err := helpers.UnpackInt(&payload)
+	if err != nil {
+		return req, err
+	}
+	req.OriginPort = originPort
+
+	if len(payload) != 0 {
+		return req, fmt.Errorf("Direct request parse error: Unknown excess data")
+	}
+
+	return req, nil
+}
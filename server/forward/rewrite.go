@@ -0,0 +1,79 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteRequestHost rewrites a request to look like it was made directly to
+// the backend host, rather than to the tunnel's public host, so that
+// backends routing by hostname see a name they know.
+func rewriteRequestHost(r *http.Request, opts Options, backendScheme string) {
+	publicHost := r.Host
+	r.Host = opts.HostHeader
+
+	if !opts.RewriteOrigin {
+		return
+	}
+	for _, header := range []string{"Origin", "Referer"} {
+		value := r.Header.Get(header)
+		if len(value) == 0 {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || !strings.EqualFold(u.Host, publicHost) {
+			continue
+		}
+		u.Scheme = backendScheme
+		u.Host = opts.HostHeader
+		r.Header.Set(header, u.String())
+	}
+}
+
+// rewriteResponseHost rewrites the references to the backend host in a
+// response, in Location and Set-Cookie headers, back to the public host the
+// visitor used.
+func rewriteResponseHost(header http.Header, backendHost string, publicScheme string, publicHost string) {
+	if location := header.Get("Location"); len(location) > 0 {
+		u, err := url.Parse(location)
+		if err == nil && strings.EqualFold(u.Host, backendHost) {
+			u.Scheme = publicScheme
+			u.Host = publicHost
+			header.Set("Location", u.String())
+		}
+	}
+
+	backendDomain := stripPort(backendHost)
+	publicDomain := stripPort(publicHost)
+	cookies := header["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = rewriteCookieDomain(cookie, backendDomain, publicDomain)
+	}
+}
+
+// rewriteCookieDomain replaces the Domain attribute of a Set-Cookie header
+// value, if it matches the domain from, keeping the rest of the cookie
+// untouched.
+func rewriteCookieDomain(cookie string, from string, to string) string {
+	parts := strings.Split(cookie, ";")
+	// the first part is the cookie itself, which may be named Domain
+	for i := 1; i < len(parts); i++ {
+		attr := strings.SplitN(strings.TrimSpace(parts[i]), "=", 2)
+		if len(attr) != 2 || !strings.EqualFold(attr[0], "Domain") {
+			continue
+		}
+		if strings.EqualFold(strings.TrimPrefix(attr[1], "."), from) {
+			parts[i] = " " + attr[0] + "=" + to
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,149 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteRequestHost(t *testing.T) {
+	tests := []struct {
+		name          string
+		rewriteOrigin bool
+		origin        string
+		referer       string
+		expectOrigin  string
+		expectReferer string
+	}{
+		{
+			"disabled", false,
+			"https://site.apparea.test", "https://site.apparea.test/page",
+			"https://site.apparea.test", "https://site.apparea.test/page",
+		},
+		{
+			"rewritten", true,
+			"https://site.apparea.test", "https://site.apparea.test/page?q=1",
+			"http://server.lan:8000", "http://server.lan:8000/page?q=1",
+		},
+		{
+			"host case", true,
+			"https://SITE.apparea.test", "",
+			"http://server.lan:8000", "",
+		},
+		{
+			"other hosts", true,
+			"https://evil.test", "https://other.apparea.test/page",
+			"https://evil.test", "https://other.apparea.test/page",
+		},
+		{
+			"unparseable", true,
+			"null", "://bad",
+			"null", "://bad",
+		},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("GET", "http://site.apparea.test/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.origin) > 0 {
+			r.Header.Set("Origin", test.origin)
+		}
+		if len(test.referer) > 0 {
+			r.Header.Set("Referer", test.referer)
+		}
+
+		rewriteRequestHost(r, Options{HostHeader: "server.lan:8000", RewriteOrigin: test.rewriteOrigin}, "http")
+		if r.Host != "server.lan:8000" {
+			t.Errorf("%s: expected host server.lan:8000, got %q", test.name, r.Host)
+		}
+		if origin := r.Header.Get("Origin"); origin != test.expectOrigin {
+			t.Errorf("%s: expected Origin %q, got %q", test.name, test.expectOrigin, origin)
+		}
+		if referer := r.Header.Get("Referer"); referer != test.expectReferer {
+			t.Errorf("%s: expected Referer %q, got %q", test.name, test.expectReferer, referer)
+		}
+	}
+}
+
+func TestRewriteResponseHost(t *testing.T) {
+	tests := []struct {
+		name            string
+		location        string
+		cookies         []string
+		expected        string
+		expectedCookies []string
+	}{
+		{
+			"absolute location", "http://server.lan:8000/login?next=%2F", nil,
+			"https://site.apparea.test/login?next=%2F", nil,
+		},
+		{
+			"location case", "http://SERVER.lan:8000/", nil,
+			"https://site.apparea.test/", nil,
+		},
+		{
+			"relative location", "/login", nil,
+			"/login", nil,
+		},
+		{
+			"other location", "https://auth.example.com/login", nil,
+			"https://auth.example.com/login", nil,
+		},
+		{
+			"other port", "http://server.lan:9000/", nil,
+			"http://server.lan:9000/", nil,
+		},
+		{
+			"cookies", "",
+			[]string{"a=1; Domain=server.lan; Path=/", "b=2; Path=/", "c=3; Domain=example.com"},
+			"",
+			[]string{"a=1; Domain=site.apparea.test; Path=/", "b=2; Path=/", "c=3; Domain=example.com"},
+		},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if len(test.location) > 0 {
+			header.Set("Location", test.location)
+		}
+		for _, cookie := range test.cookies {
+			header.Add("Set-Cookie", cookie)
+		}
+
+		rewriteResponseHost(header, "server.lan:8000", "https", "site.apparea.test")
+		if location := header.Get("Location"); location != test.expected {
+			t.Errorf("%s: expected Location %q, got %q", test.name, test.expected, location)
+		}
+		cookies := header["Set-Cookie"]
+		if len(cookies) != len(test.expectedCookies) {
+			t.Errorf("%s: expected cookies %q, got %q", test.name, test.expectedCookies, cookies)
+			continue
+		}
+		for i := range cookies {
+			if cookies[i] != test.expectedCookies[i] {
+				t.Errorf("%s: expected cookie %q, got %q", test.name, test.expectedCookies[i], cookies[i])
+			}
+		}
+	}
+}
+
+func TestRewriteCookieDomain(t *testing.T) {
+	tests := []struct {
+		cookie   string
+		expected string
+	}{
+		{"id=1; Domain=server.lan", "id=1; Domain=site.apparea.test"},
+		{"id=1; domain=.server.lan; Secure", "id=1; domain=site.apparea.test; Secure"},
+		{"id=1; Path=/; DOMAIN=SERVER.LAN; HttpOnly", "id=1; Path=/; DOMAIN=site.apparea.test; HttpOnly"},
+		{"id=1; Domain=example.com", "id=1; Domain=example.com"},
+		{"id=1; Domain=sub.server.lan", "id=1; Domain=sub.server.lan"},
+		{"id=1; Path=/", "id=1; Path=/"},
+		// only attributes are rewritten, not the cookie itself
+		{"Domain=server.lan", "Domain=server.lan"},
+		{"id=Domain=server.lan", "id=Domain=server.lan"},
+	}
+	for _, test := range tests {
+		if got := rewriteCookieDomain(test.cookie, "server.lan", "site.apparea.test"); got != test.expected {
+			t.Errorf("rewriteCookieDomain(%q) = %q, expected %q", test.cookie, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package forward
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// HeaderRule adds, sets or removes a header of the requests to, or responses
+// from, an HTTP tunnel. The value is a template, where {visitor_ip},
+// {visitor_port}, {host} and {request_id} are replaced for each request.
+type HeaderRule struct {
+	Action string
+	Name   string
+	Value  string
+}
+
+var templateVariable = regexp.MustCompile(`\{[a-z_]*\}`)
+
+var templateVariables = map[string]bool{
+	"{visitor_ip}":   true,
+	"{visitor_port}": true,
+	"{host}":         true,
+	"{request_id}":   true,
+}
+
+// parseHeaderRule parses the value of a header rule option, which is a
+// header name for removal, or "Name: value" otherwise.
+func parseHeaderRule(action string, value string) (HeaderRule, error) {
+	rule := HeaderRule{Action: action}
+	if action == "remove" {
+		rule.Name = strings.TrimSpace(value)
+	} else {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return rule, fmt.Errorf("invalid header %q (expected \"Name: value\")", value)
+		}
+		rule.Name = strings.TrimSpace(parts[0])
+		rule.Value = strings.TrimSpace(parts[1])
+	}
+
+	if len(rule.Name) == 0 || strings.IndexFunc(rule.Name, func(c rune) bool { return !isTokenChar(c) }) >= 0 {
+		return rule, fmt.Errorf("invalid header name %q", rule.Name)
+	}
+	if strings.EqualFold(rule.Name, "Host") {
+		return rule, fmt.Errorf("the Host header can only be changed with host-header")
+	}
+	for _, name := range hopHeaders {
+		if strings.EqualFold(rule.Name, name) {
+			return rule, fmt.Errorf("the %s header only applies to a single connection", name)
+		}
+	}
+	for _, variable := range templateVariable.FindAllString(rule.Value, -1) {
+		if !templateVariables[variable] {
+			return rule, fmt.Errorf("unknown variable %s in header %q", variable, rule.Name)
+		}
+	}
+
+	return rule, nil
+}
+
+// ruleVariables are the values of the template variables for a request.
+type ruleVariables struct {
+	replacer *strings.Replacer
+}
+
+func newRuleVariables(r *http.Request) ruleVariables {
+	ip, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return ruleVariables{
+		replacer: strings.NewReplacer(
+			"{visitor_ip}", ip,
+			"{visitor_port}", port,
+			"{host}", r.Host,
+			"{request_id}", newRequestID(),
+		),
+	}
+}
+
+func (v ruleVariables) expand(template string) string {
+	return v.replacer.Replace(template)
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// applyHeaderRules applies the rules, in order, to the header.
+func applyHeaderRules(header http.Header, rules []HeaderRule, vars ruleVariables) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case "add":
+			header.Add(rule.Name, vars.expand(rule.Value))
+		case "set":
+			header.Set(rule.Name, vars.expand(rule.Value))
+		case "remove":
+			header.Del(rule.Name)
+		}
+	}
+}
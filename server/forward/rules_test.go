@@ -0,0 +1,212 @@
+package forward
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestParseHeaderRule(t *testing.T) {
+	tests := []struct {
+		action string
+		value  string
+		rule   HeaderRule
+		ok     bool
+	}{
+		{"add", "X-Env: prod", HeaderRule{"add", "X-Env", "prod"}, true},
+		{"set", "  X-Env  :  prod  ", HeaderRule{"set", "X-Env", "prod"}, true},
+		{"set", "X-Empty:", HeaderRule{"set", "X-Empty", ""}, true},
+		{"set", "Location: http://server.lan:8000/", HeaderRule{"set", "Location", "http://server.lan:8000/"}, true},
+		{"remove", " Server ", HeaderRule{"remove", "Server", ""}, true},
+		{"set", "X-Visitor: {visitor_ip}:{visitor_port} {host} {request_id}", HeaderRule{"set", "X-Visitor", "{visitor_ip}:{visitor_port} {host} {request_id}"}, true},
+		// names need a colon and a value, except for removal
+		{"add", "X-Env", HeaderRule{}, false},
+		{"set", ": prod", HeaderRule{}, false},
+		{"remove", "", HeaderRule{}, false},
+		{"set", "X Env: prod", HeaderRule{}, false},
+		{"set", "X-Env(1): prod", HeaderRule{}, false},
+		{"set", "X-Visitor: {visitor}", HeaderRule{}, false},
+		{"set", "Host: server.lan", HeaderRule{}, false},
+		{"remove", "host", HeaderRule{}, false},
+		// hop-by-hop headers are removed by the proxy anyway
+		{"set", "Connection: close", HeaderRule{}, false},
+		{"add", "transfer-encoding: chunked", HeaderRule{}, false},
+		{"remove", "Upgrade", HeaderRule{}, false},
+		{"set", "Keep-Alive: timeout=5", HeaderRule{}, false},
+	}
+	for _, test := range tests {
+		rule, err := parseHeaderRule(test.action, test.value)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s %q: expected an error, got %+v", test.action, test.value, rule)
+			}
+			continue
+		}
+		if err != nil || rule != test.rule {
+			t.Errorf("%s %q: expected %+v, got %+v (%v)", test.action, test.value, test.rule, rule, err)
+		}
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []HeaderRule
+		header   http.Header
+		expected http.Header
+	}{
+		{
+			"add",
+			[]HeaderRule{{"add", "X-Env", "prod"}, {"add", "X-Env", "eu"}},
+			http.Header{"X-Env": {"dev"}},
+			http.Header{"X-Env": {"dev", "prod", "eu"}},
+		},
+		{
+			"set",
+			[]HeaderRule{{"set", "x-env", "prod"}},
+			http.Header{"X-Env": {"dev", "test"}},
+			http.Header{"X-Env": {"prod"}},
+		},
+		{
+			"remove",
+			[]HeaderRule{{"remove", "server", ""}},
+			http.Header{"Server": {"nginx"}, "X-Env": {"dev"}},
+			http.Header{"X-Env": {"dev"}},
+		},
+		// rules apply in order, so later rules see the earlier ones' changes
+		{
+			"remove then add",
+			[]HeaderRule{{"remove", "X-Env", ""}, {"add", "X-Env", "prod"}},
+			http.Header{"X-Env": {"dev"}},
+			http.Header{"X-Env": {"prod"}},
+		},
+		{
+			"add then set",
+			[]HeaderRule{{"add", "X-Env", "prod"}, {"set", "X-Env", "eu"}},
+			http.Header{"X-Env": {"dev"}},
+			http.Header{"X-Env": {"eu"}},
+		},
+		{
+			"set then remove",
+			[]HeaderRule{{"set", "X-Env", "prod"}, {"remove", "X-Env", ""}},
+			http.Header{},
+			http.Header{},
+		},
+		{
+			"templates",
+			[]HeaderRule{{"set", "X-Visitor", "{visitor_ip} port {visitor_port}"}, {"set", "X-Site", "https://{host}/"}},
+			http.Header{},
+			http.Header{"X-Visitor": {"192.0.2.1 port 1234"}, "X-Site": {"https://site.apparea.test/"}},
+		},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("GET", "http://site.apparea.test/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "192.0.2.1:1234"
+
+		applyHeaderRules(test.header, test.rules, newRuleVariables(r))
+		if len(test.header) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.header)
+			continue
+		}
+		for name, values := range test.expected {
+			got := test.header.Values(name)
+			if len(got) != len(values) {
+				t.Errorf("%s: expected %s %q, got %q", test.name, name, values, got)
+				continue
+			}
+			for i := range values {
+				if got[i] != values[i] {
+					t.Errorf("%s: expected %s %q, got %q", test.name, name, values, got)
+				}
+			}
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://site.apparea.test/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	rules := []HeaderRule{{"set", "X-Request-Id", "{request_id}"}}
+
+	// the id is shared by the rules for a request, and differs between them
+	vars := newRuleVariables(r)
+	request, response := http.Header{}, http.Header{}
+	applyHeaderRules(request, rules, vars)
+	applyHeaderRules(response, rules, vars)
+	id := request.Get("X-Request-Id")
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 16 {
+		t.Fatalf("expected a 16 digit hex id, got %q", id)
+	}
+	if response.Get("X-Request-Id") != id {
+		t.Errorf("expected the response to have the request's id %s, got %s", id, response.Get("X-Request-Id"))
+	}
+
+	other := http.Header{}
+	applyHeaderRules(other, rules, newRuleVariables(r))
+	if other.Get("X-Request-Id") == id {
+		t.Errorf("expected another request to have a new id, got %s again", id)
+	}
+}
+
+func TestHeaderRulesAfterForwarded(t *testing.T) {
+	rule := func(action string, value string) HeaderRule {
+		rule, err := parseHeaderRule(action, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule
+	}
+
+	received := make(chan http.Header, 1)
+	backend := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Server", "backend")
+	}))
+	url := newConfiguredTunnel(t, backend, Options{
+		RequestHeaders: []HeaderRule{
+			// the rules see (and can replace) the forwarded headers
+			rule("set", "X-Forwarded-For: {visitor_ip}"),
+			rule("remove", "Forwarded"),
+			rule("set", "X-Request-Id: {request_id}"),
+		},
+		ResponseHeaders: []HeaderRule{
+			rule("remove", "Server"),
+			rule("set", "X-Request-Id: {request_id}"),
+		},
+	})
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	header := <-received
+	if got := header.Values("X-Forwarded-For"); len(got) != 1 || got[0] != "127.0.0.1" {
+		t.Errorf("expected the rule to replace X-Forwarded-For, got %q", got)
+	}
+	if got := header.Get("Forwarded"); len(got) > 0 {
+		t.Errorf("expected the rule to remove Forwarded, got %q", got)
+	}
+	if got := header.Get("X-Forwarded-Host"); got != testHostname {
+		t.Errorf("expected other forwarded headers to be kept, got X-Forwarded-Host %q", got)
+	}
+
+	if got := resp.Header.Get("Server"); len(got) > 0 {
+		t.Errorf("expected the rule to remove Server, got %q", got)
+	}
+	if id := header.Get("X-Request-Id"); len(id) == 0 || resp.Header.Get("X-Request-Id") != id {
+		t.Errorf("expected the same request id on both sides, got %q and %q", id, resp.Header.Get("X-Request-Id"))
+	}
+}
@@ -0,0 +1,333 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jedevc/apparea/server/helpers"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// UDPForwardRequestType is the global request sent by clients to
+	// request a public UDP port, with the same payload as tcpip-forward.
+	UDPForwardRequestType = "udp-forward@apparea.dev"
+
+	// UDPChannelType is the channel opened to the client for each UDP flow,
+	// with the same payload as forwarded-tcpip. Datagrams are sent in both
+	// directions as length-prefixed frames.
+	UDPChannelType = "forwarded-udp@apparea.dev"
+
+	// MaxDatagramSize is the largest datagram that can be forwarded.
+	MaxDatagramSize = 65535
+)
+
+const udpIdleTimeout = 2 * time.Minute
+const udpMaxFlows = 256
+const udpFlowQueue = 64
+
+type UDPForwarder struct {
+	Request  ForwardRequest
+	Hostname string
+
+	clientLog io.Writer
+
+	baseConn *ssh.ServerConn
+
+	// idleTimeout and maxFlows limit the flows kept open at once
+	idleTimeout time.Duration
+	maxFlows    int
+
+	lock     sync.Mutex
+	closed   bool
+	options  Options
+	listener *net.UDPConn
+	flows    map[string]*udpFlow
+}
+
+// udpFlow tracks the datagrams exchanged with a single visitor address,
+// forwarded over their own channel.
+type udpFlow struct {
+	addr    *net.UDPAddr
+	queue   chan []byte
+	channel ssh.Channel
+
+	lock       sync.Mutex
+	lastActive time.Time
+	closed     bool
+	closeOnce  sync.Once
+}
+
+func NewUDPForwarder(hostname string, conn *ssh.ServerConn, req ForwardRequest) *UDPForwarder {
+	return &UDPForwarder{
+		Request:     req,
+		Hostname:    hostname,
+		clientLog:   ioutil.Discard,
+		baseConn:    conn,
+		idleTimeout: udpIdleTimeout,
+		maxFlows:    udpMaxFlows,
+		flows:       make(map[string]*udpFlow),
+	}
+}
+
+func (f *UDPForwarder) connect(addr *net.UDPAddr) (ssh.Channel, error) {
+	data := make([]byte, 0)
+	helpers.PackString(&data, f.Request.Host)
+	helpers.PackInt(&data, f.Request.Port)
+	helpers.PackString(&data, addr.IP.String())
+	helpers.PackInt(&data, uint32(addr.Port))
+
+	ch, reqs, err := f.baseConn.OpenChannel(UDPChannelType, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not open channel (is the client listening?)")
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return ch, nil
+}
+
+func (f *UDPForwarder) Serve() error {
+	addr, err := net.ResolveUDPAddr("udp", f.Request.ListenAddress())
+	if err != nil {
+		return fmt.Errorf("Could not resolve %s", f.Request.ListenAddress())
+	}
+	ln, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s", f.Request.ListenAddress())
+	}
+	f.listener = ln
+
+	// reconfigure request port (only changes in the case that port=0)
+	f.Request.Port = f.ListenerPort()
+
+	go f.expireFlows()
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := f.listener.ReadFromUDP(buf)
+			if err != nil {
+				if f.isClosed() {
+					break
+				}
+
+				log.Printf("Could not read datagram")
+				continue
+			}
+
+			datagram := make([]byte, n)
+			copy(datagram, buf[:n])
+			f.deliver(addr, datagram)
+		}
+	}()
+
+	return nil
+}
+
+// deliver queues a datagram on the flow for its source address, creating the
+// flow if this is the first datagram seen from it.
+func (f *UDPForwarder) deliver(addr *net.UDPAddr, datagram []byte) {
+	awaitOptions(f.currentOptions)
+
+	f.lock.Lock()
+	flow, ok := f.flows[addr.String()]
+	if !ok {
+		if len(f.flows) >= f.maxFlows {
+			f.lock.Unlock()
+			return
+		}
+		// unlike connections, every datagram from a rejected visitor would
+		// be logged, so they're silently dropped
+		if !f.options.AllowsVisitor(addr.String()) {
+			f.lock.Unlock()
+			return
+		}
+
+		flow = &udpFlow{
+			addr:       addr,
+			queue:      make(chan []byte, udpFlowQueue),
+			lastActive: time.Now(),
+		}
+		f.flows[addr.String()] = flow
+		go f.handleFlow(flow)
+	}
+
+	// the queue is only ever closed after the flow is removed from the map,
+	// so it's safe to send while we hold the lock
+	flow.touch()
+	select {
+	case flow.queue <- datagram:
+	default:
+		// drop the datagram if the client can't keep up, like a real
+		// network would
+	}
+	f.lock.Unlock()
+}
+
+func (f *UDPForwarder) handleFlow(flow *udpFlow) {
+	ch, err := f.connect(flow.addr)
+	if err != nil {
+		log.Print("Could not open remote connection")
+		f.removeFlow(flow)
+		return
+	}
+	flow.lock.Lock()
+	if flow.closed {
+		flow.lock.Unlock()
+		ch.Close()
+		return
+	}
+	flow.channel = ch
+	flow.lock.Unlock()
+
+	go func() {
+		for {
+			datagram, err := helpers.ReadFrame(ch, MaxDatagramSize)
+			if err != nil {
+				break
+			}
+			flow.touch()
+			f.listener.WriteToUDP(datagram, flow.addr)
+		}
+		f.removeFlow(flow)
+	}()
+
+	for datagram := range flow.queue {
+		err := helpers.WriteFrame(ch, datagram)
+		if err != nil {
+			break
+		}
+	}
+	f.removeFlow(flow)
+}
+
+func (f *UDPForwarder) removeFlow(flow *udpFlow) {
+	f.lock.Lock()
+	if f.flows[flow.addr.String()] == flow {
+		delete(f.flows, flow.addr.String())
+	}
+	f.lock.Unlock()
+
+	flow.close()
+}
+
+// expireFlows periodically closes flows that have been idle for too long.
+func (f *UDPForwarder) expireFlows() {
+	ticker := time.NewTicker(f.idleTimeout / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if f.isClosed() {
+			return
+		}
+
+		f.lock.Lock()
+		var expired []*udpFlow
+		for _, flow := range f.flows {
+			if flow.idle() > f.idleTimeout {
+				expired = append(expired, flow)
+			}
+		}
+		f.lock.Unlock()
+
+		for _, flow := range expired {
+			f.removeFlow(flow)
+		}
+	}
+}
+
+func (f *UDPForwarder) isClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+func (f *UDPForwarder) Close() {
+	f.lock.Lock()
+	f.closed = true
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	flows := f.flows
+	f.flows = make(map[string]*udpFlow)
+	f.lock.Unlock()
+
+	for _, flow := range flows {
+		flow.close()
+	}
+}
+
+func (f *UDPForwarder) Shutdown(ctx context.Context) error {
+	// datagrams have no notion of being in-flight, so there's nothing to
+	// wait for
+	f.Close()
+	return nil
+}
+
+func (f *UDPForwarder) Configure(opts Options) {
+	f.lock.Lock()
+	f.options = opts
+	f.lock.Unlock()
+}
+
+func (f *UDPForwarder) currentOptions() Options {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.options
+}
+
+func (f *UDPForwarder) Matches(fr ForwardRequest) bool {
+	return f.Request.Equal(fr)
+}
+
+func (f *UDPForwarder) AttachClientLog(w io.Writer) {
+	f.clientLog = w
+}
+
+func (f *UDPForwarder) ListenerAddress() string {
+	if f.listener == nil {
+		return ""
+	}
+
+	return "udp://" + net.JoinHostPort(f.Hostname, strconv.Itoa(int(f.ListenerPort())))
+}
+
+func (f *UDPForwarder) ListenerPort() uint32 {
+	addr, ok := f.listener.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		panic("Internal error: cannot convert to UDPAddr")
+	}
+
+	return uint32(addr.Port)
+}
+
+func (flow *udpFlow) touch() {
+	flow.lock.Lock()
+	flow.lastActive = time.Now()
+	flow.lock.Unlock()
+}
+
+func (flow *udpFlow) idle() time.Duration {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	return time.Since(flow.lastActive)
+}
+
+func (flow *udpFlow) close() {
+	flow.closeOnce.Do(func() {
+		close(flow.queue)
+
+		flow.lock.Lock()
+		flow.closed = true
+		if flow.channel != nil {
+			flow.channel.Close()
+		}
+		flow.lock.Unlock()
+	})
+}
@@ -0,0 +1,227 @@
+package forward
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jedevc/apparea/server/helpers"
+	"golang.org/x/crypto/ssh"
+)
+
+// newUDPTestConn establishes a real SSH connection, returning both of its
+// ends.
+func newUDPTestConn(t *testing.T) (*ssh.ServerConn, *ssh.Client) {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	serverConns := make(chan *ssh.ServerConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(serverConns)
+			return
+		}
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+		if err != nil {
+			close(serverConns)
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+		serverConns <- serverConn
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	serverConn, ok := <-serverConns
+	if !ok {
+		t.Fatal("could not establish ssh connection")
+	}
+	return serverConn, client
+}
+
+// newTestUDPTunnel publishes a UDP forward over a real SSH connection, with
+// the client echoing back every datagram. It returns the forwarder, and a
+// channel that receives a value whenever a flow is opened or closed.
+func newTestUDPTunnel(t *testing.T, setup func(*UDPForwarder)) (*UDPForwarder, chan string) {
+	t.Helper()
+
+	serverConn, client := newUDPTestConn(t)
+	events := make(chan string, 16)
+	flows := client.HandleChannelOpen(UDPChannelType)
+	go func() {
+		for newChannel := range flows {
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for req := range reqs {
+					req.Reply(false, nil)
+				}
+			}()
+			events <- "open"
+			go func() {
+				for {
+					datagram, err := helpers.ReadFrame(ch, MaxDatagramSize)
+					if err != nil {
+						break
+					}
+					helpers.WriteFrame(ch, datagram)
+				}
+				ch.Close()
+				events <- "close"
+			}()
+		}
+	}()
+
+	forwarder := NewUDPForwarder(testHostname, serverConn, ForwardRequest{Host: "127.0.0.1", Port: 0})
+	if setup != nil {
+		setup(forwarder)
+	}
+	if err := forwarder.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(forwarder.Close)
+
+	return forwarder, events
+}
+
+// newVisitor returns a UDP socket connected to the forwarder.
+func newVisitor(t *testing.T, forwarder *UDPForwarder) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(forwarder.ListenerPort())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echo sends a datagram, returning whether it came back.
+func echo(conn *net.UDPConn, data string) bool {
+	conn.Write([]byte(data))
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, MaxDatagramSize)
+	n, err := conn.Read(buf)
+	return err == nil && string(buf[:n]) == data
+}
+
+func expectEvent(t *testing.T, events chan string, event string) {
+	t.Helper()
+
+	select {
+	case got := <-events:
+		if got != event {
+			t.Fatalf("expected flow to %s, got %s", event, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected flow to %s", event)
+	}
+}
+
+func TestUDPFlowLimit(t *testing.T) {
+	forwarder, events := newTestUDPTunnel(t, func(f *UDPForwarder) {
+		f.maxFlows = 2
+	})
+
+	visitors := []struct {
+		conn    *net.UDPConn
+		allowed bool
+	}{
+		{newVisitor(t, forwarder), true},
+		{newVisitor(t, forwarder), true},
+		{newVisitor(t, forwarder), false},
+	}
+	for i, visitor := range visitors {
+		if got := echo(visitor.conn, "ping"); got != visitor.allowed {
+			t.Errorf("visitor %d: expected echo %v, got %v", i, visitor.allowed, got)
+		}
+	}
+
+	// flows that are already open carry on
+	if !echo(visitors[0].conn, "again") {
+		t.Error("expected an open flow to still be forwarded")
+	}
+
+	// and closing one makes room for another
+	expectEvent(t, events, "open")
+	expectEvent(t, events, "open")
+	forwarder.lock.Lock()
+	flow := forwarder.flows[visitors[0].conn.LocalAddr().String()]
+	forwarder.lock.Unlock()
+	forwarder.removeFlow(flow)
+	expectEvent(t, events, "close")
+	if !echo(visitors[2].conn, "ping") {
+		t.Error("expected a new flow once another was closed")
+	}
+}
+
+func TestUDPFlowExpiry(t *testing.T) {
+	forwarder, events := newTestUDPTunnel(t, func(f *UDPForwarder) {
+		f.idleTimeout = 200 * time.Millisecond
+	})
+	visitor := newVisitor(t, forwarder)
+
+	if !echo(visitor, "ping") {
+		t.Fatal("expected echo")
+	}
+	expectEvent(t, events, "open")
+
+	// replies from the client keep the flow active as well
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if !echo(visitor, "ping") {
+			t.Fatal("expected echo")
+		}
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("expected an active flow to be kept, got %s", event)
+	default:
+	}
+
+	expectEvent(t, events, "close")
+	forwarder.lock.Lock()
+	remaining := len(forwarder.flows)
+	forwarder.lock.Unlock()
+	if remaining != 0 {
+		t.Errorf("expected the idle flow to be removed, %d remaining", remaining)
+	}
+
+	// the next datagram opens a new flow
+	if !echo(visitor, "ping") {
+		t.Error("expected echo after the flow expired")
+	}
+	expectEvent(t, events, "open")
+}
@@ -0,0 +1,23 @@
+package forward
+
+import (
+	"context"
+	"sync"
+)
+
+// waitGroupContext waits for the wait group to complete, giving up early if
+// the context expires first.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
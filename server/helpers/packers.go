@@ -3,6 +3,7 @@ package helpers
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 func PackInt(payload *[]byte, i uint32) {
@@ -53,3 +54,35 @@ func UnpackString(payload *[]byte) (string, error) {
 
 	return s, nil
 }
+
+// WriteFrame writes a single length-prefixed frame to the writer.
+func WriteFrame(w io.Writer, frame []byte) error {
+	bs := make([]byte, 0, 4+len(frame))
+	PackInt(&bs, uint32(len(frame)))
+	bs = append(bs, frame...)
+
+	_, err := w.Write(bs)
+	return err
+}
+
+// ReadFrame reads a single length-prefixed frame from the reader, refusing
+// frames longer than max.
+func ReadFrame(r io.Reader, max uint32) ([]byte, error) {
+	bs := make([]byte, 4)
+	_, err := io.ReadFull(r, bs)
+	if err != nil {
+		return nil, err
+	}
+
+	length, _ := UnpackInt(&bs)
+	if length > max {
+		return nil, fmt.Errorf("unpack error: frame too large")
+	}
+
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
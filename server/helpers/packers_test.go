@@ -0,0 +1,107 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", []byte{}},
+		{"small", []byte("ping")},
+		{"binary", []byte{0x00, 0xFF, 0x00, 0x00, 0x00, 0x04}},
+		{"largest", bytes.Repeat([]byte("x"), 65535)},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, test.frame); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if buf.Len() != 4+len(test.frame) {
+			t.Errorf("%s: expected %d bytes written, got %d", test.name, 4+len(test.frame), buf.Len())
+		}
+
+		got, err := ReadFrame(&buf, 65535)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !bytes.Equal(got, test.frame) {
+			t.Errorf("%s: frame changed in transit", test.name)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left unread", test.name, buf.Len())
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		max   uint32
+		ok    bool
+		frame string
+		err   error
+	}{
+		{"frame", "\x00\x00\x00\x04pingpong", 4, true, "ping", nil},
+		{"empty", "\x00\x00\x00\x00", 4, true, "", nil},
+		{"too large", "\x00\x00\x00\x05hello", 4, false, "", nil},
+		{"huge length", "\xFF\xFF\xFF\xFF", 65535, false, "", nil},
+		{"end of stream", "", 4, false, "", io.EOF},
+		{"truncated length", "\x00\x00", 4, false, "", io.ErrUnexpectedEOF},
+		{"truncated frame", "\x00\x00\x00\x04pi", 4, false, "", io.ErrUnexpectedEOF},
+		{"missing frame", "\x00\x00\x00\x04", 4, false, "", io.EOF},
+	}
+	for _, test := range tests {
+		frame, err := ReadFrame(strings.NewReader(test.data), test.max)
+		if test.ok {
+			if err != nil || string(frame) != test.frame {
+				t.Errorf("%s: expected %q, got %q (%v)", test.name, test.frame, frame, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error, got %q", test.name, frame)
+		} else if test.err != nil && err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	var payload []byte
+	PackString(&payload, "apparea.dev")
+	PackInt(&payload, 80)
+
+	s, err := UnpackString(&payload)
+	if err != nil || s != "apparea.dev" {
+		t.Fatalf("expected %q, got %q (%v)", "apparea.dev", s, err)
+	}
+	i, err := UnpackInt(&payload)
+	if err != nil || i != 80 {
+		t.Fatalf("expected 80, got %d (%v)", i, err)
+	}
+	if len(payload) != 0 {
+		t.Errorf("expected the payload to be consumed, %d bytes left", len(payload))
+	}
+
+	truncated := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"short length", []byte{0x00, 0x00}},
+		{"short string", []byte{0x00, 0x00, 0x00, 0x05, 'a'}},
+	}
+	for _, test := range truncated {
+		payload := test.payload
+		if _, err := UnpackString(&payload); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
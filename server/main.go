@@ -1,23 +1,53 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/jedevc/apparea/server/audit"
 	"github.com/jedevc/apparea/server/config"
 	"github.com/jedevc/apparea/server/forward"
+	"github.com/jedevc/apparea/server/sites"
+	"github.com/jedevc/apparea/server/store"
+	"github.com/jedevc/apparea/server/throttle"
 	"github.com/jedevc/apparea/server/tunnel"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-const defaultHostname = "apparea.dev"
-const defaultSSHAddress = ":2200"
-const defaultHTTPAddress = ":8000"
+const defaultTokenTTL = 4 * time.Hour
 
 func main() {
 	app := &cli.App{
 		Name:  "apparea",
 		Usage: "reverse proxying server over ssh!",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "server settings file (toml)",
+				EnvVars: []string{"APPAREA_CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:        "config-dir",
+				Usage:       "directory containing the server config",
+				EnvVars:     []string{"APPAREA_CONFIG_DIR"},
+				DefaultText: "~/.apparea",
+			},
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "setup",
@@ -25,80 +55,631 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.BoolFlag{
 						Name:  "force",
-						Usage: "force overwrite of existing config",
+						Usage: "replace existing host keys and authorized_keys",
 					},
 				},
 				Action: func(c *cli.Context) error {
+					configDir, err := configDirectory(c)
+					if err != nil {
+						return err
+					}
+
 					force := c.Bool("force")
-					err := config.InitializeConfigs(force)
+					err = config.InitializeConfigs(configDir, force)
 					if err != nil {
 						return err
 					}
+					auditAdmin(c, "setup", configDir)
 
 					return nil
 				},
 			},
 			{
-				Name:  "serve",
-				Usage: "run the server",
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:        "bind-ssh",
-						Usage:       "address to bind to",
-						DefaultText: defaultSSHAddress,
+				Name:  "hostkey",
+				Usage: "manage the server's host keys",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "print host key fingerprints and known_hosts lines",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:        "hostname",
+								Usage:       "hostname that users connect to",
+								DefaultText: "from settings",
+							},
+							&cli.IntFlag{
+								Name:  "port",
+								Usage: "port that users connect to",
+								Value: 21,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+							active, next, err := config.HostKeys(configDir)
+							if err != nil {
+								return err
+							}
+
+							hostname := c.String("hostname")
+							if len(hostname) == 0 {
+								settings, err := loadSettings(c)
+								if err != nil {
+									return err
+								}
+								hostname = settings.Hostname
+							}
+
+							address := knownhosts.Normalize(net.JoinHostPort(hostname, strconv.Itoa(c.Int("port"))))
+							for _, key := range active {
+								fmt.Printf("# active %s\n", ssh.FingerprintSHA256(key))
+								fmt.Println(knownhosts.Line([]string{address}, key))
+							}
+							for _, key := range next {
+								fmt.Printf("# next %s\n", ssh.FingerprintSHA256(key))
+								fmt.Println(knownhosts.Line([]string{address}, key))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "rotate",
+						Usage: "generate new host keys, advertised to clients until promoted",
+						Action: func(c *cli.Context) error {
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+							err = config.RotateHostKeys(configDir)
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "hostkey.rotate", "")
+							return nil
+						},
 					},
-					&cli.StringFlag{
-						Name:        "bind-http",
-						Usage:       "address to bind to",
-						DefaultText: defaultHTTPAddress,
+					{
+						Name:  "promote",
+						Usage: "replace the active host keys with the rotated host keys",
+						Action: func(c *cli.Context) error {
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+							err = config.PromoteHostKeys(configDir)
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "hostkey.promote", "")
+							return nil
+						},
 					},
-					&cli.StringFlag{
-						Name:        "hostname",
-						Usage:       "hostname of the server",
-						DefaultText: defaultHostname,
+				},
+			},
+			{
+				Name:  "token",
+				Usage: "manage single-use guest access tokens",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "create",
+						Usage:     "mint a new guest access token",
+						ArgsUsage: "<username>",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "subdomain",
+								Usage: "subdomain the guest may use (may be repeated)",
+							},
+							&cli.DurationFlag{
+								Name:  "ttl",
+								Usage: "time until the token expires",
+								Value: defaultTokenTTL,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a username")
+							}
+
+							store, err := tokenStore(c)
+							if err != nil {
+								return err
+							}
+							secret, token, err := store.Create(c.Args().First(), c.StringSlice("subdomain"), c.Duration("ttl"))
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "token.create", token.ID+" ("+token.Username+")")
+
+							fmt.Printf("Token %s for %s (expires %s):\n", token.ID, token.Username, token.Expires.Format(time.RFC3339))
+							fmt.Println(secret)
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "list unused guest access tokens",
+						Action: func(c *cli.Context) error {
+							store, err := tokenStore(c)
+							if err != nil {
+								return err
+							}
+							tokens, err := store.List()
+							if err != nil {
+								return err
+							}
+
+							for _, token := range tokens {
+								fmt.Printf("%s\t%s\t%s\t%s\n", token.ID, token.Username, token.Expires.Format(time.RFC3339), strings.Join(token.Subdomains, ","))
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "revoke",
+						Usage:     "revoke a guest access token",
+						ArgsUsage: "<id>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a token id")
+							}
+
+							store, err := tokenStore(c)
+							if err != nil {
+								return err
+							}
+							err = store.Revoke(c.Args().First())
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "token.revoke", c.Args().First())
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "user",
+				Usage: "manage the users in authorized_keys",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "add",
+						Usage:     "add a user, or more keys to an existing user",
+						ArgsUsage: "<username> <keyfile>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 2 {
+								return fmt.Errorf("expected a username and a key file")
+							}
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+
+							keyBytes, err := ioutil.ReadFile(c.Args().Get(1))
+							if err != nil {
+								return err
+							}
+							count, err := config.AddUserKeys(configDir, c.Args().Get(0), keyBytes)
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "user.add", c.Args().Get(0))
+
+							fmt.Printf("Added %d key(s) for %s\n", count, c.Args().Get(0))
+							return nil
+						},
+					},
+					{
+						Name:      "remove",
+						Usage:     "remove a user and all of their keys (applied when the server restarts)",
+						ArgsUsage: "<username>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a username")
+							}
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+
+							count, err := config.RemoveUser(configDir, c.Args().First())
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "user.remove", c.Args().First())
+
+							fmt.Printf("Removed %d key(s) for %s\n", count, c.Args().First())
+							fmt.Println("Restart the server to stop the user from logging in")
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "list users",
+						Action: func(c *cli.Context) error {
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+							users, err := config.LoadUsers(configDir)
+							if err != nil {
+								return err
+							}
+
+							usernames := make([]string, 0, len(users))
+							for username := range users {
+								usernames = append(usernames, username)
+							}
+							sort.Strings(usernames)
+							for _, username := range usernames {
+								fmt.Printf("%s\t%d key(s)\n", username, len(users[username].Keys))
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "keys",
+						Usage:     "list a user's keys",
+						ArgsUsage: "<username>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a username")
+							}
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+							username := c.Args().First()
+							if !config.IsValidUsername(username) || strings.Contains(username, ".") {
+								return fmt.Errorf("invalid username %q", username)
+							}
+							users, err := config.LoadUsers(configDir)
+							if err != nil {
+								return err
+							}
+
+							user, ok := users[username]
+							if !ok {
+								return fmt.Errorf("no such user %q", username)
+							}
+							for _, key := range user.Keys {
+								fmt.Printf("%s\t%s\n", ssh.FingerprintSHA256(key), key.Type())
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "revoke-key",
+						Usage:     "remove a single key, by its SHA256 fingerprint (applied when the server restarts)",
+						ArgsUsage: "<fingerprint>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a key fingerprint")
+							}
+							configDir, err := configDirectory(c)
+							if err != nil {
+								return err
+							}
+
+							username, err := config.RevokeKey(configDir, c.Args().First())
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "user.revoke-key", c.Args().First()+" ("+username+")")
+
+							fmt.Printf("Revoked key %s of %s\n", c.Args().First(), username)
+							fmt.Println("Restart the server to stop the key from being accepted")
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "state",
+				Usage: "inspect the persistent server state (while the server is stopped)",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "reservations",
+						Usage: "list hostname reservations",
+						Action: func(c *cli.Context) error {
+							state, err := openState(c)
+							if err != nil {
+								return err
+							}
+							defer state.Close()
+
+							reservations, err := state.Reservations()
+							if err != nil {
+								return err
+							}
+							for _, r := range reservations {
+								port := "-"
+								if r.Port != 0 {
+									port = strconv.Itoa(int(r.Port))
+								}
+								fmt.Printf("%s\t%s\t%s\t%s\n", r.Hostname, r.Username, port, r.LastUsed.Format(time.RFC3339))
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "release",
+						Usage:     "release a hostname reservation",
+						ArgsUsage: "<hostname>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a hostname")
+							}
+							state, err := openState(c)
+							if err != nil {
+								return err
+							}
+							defer state.Close()
+
+							reservation, ok, err := state.Reservation(c.Args().First())
+							if err != nil {
+								return err
+							}
+							if !ok {
+								return fmt.Errorf("no reservation for %s", c.Args().First())
+							}
+							err = state.Release(reservation.Hostname, reservation.Username)
+							if err != nil {
+								return err
+							}
+							auditAdmin(c, "state.release", reservation.Hostname)
+							return nil
+						},
+					},
+					{
+						Name:  "usage",
+						Usage: "show usage totals for each user",
+						Action: func(c *cli.Context) error {
+							state, err := openState(c)
+							if err != nil {
+								return err
+							}
+							defer state.Close()
+
+							usages, err := state.AllUsage()
+							if err != nil {
+								return err
+							}
+							usernames := make([]string, 0, len(usages))
+							for username := range usages {
+								usernames = append(usernames, username)
+							}
+							sort.Strings(usernames)
+							for _, username := range usernames {
+								u := usages[username]
+								fmt.Printf("%s\t%d session(s)\t%d forward(s)\t%s\t%s\n", username, u.Sessions, u.Forwards, u.Connected.Round(time.Second), u.LastSeen.Format(time.RFC3339))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "history",
+						Usage: "show recent sessions",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "user",
+								Usage: "only show sessions of this user",
+							},
+							&cli.IntFlag{
+								Name:  "limit",
+								Usage: "number of sessions to show",
+								Value: 20,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							state, err := openState(c)
+							if err != nil {
+								return err
+							}
+							defer state.Close()
+
+							records, err := state.SessionHistory(c.String("user"), c.Int("limit"))
+							if err != nil {
+								return err
+							}
+							for _, r := range records {
+								fmt.Printf("%s\t%s\t%s\t%s\t%s\n", r.Started.Format(time.RFC3339), r.Ended.Sub(r.Started).Round(time.Second), r.Username, r.RemoteAddr, strings.Join(r.Forwards, " "))
+							}
+							return nil
+						},
 					},
 				},
+			},
+			{
+				Name:  "check-config",
+				Usage: "validate the server settings and config directory",
 				Action: func(c *cli.Context) error {
-					if len(c.String("bind-ssh")) == 0 {
-						err := c.Set("bind-ssh", defaultSSHAddress)
+					settings, err := loadSettings(c)
+					if err != nil {
+						return err
+					}
+					err = settings.Validate()
+					if err != nil {
+						return err
+					}
+					configDir, err := configDirectory(c)
+					if err != nil {
+						return err
+					}
+
+					var problems []string
+					if settings.Auth.Backend == "file" {
+						authKeyBytes, err := ioutil.ReadFile(filepath.Join(configDir, "authorized_keys"))
 						if err != nil {
-							panic(err)
+							problems = append(problems, err.Error())
+						} else {
+							for _, problem := range config.LintAuthorizedKeys(authKeyBytes) {
+								problems = append(problems, "authorized_keys: "+problem)
+							}
 						}
 					}
-					if len(c.String("bind-http")) == 0 {
-						err := c.Set("bind-http", defaultHTTPAddress)
-						if err != nil {
-							panic(err)
+					if _, err := config.LoadConfig(configDir, settings.Auth); err != nil {
+						problems = append(problems, err.Error())
+					}
+					if settings.Auth.Backend == "directory" {
+						if _, err := os.Stat(settings.Auth.Directory); err != nil {
+							problems = append(problems, err.Error())
+						}
+					}
+					if len(settings.TLS.Bind) > 0 {
+						if _, err := tls.LoadX509KeyPair(settings.TLS.Cert, settings.TLS.Key); err != nil {
+							problems = append(problems, fmt.Sprintf("could not load tls certificate: %s", err))
 						}
 					}
-					if len(c.String("hostname")) == 0 {
-						err := c.Set("hostname", defaultHostname)
+
+					for _, problem := range problems {
+						fmt.Println(problem)
+					}
+					if len(problems) > 0 {
+						return fmt.Errorf("found %d problem(s) in config", len(problems))
+					}
+					fmt.Println("Config OK")
+					return nil
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "run the server",
+				Flags: serveFlags(),
+				Action: func(c *cli.Context) error {
+					settings, err := loadSettings(c)
+					if err != nil {
+						return err
+					}
+					overrideSettings(c, &settings)
+					err = settings.Validate()
+					if err != nil {
+						return err
+					}
+
+					if len(settings.Log.File) > 0 {
+						logFile, err := os.OpenFile(settings.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
 						if err != nil {
-							panic(err)
+							return err
 						}
+						defer logFile.Close()
+						log.SetOutput(logFile)
 					}
 
-					config, err := config.LoadConfig()
+					configDir, err := configDirectory(c)
+					if err != nil {
+						return err
+					}
+					cfg, err := config.LoadConfig(configDir, settings.Auth)
 					if err != nil {
 						return err
 					}
+					cfg.Authenticator, err = makeAuthenticator(settings.Auth, cfg)
+					if err != nil {
+						return err
+					}
+					cfg.Audit, err = audit.Open(auditPath(settings, configDir))
+					if err != nil {
+						return err
+					}
+					defer cfg.Audit.Close()
+					cfg.Admins = settings.Auth.Admins
+					cfg.Throttle = throttle.NewTracker()
+					cfg.Throttle.BanAfter = settings.Limits.BanAfter
+					cfg.Throttle.BanDuration = settings.Limits.BanDuration.Duration
 
-					go func() {
-						err := forward.ServeHTTP(c.String("bind-http"))
+					var tlsConfig *tls.Config
+					if len(settings.TLS.Bind) > 0 {
+						cert, err := tls.LoadX509KeyPair(settings.TLS.Cert, settings.TLS.Key)
+						if err != nil {
+							return err
+						}
+						tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+					}
+
+					sshListener, err := net.Listen("tcp", settings.SSH.Bind)
+					if err != nil {
+						return err
+					}
+					httpListener, err := net.Listen("tcp", settings.HTTP.Bind)
+					if err != nil {
+						sshListener.Close()
+						return err
+					}
+					var httpsListener net.Listener
+					if tlsConfig != nil {
+						httpsListener, err = net.Listen("tcp", settings.TLS.Bind)
 						if err != nil {
-							log.Printf("http server error: %s", err)
+							sshListener.Close()
+							httpListener.Close()
+							return err
 						}
+					}
+
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					go func() {
+						signals := make(chan os.Signal, 1)
+						signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+						sig := <-signals
+						signal.Stop(signals)
+
+						log.Printf("Received %s, shutting down...", sig)
+						cancel()
 					}()
 
-					server := &tunnel.Server{
-						Config:   &config,
-						Hostname: c.String("hostname"),
+					state, err := store.Open(statePath(settings, configDir))
+					if err != nil {
+						sshListener.Close()
+						httpListener.Close()
+						if httpsListener != nil {
+							httpsListener.Close()
+						}
+						return err
 					}
-					sessions := server.Run(c.String("bind-ssh"))
-					for range sessions {
+					defer state.Close()
+
+					server := tunnel.NewServer(cfg, settings.Hostname)
+					server.Store = state
+					server.ShutdownTimeout = settings.ShutdownTimeout.Duration
+					server.HandshakeTimeout = settings.SSH.HandshakeTimeout.Duration
+					server.MaxSessions = settings.Limits.MaxSessions
+					server.MaxForwardsPerSession = settings.Limits.MaxForwardsPerSession
+					server.MaxUnauthenticated = settings.Limits.MaxUnauthenticated
+					server.VisitorFilters, err = visitorFilters(settings)
+					if err != nil {
+						return err
+					}
+					server.ProxyProtocol, err = proxyProtocol(settings)
+					if err != nil {
+						return err
+					}
+					server.HTTP.ReadTimeout = settings.HTTP.ReadTimeout.Duration
+					server.HTTP.WriteTimeout = settings.HTTP.WriteTimeout.Duration
+					server.HTTP.MaxHeaderBytes = settings.HTTP.MaxHeaderBytes
+					server.HTTP.MaxCacheSize = settings.HTTP.MaxCacheBytes
+					if settings.Sites.Enabled {
+						server.EnableSites(sites.New(sitesPath(settings, configDir), settings.Hostname, settings.Sites.Quota))
+					}
+
+					if httpsListener != nil {
+						go func() {
+							err := server.ServeHTTPS(httpsListener, tlsConfig)
+							if err != nil {
+								log.Printf("HTTPS server failed: %s", err)
+								cancel()
+							}
+						}()
+					}
+
+					err = server.Run(ctx, sshListener, httpListener)
+					if err != nil {
+						return err
 					}
 
-					select {}
+					log.Printf("Shutdown complete")
+					return nil
 				},
 			},
 		},
@@ -109,3 +690,244 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// loadSettings loads the settings file given by --config, or the default
+// settings if there isn't one.
+// serveFlags returns the flags of the serve command, which override the
+// settings file (see overrideSettings).
+func serveFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "bind-ssh",
+			Usage:   "address to bind to",
+			EnvVars: []string{"APPAREA_BIND_SSH"},
+		},
+		&cli.StringFlag{
+			Name:    "bind-http",
+			Usage:   "address to bind to",
+			EnvVars: []string{"APPAREA_BIND_HTTP"},
+		},
+		&cli.StringFlag{
+			Name:    "bind-https",
+			Usage:   "address to serve https on, using --tls-cert and --tls-key",
+			EnvVars: []string{"APPAREA_BIND_HTTPS"},
+		},
+		&cli.StringFlag{
+			Name:    "tls-cert",
+			Usage:   "certificate file for https",
+			EnvVars: []string{"APPAREA_TLS_CERT"},
+		},
+		&cli.StringFlag{
+			Name:    "tls-key",
+			Usage:   "private key file for https",
+			EnvVars: []string{"APPAREA_TLS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "hostname",
+			Usage:   "hostname of the server",
+			EnvVars: []string{"APPAREA_HOSTNAME"},
+		},
+		&cli.DurationFlag{
+			Name:    "shutdown-timeout",
+			Usage:   "time to wait for connections to finish on shutdown",
+			EnvVars: []string{"APPAREA_SHUTDOWN_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "auth",
+			Usage:   "authentication backend (file, directory or webhook)",
+			EnvVars: []string{"APPAREA_AUTH"},
+		},
+		&cli.StringFlag{
+			Name:    "auth-directory",
+			Usage:   "directory of per-user key files for directory authentication",
+			EnvVars: []string{"APPAREA_AUTH_DIRECTORY"},
+		},
+		&cli.StringFlag{
+			Name:    "auth-webhook",
+			Usage:   "url to query for webhook authentication",
+			EnvVars: []string{"APPAREA_AUTH_WEBHOOK"},
+		},
+		&cli.StringFlag{
+			Name:    "log-file",
+			Usage:   "file to append logs to, instead of stderr",
+			EnvVars: []string{"APPAREA_LOG_FILE"},
+		},
+	}
+}
+
+func loadSettings(c *cli.Context) (config.Settings, error) {
+	path := c.String("config")
+	if len(path) == 0 {
+		return config.DefaultSettings(), nil
+	}
+	return config.LoadSettings(path)
+}
+
+// overrideSettings applies the flags (and their environment variables) that
+// were explicitly set on top of the settings file.
+func overrideSettings(c *cli.Context, settings *config.Settings) {
+	values := map[string]*string{
+		"hostname":       &settings.Hostname,
+		"bind-ssh":       &settings.SSH.Bind,
+		"bind-http":      &settings.HTTP.Bind,
+		"bind-https":     &settings.TLS.Bind,
+		"tls-cert":       &settings.TLS.Cert,
+		"tls-key":        &settings.TLS.Key,
+		"auth":           &settings.Auth.Backend,
+		"auth-directory": &settings.Auth.Directory,
+		"auth-webhook":   &settings.Auth.Webhook,
+		"log-file":       &settings.Log.File,
+	}
+	for name, value := range values {
+		if c.IsSet(name) {
+			*value = c.String(name)
+		}
+	}
+	if c.IsSet("shutdown-timeout") {
+		settings.ShutdownTimeout.Duration = c.Duration("shutdown-timeout")
+	}
+}
+
+func configDirectory(c *cli.Context) (string, error) {
+	if dir := c.String("config-dir"); len(dir) > 0 {
+		return dir, nil
+	}
+
+	settings, err := loadSettings(c)
+	if err != nil {
+		return "", err
+	}
+	if len(settings.ConfigDir) > 0 {
+		return settings.ConfigDir, nil
+	}
+
+	return config.DefaultDirectory()
+}
+
+func statePath(settings config.Settings, configDir string) string {
+	if len(settings.State.Path) > 0 {
+		return settings.State.Path
+	}
+	return filepath.Join(configDir, "state.db")
+}
+
+func sitesPath(settings config.Settings, configDir string) string {
+	if len(settings.Sites.Directory) > 0 {
+		return settings.Sites.Directory
+	}
+	return filepath.Join(configDir, "sites")
+}
+
+// openState opens the state database for the admin commands, which can't be
+// used while the server is running.
+func openState(c *cli.Context) (*store.Store, error) {
+	settings, err := loadSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	configDir, err := configDirectory(c)
+	if err != nil {
+		return nil, err
+	}
+	return store.Open(statePath(settings, configDir))
+}
+
+func auditPath(settings config.Settings, configDir string) string {
+	if len(settings.Audit.File) > 0 {
+		return settings.Audit.File
+	}
+	return filepath.Join(configDir, "audit.log")
+}
+
+// auditAdmin records an administrative action in the audit log, attributed
+// to the local user that ran it.
+func auditAdmin(c *cli.Context, action string, target string) {
+	settings, err := loadSettings(c)
+	if err != nil {
+		log.Printf("Could not audit %s: %s", action, err)
+		return
+	}
+	configDir, err := configDirectory(c)
+	if err != nil {
+		log.Printf("Could not audit %s: %s", action, err)
+		return
+	}
+	logger, err := audit.Open(auditPath(settings, configDir))
+	if err != nil {
+		log.Printf("Could not audit %s: %s", action, err)
+		return
+	}
+	defer logger.Close()
+
+	event := audit.Event{
+		Type:   audit.Admin,
+		Action: action,
+		Target: target,
+	}
+	if u, err := user.Current(); err == nil {
+		event.Username = u.Username
+	}
+	logger.Log(event)
+}
+
+func visitorFilters(settings config.Settings) (map[string]forward.IPFilter, error) {
+	filters := make(map[string]forward.IPFilter, len(settings.Visitors))
+	for username, visitors := range settings.Visitors {
+		allow, err := forward.ParseCIDRs(visitors.Allow)
+		if err != nil {
+			return nil, err
+		}
+		deny, err := forward.ParseCIDRs(visitors.Deny)
+		if err != nil {
+			return nil, err
+		}
+		filters[username] = forward.IPFilter{Allow: allow, Deny: deny}
+	}
+	return filters, nil
+}
+
+func proxyProtocol(settings config.Settings) (tunnel.ProxyProtocol, error) {
+	trusted, err := forward.ParseCIDRs(settings.ProxyProtocol.Trusted)
+	if err != nil {
+		return tunnel.ProxyProtocol{}, err
+	}
+	proxy := tunnel.ProxyProtocol{Trusted: trusted}
+	for _, listener := range settings.ProxyProtocol.Listeners {
+		switch listener {
+		case "ssh":
+			proxy.SSH = true
+		case "http":
+			proxy.HTTP = true
+		case "https":
+			proxy.HTTPS = true
+		case "tcp":
+			proxy.TCP = true
+		}
+	}
+	return proxy, nil
+}
+
+func tokenStore(c *cli.Context) (*config.TokenStore, error) {
+	configDir, err := configDirectory(c)
+	if err != nil {
+		return nil, err
+	}
+	return config.NewTokenStore(filepath.Join(configDir, "tokens.json")), nil
+}
+
+func makeAuthenticator(settings config.AuthSettings, cfg *config.Config) (config.Authenticator, error) {
+	switch settings.Backend {
+	case "file":
+		return cfg.Users, nil
+	case "directory":
+		return config.DirectoryAuthenticator{
+			Directory: settings.Directory,
+		}, nil
+	case "webhook":
+		return config.WebhookAuthenticator{
+			URL: settings.Webhook,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication backend %q", settings.Backend)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jedevc/apparea/server/config"
+	"github.com/urfave/cli/v2"
+)
+
+// serveSettings returns the settings that the serve command would run with,
+// given its arguments.
+func serveSettings(t *testing.T, args ...string) config.Settings {
+	t.Helper()
+
+	var settings config.Settings
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config"},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "serve",
+				Flags: serveFlags(),
+				Action: func(c *cli.Context) error {
+					var err error
+					settings, err = loadSettings(c)
+					if err != nil {
+						return err
+					}
+					overrideSettings(c, &settings)
+					return nil
+				},
+			},
+		},
+	}
+	if err := app.Run(append([]string{"apparea"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
+
+func TestOverrideSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apparea-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "apparea.toml")
+	err = ioutil.WriteFile(path, []byte(`
+hostname = "file.example"
+shutdown_timeout = "1m"
+
+[ssh]
+bind = ":22"
+
+[auth]
+backend = "directory"
+directory = "/etc/apparea/users"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected func(settings *config.Settings)
+	}{
+		{
+			name:     "defaults",
+			args:     []string{"serve"},
+			expected: func(settings *config.Settings) {},
+		},
+		{
+			name: "flags",
+			args: []string{"serve", "--hostname", "flag.example", "--bind-ssh", ":2222", "--shutdown-timeout", "5s", "--auth", "webhook", "--auth-webhook", "http://auth.example"},
+			expected: func(settings *config.Settings) {
+				settings.Hostname = "flag.example"
+				settings.SSH.Bind = ":2222"
+				settings.ShutdownTimeout.Duration = 5 * time.Second
+				settings.Auth.Backend = "webhook"
+				settings.Auth.Webhook = "http://auth.example"
+			},
+		},
+		{
+			name: "environment",
+			args: []string{"serve"},
+			env: map[string]string{
+				"APPAREA_HOSTNAME":  "env.example",
+				"APPAREA_BIND_HTTP": ":8080",
+				"APPAREA_LOG_FILE":  "/var/log/apparea.log",
+			},
+			expected: func(settings *config.Settings) {
+				settings.Hostname = "env.example"
+				settings.HTTP.Bind = ":8080"
+				settings.Log.File = "/var/log/apparea.log"
+			},
+		},
+		{
+			name: "flags override environment",
+			args: []string{"serve", "--hostname", "flag.example"},
+			env:  map[string]string{"APPAREA_HOSTNAME": "env.example"},
+			expected: func(settings *config.Settings) {
+				settings.Hostname = "flag.example"
+			},
+		},
+		{
+			name: "file",
+			args: []string{"--config", path, "serve"},
+			expected: func(settings *config.Settings) {
+				settings.Hostname = "file.example"
+				settings.ShutdownTimeout.Duration = time.Minute
+				settings.SSH.Bind = ":22"
+				settings.Auth.Backend = "directory"
+				settings.Auth.Directory = "/etc/apparea/users"
+			},
+		},
+		{
+			name: "flags override file",
+			args: []string{"--config", path, "serve", "--bind-ssh", ":2222", "--auth", "file"},
+			env:  map[string]string{"APPAREA_SHUTDOWN_TIMEOUT": "10s"},
+			expected: func(settings *config.Settings) {
+				settings.Hostname = "file.example"
+				settings.ShutdownTimeout.Duration = 10 * time.Second
+				settings.SSH.Bind = ":2222"
+				settings.Auth.Backend = "file"
+				settings.Auth.Directory = "/etc/apparea/users"
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				os.Setenv(key, value)
+				defer os.Unsetenv(key)
+			}
+
+			expected := config.DefaultSettings()
+			test.expected(&expected)
+
+			settings := serveSettings(t, test.args...)
+			if settings.Hostname != expected.Hostname ||
+				settings.ShutdownTimeout != expected.ShutdownTimeout ||
+				settings.SSH.Bind != expected.SSH.Bind ||
+				settings.HTTP.Bind != expected.HTTP.Bind ||
+				settings.Auth.Backend != expected.Auth.Backend ||
+				settings.Auth.Directory != expected.Auth.Directory ||
+				settings.Auth.Webhook != expected.Auth.Webhook ||
+				settings.Log.File != expected.Log.File {
+				t.Errorf("expected settings %+v, got %+v", expected, settings)
+			}
+		})
+	}
+}
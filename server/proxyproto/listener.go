@@ -0,0 +1,170 @@
+package proxyproto
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the time allowed for a trusted proxy to send its header.
+const DefaultTimeout = 10 * time.Second
+
+// Listener wraps a net.Listener, reading a PROXY protocol header from each
+// connection made by a trusted proxy, so that the connection reports the
+// addresses of the original client. Connections from other addresses are
+// passed through untouched, and can't spoof their address with a header.
+//
+// Headers are read in the background, so a slow proxy can't hold up Accept.
+type Listener struct {
+	net.Listener
+
+	// Trusted are the networks of the proxies that must send a header.
+	Trusted []*net.IPNet
+
+	// Timeout is the time allowed for a trusted proxy to send its header,
+	// and must be set before the first call to Accept.
+	Timeout time.Duration
+
+	start     sync.Once
+	closeOnce sync.Once
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+func NewListener(listener net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{
+		Listener: listener,
+		Trusted:  trusted,
+		Timeout:  DefaultTimeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.acceptLoop()
+	})
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// passed on, so that the caller can back off
+				select {
+				case l.errs <- err:
+					continue
+				case <-l.closed:
+				}
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+
+		if !l.trusts(conn.RemoteAddr()) {
+			l.deliver(conn)
+			continue
+		}
+		go l.readHeader(conn)
+	}
+}
+
+func (l *Listener) readHeader(conn net.Conn) {
+	if l.Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(l.Timeout))
+	}
+	reader := bufio.NewReader(conn)
+	header, err := Read(reader)
+	if err != nil {
+		log.Printf("Dropping connection from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	l.deliver(&Conn{
+		Conn:   conn,
+		reader: reader,
+		header: header,
+	})
+}
+
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *Listener) trusts(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.Trusted {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted proxy, which reports the addresses
+// from the proxy's header.
+type Conn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	header Header
+}
+
+// Read reads from the connection, starting with any data buffered while
+// reading the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the original client, or the proxy's
+// address if the header didn't give one.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the original client connected to, or the
+// local address if the header didn't give one.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,138 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestListenerTrusts(t *testing.T) {
+	l := &Listener{Trusted: []*net.IPNet{
+		mustParseCIDR(t, "10.0.0.0/8"),
+		mustParseCIDR(t, "2001:db8::/32"),
+	}}
+
+	tests := []struct {
+		addr    net.Addr
+		trusted bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("11.1.2.3"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db9::1"), Port: 1234}, false},
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, false},
+		{&net.UnixAddr{Name: "/run/apparea.sock", Net: "unix"}, false},
+	}
+	for _, test := range tests {
+		if got := l.trusts(test.addr); got != test.trusted {
+			t.Errorf("trusts(%s %s) = %v, expected %v", test.addr.Network(), test.addr, got, test.trusted)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 1234 80\r\n"
+
+	tests := []struct {
+		name    string
+		trusted string
+		send    string
+		remote  string
+		data    string
+	}{
+		{"trusted", "127.0.0.0/8", header + "data", "192.0.2.1:1234", "data"},
+		// an untrusted source can't spoof its address, and its header is
+		// passed on as data
+		{"untrusted", "192.0.2.0/24", header + "data", "", header + "data"},
+		{"untrusted without header", "192.0.2.0/24", "data", "", "data"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := NewListener(inner, []*net.IPNet{mustParseCIDR(t, test.trusted)})
+			defer l.Close()
+
+			client, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte(test.send))
+			client.(*net.TCPConn).CloseWrite()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			remote := test.remote
+			if len(remote) == 0 {
+				remote = client.LocalAddr().String()
+			}
+			if conn.RemoteAddr().String() != remote {
+				t.Errorf("expected remote address %s, got %s", remote, conn.RemoteAddr())
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			data := make([]byte, len(test.data))
+			if _, err := io.ReadFull(conn, data); err != nil || string(data) != test.data {
+				t.Errorf("expected data %q, got %q (%v)", test.data, data, err)
+			}
+		})
+	}
+}
+
+func TestListenerDropsMissingHeader(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")})
+	defer l.Close()
+
+	// a trusted proxy that doesn't send a header is dropped, without
+	// holding up the next connection
+	bad, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	good, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	good.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != good.LocalAddr().String() {
+		t.Errorf("expected the connection with a header, got one from %s", conn.RemoteAddr())
+	}
+
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection without a header to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Package proxyproto implements the PROXY protocol (versions 1 and 2), used
+// to pass the original addresses of a proxied TCP connection to the server
+// behind the proxy.
+//
+// See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// signature is the prefix of every version 2 header.
+var signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Header describes the original source and destination of a connection.
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// Format encodes the header in its version's wire format. If the addresses
+// aren't both IPv4 or both IPv6, the header describes an unknown connection,
+// which tells the receiver to use the real connection's addresses.
+func (h Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2(), nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", h.Version)
+	}
+}
+
+// WriteTo writes the header to w.
+func (h Header) WriteTo(w io.Writer) (int64, error) {
+	data, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// family returns the address family shared by the source and destination,
+// 4 or 6, or 0 if they don't share one.
+func (h Header) family() int {
+	if h.Source == nil || h.Destination == nil {
+		return 0
+	}
+	src4, dst4 := h.Source.IP.To4() != nil, h.Destination.IP.To4() != nil
+	switch {
+	case src4 && dst4:
+		return 4
+	case !src4 && !dst4 && h.Source.IP.To16() != nil && h.Destination.IP.To16() != nil:
+		return 6
+	default:
+		return 0
+	}
+}
+
+func (h Header) formatV1() []byte {
+	var proto string
+	switch h.family() {
+	case 4:
+		proto = "TCP4"
+	case 6:
+		proto = "TCP6"
+	default:
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, h.Source.IP, h.Destination.IP, h.Source.Port, h.Destination.Port))
+}
+
+func (h Header) formatV2() []byte {
+	var buf bytes.Buffer
+	buf.Write(signature)
+
+	var addrs []byte
+	switch h.family() {
+	case 4:
+		buf.WriteByte(0x21) // version 2, PROXY command
+		buf.WriteByte(0x11) // TCP over IPv4
+		addrs = append(addrs, h.Source.IP.To4()...)
+		addrs = append(addrs, h.Destination.IP.To4()...)
+	case 6:
+		buf.WriteByte(0x21) // version 2, PROXY command
+		buf.WriteByte(0x21) // TCP over IPv6
+		addrs = append(addrs, h.Source.IP.To16()...)
+		addrs = append(addrs, h.Destination.IP.To16()...)
+	default:
+		buf.WriteByte(0x20) // version 2, LOCAL command
+		buf.WriteByte(0x00) // unspecified
+		binary.Write(&buf, binary.BigEndian, uint16(0))
+		return buf.Bytes()
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:], uint16(h.Source.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(h.Destination.Port))
+	addrs = append(addrs, ports...)
+
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
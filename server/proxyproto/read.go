@@ -0,0 +1,141 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxV1Length is the longest a version 1 header can be, including the CRLF.
+const maxV1Length = 107
+
+// Read reads a version 1 or 2 header from the start of a connection. If the
+// header describes an unknown or local connection, its addresses are nil.
+func Read(r *bufio.Reader) (Header, error) {
+	prefix, err := r.Peek(len(signature))
+	if err != nil {
+		return Header{}, fmt.Errorf("could not read proxy protocol header: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(prefix, signature):
+		return readV2(r)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readV1(r)
+	default:
+		return Header{}, fmt.Errorf("missing proxy protocol header")
+	}
+}
+
+func readV1(r *bufio.Reader) (Header, error) {
+	header := Header{Version: 1}
+
+	var line []byte
+	for len(line) < maxV1Length {
+		c, err := r.ReadByte()
+		if err != nil {
+			return header, fmt.Errorf("could not read proxy protocol header: %w", err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return header, fmt.Errorf("invalid proxy protocol header: line too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return header, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+
+	var err error
+	header.Source, err = parseV1Address(fields[2], fields[4])
+	if err != nil {
+		return header, err
+	}
+	header.Destination, err = parseV1Address(fields[3], fields[5])
+	if err != nil {
+		return header, err
+	}
+	if (header.Source.IP.To4() != nil) != (fields[1] == "TCP4") || header.family() == 0 {
+		return header, fmt.Errorf("invalid proxy protocol header: addresses don't match %s", fields[1])
+	}
+
+	return header, nil
+}
+
+func parseV1Address(host string, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid proxy protocol address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (Header, error) {
+	header := Header{Version: 2}
+
+	fixed := make([]byte, len(signature)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return header, fmt.Errorf("could not read proxy protocol header: %w", err)
+	}
+	versionCommand, family := fixed[12], fixed[13]
+	length := binary.BigEndian.Uint16(fixed[14:])
+
+	if versionCommand>>4 != 2 {
+		return header, fmt.Errorf("invalid proxy protocol version %d", versionCommand>>4)
+	}
+	command := versionCommand & 0x0F
+	if command > 1 {
+		return header, fmt.Errorf("invalid proxy protocol command %d", command)
+	}
+
+	// the rest of the header is the addresses, followed by optional TLVs
+	// that we don't need
+	rest := make([]byte, length)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return header, fmt.Errorf("could not read proxy protocol header: %w", err)
+	}
+
+	// a local command is sent by the proxy itself, like for health checks
+	if command == 0 {
+		return header, nil
+	}
+
+	var size int
+	switch family >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return header, nil
+	}
+	if len(rest) < 2*size+4 {
+		return header, fmt.Errorf("invalid proxy protocol header: addresses truncated")
+	}
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), rest[:size]...)),
+		Port: int(binary.BigEndian.Uint16(rest[2*size:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), rest[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(rest[2*size+2:])),
+	}
+
+	return header, nil
+}
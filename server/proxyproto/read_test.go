@@ -0,0 +1,142 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2 builds a version 2 header with the given command, family and body.
+func v2(command byte, family byte, body []byte) string {
+	var buf bytes.Buffer
+	buf.Write(signature)
+	buf.WriteByte(0x20 | command)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(body)))
+	buf.Write(body)
+	return buf.String()
+}
+
+// v2Addrs is the body of a version 2 header for 192.0.2.1:1234 connecting to
+// 198.51.100.1:80.
+var v2Addrs = []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x04, 0xD2, 0x00, 0x50}
+
+func TestRead(t *testing.T) {
+	v1Max := "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"
+
+	tests := []struct {
+		name        string
+		data        string
+		ok          bool
+		source      string
+		destination string
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 1234 80\r\n", true, "192.0.2.1:1234", "198.51.100.1:80"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", true, "[2001:db8::1]:1234", "[2001:db8::2]:443"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", true, "", ""},
+		{"v1 unknown with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.1 1234 80\r\n", true, "", ""},
+		{"v1 longest", v1Max, true, "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"},
+		{"v1 unknown at limit", unknownV1(maxV1Length), true, "", ""},
+		{"v1 oversize", unknownV1(maxV1Length + 1), false, "", ""},
+		{"v1 no end of line", "PROXY TCP4 192.0.2.1 198.51.100.1 1234 80" + strings.Repeat(" ", 100), false, "", ""},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1", false, "", ""},
+		{"v1 missing CR", "PROXY TCP4 192.0.2.1 198.51.100.1 1234 80\n", false, "", ""},
+		{"v1 bad protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 1234 80\r\n", false, "", ""},
+		{"v1 bad address", "PROXY TCP4 192.0.2 198.51.100.1 1234 80\r\n", false, "", ""},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 1234 65536\r\n", false, "", ""},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 2001:db8::2 1234 80\r\n", false, "", ""},
+		{"v1 mixed family", "PROXY TCP6 2001:db8::1 198.51.100.1 1234 80\r\n", false, "", ""},
+		{"v2 tcp4", v2(1, 0x11, v2Addrs), true, "192.0.2.1:1234", "198.51.100.1:80"},
+		{"v2 tcp4 with tlvs", v2(1, 0x11, append(append([]byte(nil), v2Addrs...), 0x04, 0x00, 0x01, 0xFF)), true, "192.0.2.1:1234", "198.51.100.1:80"},
+		{"v2 local", v2(0, 0x00, nil), true, "", ""},
+		{"v2 local ignores addresses", v2(0, 0x11, v2Addrs), true, "", ""},
+		{"v2 unspecified family", v2(1, 0x00, nil), true, "", ""},
+		{"v2 unix family", v2(1, 0x31, make([]byte, 216)), true, "", ""},
+		{"v2 bad version", strings.Replace(v2(1, 0x11, v2Addrs), "\x21\x11", "\x11\x11", 1), false, "", ""},
+		{"v2 bad command", v2(2, 0x11, v2Addrs), false, "", ""},
+		{"v2 truncated header", v2(1, 0x11, v2Addrs)[:14], false, "", ""},
+		{"v2 truncated body", v2(1, 0x11, v2Addrs)[:20], false, "", ""},
+		{"v2 short addresses", v2(1, 0x21, v2Addrs), false, "", ""},
+		{"missing", "GET / HTTP/1.1\r\n\r\n", false, "", ""},
+		{"empty", "", false, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(test.data + "data"))
+			header, err := Read(r)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := addrString(header.Source); got != test.source {
+				t.Errorf("expected source %q, got %q", test.source, got)
+			}
+			if got := addrString(header.Destination); got != test.destination {
+				t.Errorf("expected destination %q, got %q", test.destination, got)
+			}
+			// the connection's data must be left behind the header
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+				t.Errorf("expected the data after the header, got %q", rest)
+			}
+		})
+	}
+}
+
+// unknownV1 returns an UNKNOWN version 1 header, padded to length bytes.
+func unknownV1(length int) string {
+	line := "PROXY UNKNOWN "
+	return line + strings.Repeat("x", length-len(line)-2) + "\r\n"
+}
+
+func addrString(addr *net.TCPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	addrs := []struct {
+		source      string
+		destination string
+	}{
+		{"192.0.2.1:1234", "198.51.100.1:80"},
+		{"[2001:db8::1]:1234", "[2001:db8::2]:443"},
+		{"192.0.2.1:1234", "[2001:db8::2]:443"},
+	}
+	for _, version := range []int{1, 2} {
+		for _, addr := range addrs {
+			source, _ := net.ResolveTCPAddr("tcp", addr.source)
+			destination, _ := net.ResolveTCPAddr("tcp", addr.destination)
+			header := Header{Version: version, Source: source, Destination: destination}
+
+			data, err := header.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Read(bufio.NewReader(bytes.NewReader(data)))
+			if err != nil {
+				t.Fatalf("v%d %s -> %s: %s", version, addr.source, addr.destination, err)
+			}
+
+			// mixed families can't be described, so are sent as unknown
+			want := header
+			if header.family() == 0 {
+				want.Source, want.Destination = nil, nil
+			}
+			if got.Version != version || addrString(got.Source) != addrString(want.Source) || addrString(got.Destination) != addrString(want.Destination) {
+				t.Errorf("v%d %s -> %s: got %+v", version, addr.source, addr.destination, got)
+			}
+		}
+	}
+}
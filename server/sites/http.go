@@ -0,0 +1,46 @@
+package sites
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+)
+
+// ServeHTTP serves the files of the site named by the request's Host.
+func (sites *Sites) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dir, _, ok := sites.Lookup(r.Host)
+	if !ok {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "site not found")
+		return
+	}
+	http.FileServer(siteFS{http.Dir(dir)}).ServeHTTP(w, r)
+}
+
+// siteFS hides directories without an index.html, so that the contents of a
+// site are never listed.
+type siteFS struct {
+	fs http.FileSystem
+}
+
+func (fs siteFS) Open(name string) (http.File, error) {
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := fs.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,321 @@
+package sites
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Serve runs an SFTP server on channel, giving the user access to their own
+// sites until the client disconnects.
+func (sites *Sites) Serve(username string, channel io.ReadWriteCloser) error {
+	root := sites.userDirectory(username)
+	err := os.MkdirAll(root, 0o755)
+	if err != nil {
+		return err
+	}
+
+	handler := &sftpHandler{
+		sites:    sites,
+		username: username,
+		root:     root,
+	}
+	server := sftp.NewRequestServer(channel, sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	})
+	defer server.Close()
+
+	err = server.Serve()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// sftpHandler confines a user's SFTP requests to their own directory, in
+// which the top-level entries are sites, and keeps track of the space that
+// they use.
+type sftpHandler struct {
+	sites    *Sites
+	username string
+	root     string
+}
+
+// resolve maps a path requested by the client to a path on disk, returning
+// the cleaned path components too.
+func (handler *sftpHandler) resolve(p string) (string, []string) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return handler.root, nil
+	}
+	parts := strings.Split(p[1:], "/")
+	return filepath.Join(handler.root, filepath.FromSlash(p)), parts
+}
+
+func (handler *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, _ := handler.resolve(r.Filepath)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("not a regular file")
+	}
+	return f, nil
+}
+
+func (handler *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	p, parts := handler.resolve(r.Filepath)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("files must be uploaded into a site directory")
+	}
+
+	var size int64
+	info, err := os.Lstat(p)
+	if err == nil {
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("not a regular file")
+		}
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// O_APPEND is left out, since every write is made at an explicit offset
+	flags := os.O_WRONLY
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(p, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if pflags.Trunc {
+		handler.sites.release(handler.username, size)
+		size = 0
+	}
+
+	return &quotaWriter{
+		sites:    handler.sites,
+		username: handler.username,
+		file:     f,
+		size:     size,
+	}, nil
+}
+
+func (handler *sftpHandler) Filecmd(r *sftp.Request) error {
+	p, parts := handler.resolve(r.Filepath)
+
+	switch r.Method {
+	case "Setstat":
+		if len(parts) == 0 {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		flags := r.AttrFlags()
+		attrs := r.Attributes()
+		if flags.Size {
+			err := handler.truncate(p, int64(attrs.Size))
+			if err != nil {
+				return err
+			}
+		}
+		if flags.Acmodtime {
+			atime := time.Unix(int64(attrs.Atime), 0)
+			mtime := time.Unix(int64(attrs.Mtime), 0)
+			return os.Chtimes(p, atime, mtime)
+		}
+		return nil
+	case "Rename":
+		target, targetParts := handler.resolve(r.Target)
+		if len(parts) == 0 || len(targetParts) == 0 {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if len(targetParts) == 1 && (!info.IsDir() || !isValidName(targetParts[0])) {
+			return fmt.Errorf("sites must be directories named with lowercase letters, digits and dashes")
+		}
+
+		var replaced int64
+		if existing, err := os.Lstat(target); err == nil && existing.Mode().IsRegular() {
+			replaced = existing.Size()
+		}
+		err = os.Rename(p, target)
+		if err != nil {
+			return err
+		}
+		handler.sites.release(handler.username, replaced)
+		return nil
+	case "Mkdir":
+		if len(parts) == 0 {
+			return os.ErrExist
+		}
+		if len(parts) == 1 && !isValidName(parts[0]) {
+			return fmt.Errorf("sites must be named with lowercase letters, digits and dashes")
+		}
+		return os.Mkdir(p, 0o755)
+	case "Rmdir":
+		if len(parts) == 0 {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("not a directory")
+		}
+		return os.Remove(p)
+	case "Remove":
+		if len(parts) == 0 {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("is a directory")
+		}
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			handler.sites.release(handler.username, info.Size())
+		}
+		return nil
+	case "Link", "Symlink":
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// truncate changes the size of a file, within the user's quota.
+func (handler *sftpHandler) truncate(p string, size int64) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+
+	if size > info.Size() {
+		err := handler.sites.reserve(handler.username, size-info.Size())
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Truncate(p, size)
+	if err != nil {
+		if size > info.Size() {
+			handler.sites.release(handler.username, size-info.Size())
+		}
+		return err
+	}
+	if size < info.Size() {
+		handler.sites.release(handler.username, info.Size()-size)
+	}
+	return nil
+}
+
+func (handler *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p, _ := handler.resolve(r.Filepath)
+
+	switch r.Method {
+	case "List":
+		infos, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// quotaWriter writes to an uploaded file, charging any growth in its size to
+// the user's quota.
+type quotaWriter struct {
+	sites    *Sites
+	username string
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (w *quotaWriter) WriteAt(p []byte, offset int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	size, end := w.size, offset+int64(len(p))
+	if end > size {
+		err := w.sites.reserve(w.username, end-size)
+		if err != nil {
+			return 0, err
+		}
+		w.size = end
+	}
+
+	n, err := w.file.WriteAt(p, offset)
+	if err != nil && end > size {
+		// only charge for as far as the file actually grew
+		written := offset + int64(n)
+		if written < size {
+			written = size
+		}
+		w.sites.release(w.username, end-written)
+		w.size = written
+	}
+	return n, err
+}
+
+func (w *quotaWriter) Close() error {
+	return w.file.Close()
+}
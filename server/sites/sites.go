@@ -0,0 +1,164 @@
+// Package sites hosts static websites that users upload over SFTP, served
+// over HTTP at name-user.hostname when no tunnel is using that hostname.
+package sites
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jedevc/apparea/server/config"
+)
+
+var isValidName = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`).MatchString
+
+// Sites stores each user's sites in a directory of their own under Root,
+// with one subdirectory per site.
+type Sites struct {
+	Root     string
+	Hostname string
+
+	// Quota limits the total size of the files stored by each user, or is
+	// zero for no limit.
+	Quota int64
+
+	lock  sync.Mutex
+	usage map[string]int64
+}
+
+func New(root string, hostname string, quota int64) *Sites {
+	return &Sites{
+		Root:     root,
+		Hostname: hostname,
+		Quota:    quota,
+		usage:    make(map[string]int64),
+	}
+}
+
+// userDirectory returns the directory that holds the user's sites.
+// Usernames are case-sensitive, so this is named by the exact username.
+func (sites *Sites) userDirectory(username string) string {
+	return filepath.Join(sites.Root, username)
+}
+
+// siteUsers returns the users whose usernames match, ignoring case, since
+// hostnames don't keep it. An exact match comes first.
+func (sites *Sites) siteUsers(username string) []string {
+	users := []string{username}
+	infos, err := ioutil.ReadDir(sites.Root)
+	if err != nil {
+		return users
+	}
+	for _, info := range infos {
+		if info.IsDir() && info.Name() != username && strings.EqualFold(info.Name(), username) {
+			users = append(users, info.Name())
+		}
+	}
+	return users
+}
+
+// Lookup returns the directory of the site served at host, and the user that
+// owns it.
+func (sites *Sites) Lookup(host string) (string, string, bool) {
+	host = strings.ToLower(stripPort(host))
+	suffix := "." + strings.ToLower(sites.Hostname)
+	if !strings.HasSuffix(host, suffix) {
+		return "", "", false
+	}
+	host = strings.TrimSuffix(host, suffix)
+
+	// usernames can't contain dashes, so the last dash ends the site name
+	idx := strings.LastIndex(host, "-")
+	if idx == -1 {
+		return "", "", false
+	}
+	name, username := host[:idx], host[idx+1:]
+	if !isValidName(name) || !config.IsValidUsername(username) {
+		return "", "", false
+	}
+
+	for _, user := range sites.siteUsers(username) {
+		dir := filepath.Join(sites.userDirectory(user), name)
+		info, err := os.Stat(dir)
+		if err == nil && info.IsDir() {
+			return dir, user, true
+		}
+	}
+	return "", "", false
+}
+
+// Usage returns the total size of the files stored by the user.
+func (sites *Sites) Usage(username string) (int64, error) {
+	sites.lock.Lock()
+	defer sites.lock.Unlock()
+
+	return sites.loadUsage(username)
+}
+
+func (sites *Sites) loadUsage(username string) (int64, error) {
+	if usage, ok := sites.usage[username]; ok {
+		return usage, nil
+	}
+
+	var usage int64
+	err := filepath.Walk(sites.userDirectory(username), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			usage += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sites.usage[username] = usage
+	return usage, nil
+}
+
+// reserve accounts for n more bytes stored by the user, failing if that
+// would exceed their quota.
+func (sites *Sites) reserve(username string, n int64) error {
+	sites.lock.Lock()
+	defer sites.lock.Unlock()
+
+	usage, err := sites.loadUsage(username)
+	if err != nil {
+		return err
+	}
+	if sites.Quota > 0 && usage+n > sites.Quota {
+		return fmt.Errorf("quota of %d bytes exceeded", sites.Quota)
+	}
+	sites.usage[username] = usage + n
+	return nil
+}
+
+// release accounts for n bytes removed by the user.
+func (sites *Sites) release(username string, n int64) {
+	sites.lock.Lock()
+	defer sites.lock.Unlock()
+
+	if usage, ok := sites.usage[username]; ok {
+		usage -= n
+		if usage < 0 {
+			usage = 0
+		}
+		sites.usage[username] = usage
+	}
+}
+
+func stripPort(host string) string {
+	if idx := strings.LastIndex(host, ":"); idx != -1 && !strings.HasSuffix(host, "]") {
+		return host[:idx]
+	}
+	return host
+}
@@ -0,0 +1,344 @@
+package sites
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// sftp open flags and attribute flags, from the protocol
+const (
+	openWrite  = 0x02
+	openCreate = 0x08
+	openTrunc  = 0x10
+
+	attrSize = 0x01
+)
+
+func newTestSites(t *testing.T, quota int64) *Sites {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "apparea-sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return New(dir, "apparea.test", quota)
+}
+
+func newTestHandler(t *testing.T, sites *Sites) *sftpHandler {
+	t.Helper()
+
+	root := sites.userDirectory("alice")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return &sftpHandler{sites: sites, username: "alice", root: root}
+}
+
+func command(method string, path string, target string) *sftp.Request {
+	r := sftp.NewRequest(method, path)
+	r.Target = target
+	return r
+}
+
+// upload writes a file of the given size, returning the error from opening
+// or writing it.
+func upload(handler *sftpHandler, path string, size int) error {
+	r := sftp.NewRequest("Put", path)
+	r.Flags = openWrite | openCreate | openTrunc
+	w, err := handler.Filewrite(r)
+	if err != nil {
+		return err
+	}
+	defer w.(*quotaWriter).Close()
+
+	_, err = w.WriteAt(make([]byte, size), 0)
+	return err
+}
+
+func usage(t *testing.T, sites *Sites) int64 {
+	t.Helper()
+
+	n, err := sites.Usage("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestResolve(t *testing.T) {
+	handler := &sftpHandler{root: filepath.FromSlash("/srv/sites/alice")}
+
+	tests := []struct {
+		path  string
+		want  string
+		parts int
+	}{
+		{"/", "/srv/sites/alice", 0},
+		{"", "/srv/sites/alice", 0},
+		{"..", "/srv/sites/alice", 0},
+		{"/../../etc/passwd", "/srv/sites/alice/etc/passwd", 2},
+		{"demo/../../bob/demo", "/srv/sites/alice/bob/demo", 2},
+		{"/demo/./css//a.css", "/srv/sites/alice/demo/css/a.css", 3},
+	}
+	for _, test := range tests {
+		got, parts := handler.resolve(test.path)
+		if got != filepath.FromSlash(test.want) || len(parts) != test.parts {
+			t.Errorf("resolve(%q) = %q, %v, expected %q with %d parts", test.path, got, parts, test.want, test.parts)
+		}
+	}
+}
+
+func TestSiteNames(t *testing.T) {
+	tests := []struct {
+		method  string
+		path    string
+		target  string
+		allowed bool
+	}{
+		{"Mkdir", "/docs", "", true},
+		{"Mkdir", "/my-site2", "", true},
+		{"Mkdir", "/Demo", "", false},
+		{"Mkdir", "/bad_name", "", false},
+		{"Mkdir", "/-demo", "", false},
+		{"Mkdir", "/", "", false},
+		{"Mkdir", "/demo/Any_Name", "", true},
+		{"Rename", "/demo", "/docs", true},
+		{"Rename", "/demo", "/Docs", false},
+		{"Rename", "/demo/index.html", "/index.html", false},
+		{"Rename", "/demo/index.html", "/demo/home.html", true},
+		{"Rmdir", "/", "", false},
+		{"Remove", "/", "", false},
+		{"Symlink", "/demo/index.html", "/demo/link", false},
+		{"Link", "/demo/index.html", "/demo/link", false},
+	}
+	for _, test := range tests {
+		sites := newTestSites(t, 0)
+		handler := newTestHandler(t, sites)
+		if err := os.MkdirAll(filepath.Join(handler.root, "demo"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := upload(handler, "/demo/index.html", 10); err != nil {
+			t.Fatal(err)
+		}
+
+		err := handler.Filecmd(command(test.method, test.path, test.target))
+		if test.allowed && err != nil {
+			t.Errorf("%s %s %s: expected success, got %s", test.method, test.path, test.target, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("%s %s %s: expected failure", test.method, test.path, test.target)
+		}
+	}
+}
+
+func TestUploadOutsideSite(t *testing.T) {
+	sites := newTestSites(t, 0)
+	handler := newTestHandler(t, sites)
+
+	if err := upload(handler, "/index.html", 10); err == nil {
+		t.Error("expected upload outside of a site to fail")
+	}
+	if err := upload(handler, "/../index.html", 10); err == nil {
+		t.Error("expected upload outside of the user's directory to fail")
+	}
+	if _, err := os.Stat(filepath.Join(sites.Root, "index.html")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written outside the user's directory, got %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	sites := newTestSites(t, 100)
+	handler := newTestHandler(t, sites)
+	if err := handler.Filecmd(command("Mkdir", "/demo", "")); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		run   func() error
+		ok    bool
+		usage int64
+	}{
+		{"upload", func() error { return upload(handler, "/demo/a", 60) }, true, 60},
+		{"exceed", func() error { return upload(handler, "/demo/b", 50) }, false, 60},
+		{"overwrite", func() error { return upload(handler, "/demo/a", 80) }, true, 80},
+		{"fill", func() error { return upload(handler, "/demo/b", 20) }, true, 100},
+		{"remove", func() error { return handler.Filecmd(command("Remove", "/demo/b", "")) }, true, 80},
+		{"replace by rename", func() error {
+			if err := upload(handler, "/demo/c", 10); err != nil {
+				return err
+			}
+			return handler.Filecmd(command("Rename", "/demo/c", "/demo/a"))
+		}, true, 10},
+		{"grow", func() error { return truncate(handler, "/demo/a", 90) }, true, 90},
+		{"grow too far", func() error { return truncate(handler, "/demo/a", 101) }, false, 90},
+		{"shrink", func() error { return truncate(handler, "/demo/a", 5) }, true, 5},
+	}
+	for _, step := range steps {
+		err := step.run()
+		if step.ok && err != nil {
+			t.Fatalf("%s: expected success, got %s", step.name, err)
+		}
+		if !step.ok && err == nil {
+			t.Fatalf("%s: expected the quota to be exceeded", step.name)
+		}
+		if got := usage(t, sites); got != step.usage {
+			t.Fatalf("%s: expected usage %d, got %d", step.name, step.usage, got)
+		}
+	}
+
+	// usage is recalculated from disk when the server restarts
+	restarted := New(sites.Root, sites.Hostname, sites.Quota)
+	if got := usage(t, restarted); got != 5 {
+		t.Errorf("expected usage 5 after restart, got %d", got)
+	}
+}
+
+func TestQuotaWriterGrowth(t *testing.T) {
+	sites := newTestSites(t, 100)
+	handler := newTestHandler(t, sites)
+	if err := handler.Filecmd(command("Mkdir", "/demo", "")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := sftp.NewRequest("Put", "/demo/a")
+	r.Flags = openWrite | openCreate
+	w, err := handler.Filewrite(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.(*quotaWriter).Close()
+
+	writes := []struct {
+		offset int64
+		size   int
+		ok     bool
+		usage  int64
+	}{
+		{0, 40, true, 40},
+		{40, 40, true, 80},
+		// rewriting the start of the file doesn't use more space
+		{0, 80, true, 80},
+		{90, 20, false, 80},
+		{80, 20, true, 100},
+	}
+	for _, write := range writes {
+		_, err := w.WriteAt(make([]byte, write.size), write.offset)
+		if write.ok && err != nil {
+			t.Fatalf("write of %d at %d: expected success, got %s", write.size, write.offset, err)
+		}
+		if !write.ok && err == nil {
+			t.Fatalf("write of %d at %d: expected the quota to be exceeded", write.size, write.offset)
+		}
+		if got := usage(t, sites); got != write.usage {
+			t.Fatalf("write of %d at %d: expected usage %d, got %d", write.size, write.offset, write.usage, got)
+		}
+	}
+}
+
+func TestQuotaWriterFailure(t *testing.T) {
+	sites := newTestSites(t, 100)
+	handler := newTestHandler(t, sites)
+	if err := handler.Filecmd(command("Mkdir", "/demo", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload(handler, "/demo/a", 40); err != nil {
+		t.Fatal(err)
+	}
+
+	r := sftp.NewRequest("Put", "/demo/a")
+	r.Flags = openWrite
+	w, err := handler.Filewrite(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.(*quotaWriter).Close()
+
+	// writes that fail don't use up the quota
+	if _, err := w.WriteAt(make([]byte, 50), 20); err == nil {
+		t.Fatal("expected writing to a closed file to fail")
+	}
+	if got := usage(t, sites); got != 40 {
+		t.Errorf("expected usage 40 after a failed write, got %d", got)
+	}
+}
+
+func TestUsernameCase(t *testing.T) {
+	sites := newTestSites(t, 100)
+	if sites.userDirectory("Alice") == sites.userDirectory("alice") {
+		t.Fatal("expected users differing in case to have their own directories")
+	}
+
+	// alice's usage isn't charged to Alice
+	handler := newTestHandler(t, sites)
+	if err := handler.Filecmd(command("Mkdir", "/demo", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload(handler, "/demo/a", 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := sites.reserve("Alice", 80); err != nil {
+		t.Errorf("expected Alice to have a quota of their own, got %s", err)
+	}
+	sites.release("Alice", 80)
+	if got := usage(t, sites); got != 80 {
+		t.Errorf("expected alice's usage to be unchanged, got %d", got)
+	}
+}
+
+func truncate(handler *sftpHandler, path string, size uint64) error {
+	r := sftp.NewRequest("Setstat", path)
+	r.Flags = attrSize
+	r.Attrs = make([]byte, 8)
+	binary.BigEndian.PutUint64(r.Attrs, size)
+	return handler.Filecmd(r)
+}
+
+func TestLookup(t *testing.T) {
+	sites := newTestSites(t, 0)
+	for _, dir := range []string{"alice/demo", "alice/my-site", "bob.smith/docs", "Carol/demo", "dave/demo", "Dave/blog"} {
+		if err := os.MkdirAll(filepath.Join(sites.Root, filepath.FromSlash(dir)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host     string
+		username string
+		site     string
+	}{
+		{"demo-alice.apparea.test", "alice", "demo"},
+		{"DEMO-Alice.apparea.test:8080", "alice", "demo"},
+		{"my-site-alice.apparea.test", "alice", "my-site"},
+		{"docs-bob.smith.apparea.test", "bob.smith", "docs"},
+		// hostnames lose the case of usernames, which is found again
+		{"demo-carol.apparea.test", "Carol", "demo"},
+		{"demo-dave.apparea.test", "dave", "demo"},
+		{"blog-dave.apparea.test", "Dave", "blog"},
+		{"alice.apparea.test", "", ""},
+		{"missing-alice.apparea.test", "", ""},
+		{"demo-bob.apparea.test", "", ""},
+		{"-alice.apparea.test", "", ""},
+		{"demo-..apparea.test", "", ""},
+		{"demo-alice.example.com", "", ""},
+	}
+	for _, test := range tests {
+		dir, username, ok := sites.Lookup(test.host)
+		if len(test.username) == 0 {
+			if ok {
+				t.Errorf("Lookup(%q): expected no site, got %q", test.host, dir)
+			}
+			continue
+		}
+		want := filepath.Join(sites.Root, test.username, test.site)
+		if !ok || username != test.username || dir != want {
+			t.Errorf("Lookup(%q) = %q, %q, %v, expected %q, %q", test.host, dir, username, ok, want, test.username)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket         = []byte("meta")
+	reservationsBucket = []byte("reservations")
+	usageBucket        = []byte("usage")
+	sessionsBucket     = []byte("sessions")
+
+	versionKey = []byte("version")
+)
+
+// migrations upgrade the database one schema version at a time, so that
+// migrations[i] upgrades a database at version i to version i+1. Released
+// migrations must never be changed; append a new one instead.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: initial schema
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{reservationsBucket, usageBucket, sessionsBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// SchemaVersion is the schema version of databases written by this version
+// of the server.
+var SchemaVersion = len(migrations)
+
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if data := meta.Get(versionKey); data != nil {
+			version = int(binary.BigEndian.Uint64(data))
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("state database has schema version %d, but only %d is supported (was it written by a newer server?)", version, len(migrations))
+		}
+
+		for ; version < len(migrations); version++ {
+			err := migrations[version](tx)
+			if err != nil {
+				return fmt.Errorf("could not migrate state database to version %d: %w", version+1, err)
+			}
+		}
+
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(version))
+		return meta.Put(versionKey, data)
+	})
+}
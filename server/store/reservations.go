@@ -0,0 +1,136 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrReserved is returned when reserving a hostname that belongs to another
+// user.
+var ErrReserved = errors.New("hostname is reserved by another user")
+
+// Reservation records the public port last used for a user's tcp tunnel on
+// a hostname, so that it can be handed out again when the user reconnects.
+type Reservation struct {
+	Hostname string    `json:"hostname"`
+	Username string    `json:"username"`
+	Port     uint32    `json:"port,omitempty"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Reserve reserves the hostname for the user, or refreshes the user's
+// existing reservation. If port is non-zero, it replaces the reserved port.
+func (s *Store) Reserve(hostname string, username string, port uint32) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reservationsBucket)
+
+		now := time.Now()
+		var reservation Reservation
+		ok, err := getJSON(bucket, []byte(hostname), &reservation)
+		if err != nil {
+			return err
+		}
+		if ok && reservation.Username != username {
+			return ErrReserved
+		}
+		if !ok {
+			reservation = Reservation{
+				Hostname: hostname,
+				Username: username,
+				Created:  now,
+			}
+		}
+
+		reservation.LastUsed = now
+		if port != 0 {
+			reservation.Port = port
+		}
+		return putJSON(bucket, []byte(hostname), reservation)
+	})
+}
+
+// Reservation returns the reservation for the hostname, if there is one.
+func (s *Store) Reservation(hostname string) (Reservation, bool, error) {
+	var reservation Reservation
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ok, err = getJSON(tx.Bucket(reservationsBucket), []byte(hostname), &reservation)
+		return err
+	})
+	return reservation, ok, err
+}
+
+// Release removes the user's reservation of the hostname.
+func (s *Store) Release(hostname string, username string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reservationsBucket)
+
+		var reservation Reservation
+		ok, err := getJSON(bucket, []byte(hostname), &reservation)
+		if err != nil || !ok {
+			return err
+		}
+		if reservation.Username != username {
+			return ErrReserved
+		}
+		return bucket.Delete([]byte(hostname))
+	})
+}
+
+// ExpireReservations removes the reservations that were last used before
+// the given time, returning how many were removed.
+func (s *Store) ExpireReservations(before time.Time) (int, error) {
+	expired := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reservationsBucket)
+
+		// keys can't be deleted while iterating with ForEach
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var reservation Reservation
+			err := json.Unmarshal(v, &reservation)
+			if err != nil {
+				return err
+			}
+			if reservation.LastUsed.Before(before) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err := bucket.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		expired = len(keys)
+		return nil
+	})
+	return expired, err
+}
+
+// Reservations lists all reservations, ordered by hostname.
+func (s *Store) Reservations() ([]Reservation, error) {
+	var reservations []Reservation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(reservationsBucket).ForEach(func(k, v []byte) error {
+			var reservation Reservation
+			err := json.Unmarshal(v, &reservation)
+			if err != nil {
+				return err
+			}
+			reservations = append(reservations, reservation)
+			return nil
+		})
+	})
+	return reservations, err
+}
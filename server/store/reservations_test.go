@@ -0,0 +1,141 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*Store, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "apparea-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "state.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+func TestReservations(t *testing.T) {
+	s, path := newTestStore(t)
+
+	steps := []struct {
+		name     string
+		run      func() error
+		err      error
+		hostname string
+		username string
+		port     uint32
+	}{
+		{"reserve", func() error { return s.Reserve("alice.apparea.test", "alice", 0) }, nil, "alice.apparea.test", "alice", 0},
+		{"reserve port", func() error { return s.Reserve("alice.apparea.test", "alice", 4000) }, nil, "alice.apparea.test", "alice", 4000},
+		{"refresh keeps port", func() error { return s.Reserve("alice.apparea.test", "alice", 0) }, nil, "alice.apparea.test", "alice", 4000},
+		{"change port", func() error { return s.Reserve("alice.apparea.test", "alice", 4001) }, nil, "alice.apparea.test", "alice", 4001},
+		{"taken", func() error { return s.Reserve("alice.apparea.test", "bob", 5000) }, ErrReserved, "alice.apparea.test", "alice", 4001},
+		{"release by another user", func() error { return s.Release("alice.apparea.test", "bob") }, ErrReserved, "alice.apparea.test", "alice", 4001},
+		{"reserve another", func() error { return s.Reserve("bob.apparea.test", "bob", 5000) }, nil, "bob.apparea.test", "bob", 5000},
+		{"release", func() error { return s.Release("alice.apparea.test", "alice") }, nil, "alice.apparea.test", "", 0},
+		{"release again", func() error { return s.Release("alice.apparea.test", "alice") }, nil, "alice.apparea.test", "", 0},
+		{"reserve released", func() error { return s.Reserve("alice.apparea.test", "bob", 0) }, nil, "alice.apparea.test", "bob", 0},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != step.err {
+			t.Fatalf("%s: expected error %v, got %v", step.name, step.err, err)
+		}
+
+		reservation, ok, err := s.Reservation(step.hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(step.username) == 0 {
+			if ok {
+				t.Fatalf("%s: expected no reservation, got %+v", step.name, reservation)
+			}
+			continue
+		}
+		if !ok || reservation.Username != step.username || reservation.Port != step.port {
+			t.Fatalf("%s: expected %s reserved by %s with port %d, got %+v (%v)", step.name, step.hostname, step.username, step.port, reservation, ok)
+		}
+		if reservation.LastUsed.Before(reservation.Created) {
+			t.Fatalf("%s: last used before it was created: %+v", step.name, reservation)
+		}
+	}
+
+	// reservations survive a restart
+	s.Close()
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	reservations, err := reopened.Reservations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		hostname string
+		username string
+	}{
+		{"alice.apparea.test", "bob"},
+		{"bob.apparea.test", "bob"},
+	}
+	if len(reservations) != len(expected) {
+		t.Fatalf("expected %d reservations, got %+v", len(expected), reservations)
+	}
+	for i, reservation := range reservations {
+		if reservation.Hostname != expected[i].hostname || reservation.Username != expected[i].username {
+			t.Errorf("reservation %d: expected %s reserved by %s, got %+v", i, expected[i].hostname, expected[i].username, reservation)
+		}
+	}
+}
+
+func TestStoreLocked(t *testing.T) {
+	_, path := newTestStore(t)
+
+	// only one server may use the state at a time
+	if s, err := Open(path); err == nil {
+		s.Close()
+		t.Error("expected the open database to be locked")
+	}
+}
+
+func TestExpireReservations(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	for _, hostname := range []string{"old.apparea.test", "new.apparea.test"} {
+		if err := s.Reserve(hostname, "alice", 4000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := time.Now()
+	if err := s.Reserve("new.apparea.test", "alice", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := s.ExpireReservations(cutoff)
+	if err != nil || expired != 1 {
+		t.Fatalf("expected 1 expired reservation, got %d (%v)", expired, err)
+	}
+	if _, ok, _ := s.Reservation("old.apparea.test"); ok {
+		t.Error("expected the unused reservation to expire")
+	}
+	if reservation, ok, _ := s.Reservation("new.apparea.test"); !ok || reservation.Port != 4000 {
+		t.Errorf("expected the refreshed reservation to be kept, got %+v (%v)", reservation, ok)
+	}
+
+	expired, err = s.ExpireReservations(cutoff)
+	if err != nil || expired != 0 {
+		t.Errorf("expected nothing else to expire, got %d (%v)", expired, err)
+	}
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxSessionHistory is the number of session records kept, after which the
+// oldest are discarded.
+const maxSessionHistory = 10000
+
+// SessionRecord is the history of a single SSH session.
+type SessionRecord struct {
+	ID         uint64    `json:"id"`
+	Username   string    `json:"username"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+	Ended      time.Time `json:"ended"`
+	Forwards   []string  `json:"forwards,omitempty"`
+}
+
+// RecordSession appends the record to the session history, assigning its ID.
+func (s *Store) RecordSession(record SessionRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.ID = id
+
+		err = putJSON(bucket, sessionKey(id), record)
+		if err != nil {
+			return err
+		}
+
+		// ids are sequential, so only one record falls out of the history
+		// for each one added
+		if id > maxSessionHistory {
+			return bucket.Delete(sessionKey(id - maxSessionHistory))
+		}
+		return nil
+	})
+}
+
+// SessionHistory returns up to limit of the most recent session records,
+// newest first. If username is non-empty, only that user's sessions are
+// returned.
+func (s *Store) SessionHistory(username string, limit int) ([]SessionRecord, error) {
+	var records []SessionRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Last(); k != nil && len(records) < limit; k, _ = cursor.Prev() {
+			var record SessionRecord
+			_, err := getJSON(bucket, k, &record)
+			if err != nil {
+				return err
+			}
+			if len(username) > 0 && record.Username != username {
+				continue
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func sessionKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
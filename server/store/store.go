@@ -0,0 +1,57 @@
+// Package store persists the server state that should survive a restart,
+// such as hostname reservations, usage totals and session history, in an
+// embedded bbolt database.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a handle to the state database. It's safe for concurrent use.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens (or creates) the state database at path, migrating it to the
+// latest schema version.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("could not open %s: database is locked (is the server already running?)", path)
+		}
+		return nil, fmt.Errorf("could not open %s: %w", path, err)
+	}
+
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func getJSON(bucket *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	data := bucket.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Usage is the running total of a user's activity.
+type Usage struct {
+	Sessions  uint64        `json:"sessions"`
+	Forwards  uint64        `json:"forwards"`
+	Connected time.Duration `json:"connected"`
+	LastSeen  time.Time     `json:"last_seen"`
+}
+
+// AddUsage adds delta to the user's usage totals.
+func (s *Store) AddUsage(username string, delta Usage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+
+		var usage Usage
+		_, err := getJSON(bucket, []byte(username), &usage)
+		if err != nil {
+			return err
+		}
+
+		usage.Sessions += delta.Sessions
+		usage.Forwards += delta.Forwards
+		usage.Connected += delta.Connected
+		if delta.LastSeen.After(usage.LastSeen) {
+			usage.LastSeen = delta.LastSeen
+		}
+		return putJSON(bucket, []byte(username), usage)
+	})
+}
+
+// Usage returns the user's usage totals.
+func (s *Store) Usage(username string) (Usage, error) {
+	var usage Usage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, err := getJSON(tx.Bucket(usageBucket), []byte(username), &usage)
+		return err
+	})
+	return usage, err
+}
+
+// AllUsage returns the usage totals of every user.
+func (s *Store) AllUsage() (map[string]Usage, error) {
+	usages := make(map[string]Usage)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usageBucket).ForEach(func(k, v []byte) error {
+			var usage Usage
+			err := json.Unmarshal(v, &usage)
+			if err != nil {
+				return err
+			}
+			usages[string(k)] = usage
+			return nil
+		})
+	})
+	return usages, err
+}
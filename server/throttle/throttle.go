@@ -0,0 +1,193 @@
+// Package throttle tracks failed authentication attempts by source IP,
+// refusing connections from sources that keep failing for a while, and
+// temporarily banning them.
+package throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFreeAttempts = 5
+	defaultBaseDelay    = 250 * time.Millisecond
+	defaultMaxDelay     = 8 * time.Second
+	defaultBanAfter     = 20
+	defaultBanDuration  = 15 * time.Minute
+	defaultWindow       = 10 * time.Minute
+)
+
+// Tracker records authentication failures for each source IP, where each
+// connection that fails to authenticate counts once. A nil Tracker never
+// throttles or bans anyone.
+type Tracker struct {
+	// FreeAttempts is the number of failures allowed before a source is
+	// throttled, so that users can make a few mistakes.
+	FreeAttempts int
+
+	// BaseDelay is how long connections from a source are refused after the
+	// first failure beyond FreeAttempts, which doubles with each further
+	// failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// BanAfter is the number of failures after which a source is banned for
+	// BanDuration, or zero to never ban.
+	BanAfter    int
+	BanDuration time.Duration
+
+	// Window is how long failures are remembered for.
+	Window time.Duration
+
+	lock    sync.Mutex
+	sources map[string]*source
+}
+
+type source struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	bannedUntil  time.Time
+}
+
+// Ban describes a banned source.
+type Ban struct {
+	IP       string
+	Failures int
+	Until    time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		FreeAttempts: defaultFreeAttempts,
+		BaseDelay:    defaultBaseDelay,
+		MaxDelay:     defaultMaxDelay,
+		BanAfter:     defaultBanAfter,
+		BanDuration:  defaultBanDuration,
+		Window:       defaultWindow,
+		sources:      make(map[string]*source),
+	}
+}
+
+// Failure records a failed authentication attempt from ip, returning how long
+// the source is blocked for, and whether it is now banned.
+func (t *Tracker) Failure(ip string) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+
+	s, ok := t.sources[ip]
+	if !ok {
+		s = &source{}
+		t.sources[ip] = s
+	}
+	s.failures++
+	s.lastFailure = now
+
+	banned := false
+	if t.BanAfter > 0 && s.failures >= t.BanAfter && !s.bannedUntil.After(now) {
+		s.bannedUntil = now.Add(t.BanDuration)
+		banned = true
+	}
+
+	excess := s.failures - t.FreeAttempts
+	if excess <= 0 {
+		return 0, banned
+	}
+	delay := t.BaseDelay
+	for i := 1; i < excess && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+	s.blockedUntil = now.Add(delay)
+	return delay, banned
+}
+
+// Blocked reports whether connections from ip should be refused, because it
+// is banned, or failed too recently.
+func (t *Tracker) Blocked(ip string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	s, ok := t.sources[ip]
+	return ok && (s.bannedUntil.After(now) || s.blockedUntil.After(now))
+}
+
+// Banned reports whether ip is currently banned.
+func (t *Tracker) Banned(ip string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, ok := t.sources[ip]
+	return ok && s.bannedUntil.After(time.Now())
+}
+
+// Bans lists the currently banned sources, ordered by IP.
+func (t *Tracker) Bans() []Ban {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+
+	var bans []Ban
+	for ip, s := range t.sources {
+		if s.bannedUntil.After(now) {
+			bans = append(bans, Ban{IP: ip, Failures: s.failures, Until: s.bannedUntil})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Unban lifts the ban on ip, and forgets its failures. It returns false if ip
+// wasn't banned.
+func (t *Tracker) Unban(ip string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, ok := t.sources[ip]
+	if !ok || !s.bannedUntil.After(time.Now()) {
+		return false
+	}
+	delete(t.sources, ip)
+	return true
+}
+
+// expire forgets sources that are no longer banned, and haven't failed
+// within the window.
+func (t *Tracker) expire(now time.Time) {
+	for ip, s := range t.sources {
+		if !s.bannedUntil.After(now) && now.Sub(s.lastFailure) > t.Window {
+			delete(t.sources, ip)
+		}
+	}
+}
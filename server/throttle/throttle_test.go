@@ -0,0 +1,194 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestTracker() *Tracker {
+	t := NewTracker()
+	t.FreeAttempts = 2
+	t.BaseDelay = time.Millisecond
+	t.MaxDelay = 4 * time.Millisecond
+	t.BanAfter = 5
+	t.BanDuration = time.Hour
+	return t
+}
+
+func TestFailures(t *testing.T) {
+	tracker := newTestTracker()
+
+	failures := []struct {
+		delay  time.Duration
+		banned bool
+	}{
+		{0, false},
+		{0, false},
+		{1 * time.Millisecond, false},
+		{2 * time.Millisecond, false},
+		// reaching the threshold bans the source, once
+		{4 * time.Millisecond, true},
+		{4 * time.Millisecond, false},
+	}
+	for i, failure := range failures {
+		delay, banned := tracker.Failure("192.0.2.1")
+		if delay != failure.delay || banned != failure.banned {
+			t.Errorf("failure %d: expected %s (banned %v), got %s (banned %v)", i+1, failure.delay, failure.banned, delay, banned)
+		}
+	}
+
+	if !tracker.Banned("192.0.2.1") {
+		t.Error("expected source to be banned")
+	}
+	if tracker.Banned("192.0.2.2") {
+		t.Error("expected other sources to be unaffected")
+	}
+	if delay, banned := tracker.Failure("192.0.2.2"); delay != 0 || banned {
+		t.Errorf("expected other sources to be unaffected, got %s (banned %v)", delay, banned)
+	}
+}
+
+func TestBanThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		banAfter int
+		failures int
+		banned   bool
+	}{
+		{"below", 5, 4, false},
+		{"at", 5, 5, true},
+		{"above", 5, 8, true},
+		{"first failure", 1, 1, true},
+		{"never", 0, 100, false},
+	}
+	for _, test := range tests {
+		tracker := newTestTracker()
+		tracker.BanAfter = test.banAfter
+
+		bans := 0
+		for i := 0; i < test.failures; i++ {
+			if _, banned := tracker.Failure("192.0.2.1"); banned {
+				bans++
+			}
+		}
+		if got := tracker.Banned("192.0.2.1"); got != test.banned {
+			t.Errorf("%s: expected banned %v after %d failures, got %v", test.name, test.banned, test.failures, got)
+		}
+		if test.banned && bans != 1 {
+			t.Errorf("%s: expected the ban to be reported once, got %d", test.name, bans)
+		}
+		if got := len(tracker.Bans()); test.banned != (got == 1) {
+			t.Errorf("%s: expected banned %v, got %d bans listed", test.name, test.banned, got)
+		}
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.BanAfter = 2
+	tracker.BanDuration = 50 * time.Millisecond
+	tracker.Window = time.Hour
+
+	tracker.Failure("192.0.2.1")
+	if _, banned := tracker.Failure("192.0.2.1"); !banned {
+		t.Fatal("expected source to be banned")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if tracker.Banned("192.0.2.1") {
+		t.Fatal("expected the ban to expire")
+	}
+	if bans := tracker.Bans(); len(bans) != 0 {
+		t.Fatalf("expected no bans, got %+v", bans)
+	}
+
+	// failures within the window are still remembered, so the next one
+	// bans the source again
+	if _, banned := tracker.Failure("192.0.2.1"); !banned {
+		t.Error("expected a repeat offender to be banned again")
+	}
+}
+
+func TestForgetting(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.Window = 50 * time.Millisecond
+
+	for i := 0; i < 4; i++ {
+		tracker.Failure("192.0.2.1")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if delay, banned := tracker.Failure("192.0.2.1"); delay != 0 || banned {
+		t.Errorf("expected failures to be forgotten, got %s (banned %v)", delay, banned)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.BaseDelay = 50 * time.Millisecond
+	tracker.MaxDelay = time.Second
+
+	steps := []struct {
+		name    string
+		step    func()
+		blocked bool
+	}{
+		{"unknown", func() {}, false},
+		{"free failure", func() { tracker.Failure("192.0.2.1") }, false},
+		{"free failures", func() { tracker.Failure("192.0.2.1") }, false},
+		{"throttled", func() { tracker.Failure("192.0.2.1") }, true},
+		{"delay passed", func() { time.Sleep(100 * time.Millisecond) }, false},
+		{"throttled again", func() { tracker.Failure("192.0.2.1") }, true},
+		{"banned", func() {
+			tracker.Failure("192.0.2.1")
+			time.Sleep(200 * time.Millisecond)
+		}, true},
+	}
+	for _, step := range steps {
+		step.step()
+		if blocked := tracker.Blocked("192.0.2.1"); blocked != step.blocked {
+			t.Fatalf("%s: expected blocked %v, got %v", step.name, step.blocked, blocked)
+		}
+		if tracker.Blocked("192.0.2.2") {
+			t.Fatalf("%s: expected other sources to be unaffected", step.name)
+		}
+	}
+}
+
+func TestUnban(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.BanAfter = 1
+
+	if tracker.Unban("192.0.2.1") {
+		t.Error("expected unbanning an unknown source to fail")
+	}
+	tracker.Failure("192.0.2.1")
+	tracker.Failure("192.0.2.2")
+
+	if !tracker.Unban("192.0.2.1") {
+		t.Fatal("expected unban to succeed")
+	}
+	if tracker.Banned("192.0.2.1") || !tracker.Banned("192.0.2.2") {
+		t.Error("expected only the unbanned source to be allowed")
+	}
+	if bans := tracker.Bans(); len(bans) != 1 || bans[0].IP != "192.0.2.2" || bans[0].Failures != 1 {
+		t.Errorf("expected only 192.0.2.2 to be banned, got %+v", bans)
+	}
+
+	// unbanning also forgets the source's failures
+	tracker.BanAfter = 2
+	if _, banned := tracker.Failure("192.0.2.1"); banned {
+		t.Error("expected failures to be forgotten after an unban")
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+
+	if delay, banned := tracker.Failure("192.0.2.1"); delay != 0 || banned {
+		t.Errorf("expected no throttling, got %s (banned %v)", delay, banned)
+	}
+	if tracker.Banned("192.0.2.1") || tracker.Blocked("192.0.2.1") || tracker.Unban("192.0.2.1") || tracker.Bans() != nil {
+		t.Error("expected a nil tracker to never ban")
+	}
+}
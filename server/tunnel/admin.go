@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jedevc/apparea/server/audit"
+	"github.com/jedevc/apparea/server/config"
+	"github.com/jedevc/apparea/server/helpers"
+	"golang.org/x/crypto/ssh"
+)
+
+// command can be run with exec (as in `ssh admin@apparea.dev bans`), to
+// manage the running server. Admin commands can only be run by admins.
+type command struct {
+	admin bool
+	run   func(server *Server, conn *ssh.ServerConn, w io.Writer, args []string) error
+}
+
+var commands = map[string]command{
+	"bans":  {admin: true, run: (*Server).adminBans},
+	"unban": {admin: true, run: (*Server).adminUnban},
+	"purge": {run: (*Server).purgeCache},
+}
+
+// isCommand reports whether the exec command names a command, rather than
+// setting session options.
+func isCommand(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	_, ok := commands[fields[0]]
+	return ok
+}
+
+// runCommand runs a command, writing its output to the channel and closing
+// it with the command's exit status.
+func (server *Server) runCommand(conn *ssh.ServerConn, channel ssh.Channel, command string) {
+	fields := strings.Fields(command)
+	cmd := commands[fields[0]]
+	status := uint32(0)
+
+	perms := config.PermissionsFromSSH(conn.Permissions)
+	if cmd.admin && !perms.Admin {
+		fmt.Fprintf(channel.Stderr(), "Permission denied\n")
+		status = 1
+	} else if err := cmd.run(server, conn, channel, fields[1:]); err != nil {
+		fmt.Fprintf(channel.Stderr(), "%s\n", err)
+		status = 1
+	}
+
+	payload := make([]byte, 0)
+	helpers.PackInt(&payload, status)
+	channel.SendRequest("exit-status", false, payload)
+	channel.Close()
+}
+
+func (server *Server) adminBans(conn *ssh.ServerConn, w io.Writer, args []string) error {
+	for _, ban := range server.Config.Throttle.Bans() {
+		fmt.Fprintf(w, "%s\t%d failure(s)\tuntil %s\n", ban.IP, ban.Failures, ban.Until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (server *Server) adminUnban(conn *ssh.ServerConn, w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: unban <ip>")
+	}
+	if !server.Config.Throttle.Unban(args[0]) {
+		return fmt.Errorf("%s is not banned", args[0])
+	}
+
+	server.audit(conn, audit.Event{
+		Type:   audit.AuthUnban,
+		Target: args[0],
+	})
+	fmt.Fprintf(w, "Unbanned %s\n", args[0])
+	return nil
+}
+
+// purgeCache removes cached responses from the user's HTTP tunnels, or from
+// any tunnel for admins, optionally limited to one hostname and to paths
+// starting with a prefix. Guests can only purge their own session's tunnels.
+func (server *Server) purgeCache(conn *ssh.ServerConn, w io.Writer, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("usage: purge [hostname] [path-prefix]")
+	}
+	hostname, prefix := "", "/"
+	if len(args) > 0 {
+		hostname = args[0]
+	}
+	if len(args) > 1 {
+		prefix = args[1]
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix must start with /")
+		}
+	}
+
+	perms := config.PermissionsFromSSH(conn.Permissions)
+	server.lock.Lock()
+	sessions := make(map[*ssh.ServerConn]*Session, len(server.sessions))
+	for c, session := range server.sessions {
+		sessions[c] = session
+	}
+	server.lock.Unlock()
+
+	tunnels, purged := 0, 0
+	for c, session := range sessions {
+		owner := config.PermissionsFromSSH(c.Permissions).Username
+		if owner != perms.Username && !perms.Admin {
+			continue
+		}
+		if perms.Guest() && c != conn {
+			continue
+		}
+		for _, fwd := range session.httpForwarders() {
+			if len(hostname) > 0 && fwd.Hostname != hostname {
+				continue
+			}
+			if n, ok := fwd.PurgeCache(prefix); ok {
+				tunnels++
+				purged += n
+			}
+		}
+	}
+	if tunnels == 0 {
+		return fmt.Errorf("no matching tunnels with caching enabled")
+	}
+
+	fmt.Fprintf(w, "Purged %d response(s) from %d tunnel(s)\n", purged, tunnels)
+	return nil
+}
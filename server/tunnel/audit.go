@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"log"
+
+	"github.com/jedevc/apparea/server/audit"
+	"github.com/jedevc/apparea/server/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// audit records an event for the connection in the audit log, filling in
+// who the connection belongs to.
+func (server *Server) audit(conn *ssh.ServerConn, event audit.Event) {
+	perms := config.PermissionsFromSSH(conn.Permissions)
+	event.Username = perms.Username
+	event.Login = conn.User()
+	event.SourceIP = audit.SourceIP(conn.RemoteAddr())
+	if conn.Permissions != nil {
+		event.Fingerprint = conn.Permissions.Extensions["pubkey-fp"]
+	}
+
+	server.Config.Audit.Log(event)
+}
+
+// auditAuthSuccess records the successful authentication of a connection,
+// along with the method that was used.
+func (server *Server) auditAuthSuccess(conn *ssh.ServerConn) {
+	event := audit.Event{
+		Type:   audit.AuthSuccess,
+		Method: "publickey",
+	}
+	if conn.Permissions != nil {
+		if id, ok := conn.Permissions.Extensions["cert-key-id"]; ok {
+			event.Method = "certificate"
+			event.KeyID = id
+		} else if id, ok := conn.Permissions.Extensions["token-id"]; ok {
+			event.Method = "token"
+			event.KeyID = id
+		}
+	}
+	server.audit(conn, event)
+}
+
+// authFailure throttles the source of a connection that failed to
+// authenticate, banning it if it keeps failing.
+func (server *Server) authFailure(ip string, login string) {
+	_, banned := server.Config.Throttle.Failure(ip)
+	if banned {
+		log.Printf("Banning %s after repeated authentication failures", ip)
+		server.Config.Audit.Log(audit.Event{
+			Type:     audit.AuthBan,
+			Login:    login,
+			SourceIP: ip,
+		})
+	}
+}
+
+// auditForwardReject records a forward request that was refused.
+func (server *Server) auditForwardReject(conn *ssh.ServerConn, req *ssh.Request, reason string) {
+	server.audit(conn, audit.Event{
+		Type:    audit.ForwardReject,
+		Request: req.Type,
+		Reason:  reason,
+	})
+}
@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"log"
+
+	"github.com/jedevc/apparea/server/helpers"
+	"golang.org/x/crypto/ssh"
+)
+
+// advertisedHostKeys returns all of the host keys that clients should learn,
+// including keys that will be rotated to in the future.
+func (server *Server) advertisedHostKeys() []ssh.Signer {
+	keys := append([]ssh.Signer{}, server.Config.HostKeys...)
+	return append(keys, server.Config.NextHostKeys...)
+}
+
+// advertiseHostKeys sends all of the server's host keys to the client, using
+// the hostkeys-00@openssh.com extension, so that clients can update their
+// known_hosts ahead of a key rotation.
+func (server *Server) advertiseHostKeys(conn *ssh.ServerConn) {
+	payload := make([]byte, 0)
+	for _, key := range server.advertisedHostKeys() {
+		helpers.PackString(&payload, string(key.PublicKey().Marshal()))
+	}
+
+	_, _, err := conn.SendRequest("hostkeys-00@openssh.com", false, payload)
+	if err != nil {
+		log.Printf("Could not advertise host keys to %s (%s): %s", conn.User(), conn.RemoteAddr(), err)
+	}
+}
+
+// handleHostKeysProve responds to a hostkeys-prove-00@openssh.com request, in
+// which the client asks the server to prove that it holds the private keys
+// for the advertised host keys it hasn't seen before.
+func (server *Server) handleHostKeysProve(conn *ssh.ServerConn, req *ssh.Request) {
+	keys := server.advertisedHostKeys()
+
+	payload := req.Payload
+	response := make([]byte, 0)
+	for len(payload) > 0 {
+		blob, err := helpers.UnpackString(&payload)
+		if err != nil {
+			req.Reply(false, nil)
+			return
+		}
+
+		var signer ssh.Signer
+		for _, key := range keys {
+			if bytes.Equal(key.PublicKey().Marshal(), []byte(blob)) {
+				signer = key
+				break
+			}
+		}
+		if signer == nil {
+			req.Reply(false, nil)
+			return
+		}
+
+		data := make([]byte, 0)
+		helpers.PackString(&data, "hostkeys-prove-00@openssh.com")
+		helpers.PackString(&data, string(conn.SessionID()))
+		helpers.PackString(&data, blob)
+
+		sig, err := signHostKeyProof(signer, data)
+		if err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		helpers.PackString(&response, string(ssh.Marshal(sig)))
+	}
+
+	req.Reply(true, response)
+}
+
+func signHostKeyProof(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	// prefer SHA-2 signatures for RSA keys, since clients may refuse SHA-1
+	if algSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return algSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	}
+	return signer.Sign(rand.Reader, data)
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jedevc/apparea/server/helpers"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeysProve(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := newTestSigner(t)
+
+	server := newTestServer(t, func(server *Server) {
+		server.Config.NextHostKeys = []ssh.Signer{next}
+	})
+
+	netConn, err := net.DialTimeout("tcp", server.sshAddress, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(netConn, server.sshAddress, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(server.alice)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	// the active and next keys are both advertised
+	var advertised [][]byte
+	select {
+	case req := <-reqs:
+		if req.Type != "hostkeys-00@openssh.com" {
+			t.Fatalf("expected host keys to be advertised, got %q", req.Type)
+		}
+		payload := req.Payload
+		for len(payload) > 0 {
+			blob, err := helpers.UnpackString(&payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			advertised = append(advertised, []byte(blob))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for host keys")
+	}
+	go ssh.DiscardRequests(reqs)
+
+	expected := server.advertisedHostKeys()
+	if len(advertised) != len(expected) {
+		t.Fatalf("expected %d advertised keys, got %d", len(expected), len(advertised))
+	}
+	for i, key := range expected {
+		if string(advertised[i]) != string(key.PublicKey().Marshal()) {
+			t.Errorf("advertised key %d doesn't match", i)
+		}
+	}
+
+	// the client asks for proof of the next key
+	payload := make([]byte, 0)
+	helpers.PackString(&payload, string(next.PublicKey().Marshal()))
+	ok, response, err := conn.SendRequest("hostkeys-prove-00@openssh.com", true, payload)
+	if err != nil || !ok {
+		t.Fatalf("expected the proof to be accepted, got %v (%v)", ok, err)
+	}
+
+	blob, err := helpers.UnpackString(&response)
+	if err != nil || len(response) != 0 {
+		t.Fatalf("expected a single signature, got %v with %d bytes left", err, len(response))
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal([]byte(blob), sig); err != nil {
+		t.Fatal(err)
+	}
+	if sig.Format != ssh.SigAlgoRSASHA2512 {
+		t.Errorf("expected an %s signature, got %s", ssh.SigAlgoRSASHA2512, sig.Format)
+	}
+
+	data := make([]byte, 0)
+	helpers.PackString(&data, "hostkeys-prove-00@openssh.com")
+	helpers.PackString(&data, string(conn.SessionID()))
+	helpers.PackString(&data, string(next.PublicKey().Marshal()))
+	if err := next.PublicKey().Verify(data, sig); err != nil {
+		t.Errorf("expected the signature to verify: %s", err)
+	}
+
+	// keys the server doesn't hold can't be proved
+	payload = make([]byte, 0)
+	helpers.PackString(&payload, string(unknown.PublicKey().Marshal()))
+	ok, _, err = conn.SendRequest("hostkeys-prove-00@openssh.com", true, payload)
+	if err != nil || ok {
+		t.Errorf("expected the proof of an unknown key to be refused, got %v (%v)", ok, err)
+	}
+}
@@ -1,116 +1,543 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/jedevc/apparea/server/audit"
 	"github.com/jedevc/apparea/server/config"
 	"github.com/jedevc/apparea/server/forward"
 	"github.com/jedevc/apparea/server/helpers"
+	"github.com/jedevc/apparea/server/proxyproto"
+	"github.com/jedevc/apparea/server/sites"
+	"github.com/jedevc/apparea/server/store"
 	"golang.org/x/crypto/ssh"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+const defaultHandshakeTimeout = 30 * time.Second
+const defaultMaxUnauthenticated = 64
+
+// optionsTimeout is how long visitors are held back while waiting for a
+// session's options.
+var optionsTimeout = 5 * time.Second
+
 type Server struct {
 	Config   *config.Config
 	Hostname string
+
+	// ShutdownTimeout is the time to wait for in-flight connections to finish
+	// when Run's context is cancelled.
+	ShutdownTimeout time.Duration
+
+	// HandshakeTimeout is the time allowed for a client to complete the SSH
+	// handshake, or zero for no limit.
+	HandshakeTimeout time.Duration
+
+	// MaxSessions limits the number of concurrent SSH sessions, and
+	// MaxForwardsPerSession limits the forwards active in each. Zero means
+	// unlimited.
+	MaxSessions           int
+	MaxForwardsPerSession int
+
+	// MaxUnauthenticated limits the number of connections that haven't yet
+	// completed authentication, or zero for no limit.
+	MaxUnauthenticated int
+
+	// HTTP routes requests to HTTP forwards, and may be configured before
+	// the server is run.
+	HTTP *forward.HTTPServer
+
+	// VisitorFilters restrict the addresses that may reach each user's
+	// public tunnels, by username, on top of any filters set by the user.
+	VisitorFilters map[string]forward.IPFilter
+
+	// Store optionally persists hostname reservations, usage totals and
+	// session history across restarts.
+	Store *store.Store
+
+	// ProxyProtocol configures which listeners accept PROXY protocol
+	// headers, and from which proxies.
+	ProxyProtocol ProxyProtocol
+
+	// Sites optionally hosts static sites uploaded by users over SFTP, and
+	// should be set with EnableSites.
+	Sites *sites.Sites
+
+	private *forward.PrivateRegistry
+
+	lock       sync.Mutex
+	listener   net.Listener
+	closing    bool
+	handshakes int
+	sessions   map[*ssh.ServerConn]*Session
 }
 
-func (server *Server) Run(address string) <-chan *Session {
-	if server.Config == nil {
-		log.Fatalf("Internal error: no config provided")
+// ProxyProtocol configures reading the original client's address from the
+// PROXY protocol headers sent by load balancers in front of the server.
+// Connections from Trusted networks must send a header on the enabled
+// listeners, and other connections are used as they are.
+type ProxyProtocol struct {
+	Trusted []*net.IPNet
+
+	SSH   bool
+	HTTP  bool
+	HTTPS bool
+	// TCP enables headers on the listeners of raw tcp forwards.
+	TCP bool
+}
+
+func (p ProxyProtocol) wrap(enabled bool, listener net.Listener) net.Listener {
+	if !enabled || len(p.Trusted) == 0 {
+		return listener
 	}
+	return proxyproto.NewListener(listener, p.Trusted)
+}
 
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatalf("Failed to listen on %s (%s)", address, err)
+func NewServer(config *config.Config, hostname string) *Server {
+	return &Server{
+		Config:             config,
+		Hostname:           hostname,
+		ShutdownTimeout:    defaultShutdownTimeout,
+		HandshakeTimeout:   defaultHandshakeTimeout,
+		MaxUnauthenticated: defaultMaxUnauthenticated,
+		HTTP:               forward.NewHTTPServer(),
+		private:            forward.NewPrivateRegistry(),
 	}
+}
 
-	sessions := make(chan *Session)
+// EnableSites accepts SFTP uploads into the given sites, and serves them
+// over HTTP to requests for hosts without a tunnel. It must be called before
+// the server is run.
+func (server *Server) EnableSites(sites *sites.Sites) {
+	server.Sites = sites
+	server.HTTP.Fallback = http.HandlerFunc(server.serveSite)
+}
 
-	log.Printf("Listening for SSH connections on %s...", address)
+// Run serves SSH connections on sshListener and HTTP connections on
+// httpListener until the context is cancelled, at which point the server is
+// gracefully shut down, or until either listener fails.
+func (server *Server) Run(ctx context.Context, sshListener net.Listener, httpListener net.Listener) error {
+	if server.Config == nil {
+		return fmt.Errorf("no config provided")
+	}
+	if server.HTTP == nil {
+		return fmt.Errorf("server not created with NewServer")
+	}
+
+	sshListener = server.ProxyProtocol.wrap(server.ProxyProtocol.SSH, sshListener)
+	httpListener = server.ProxyProtocol.wrap(server.ProxyProtocol.HTTP, httpListener)
+
+	sweepCtx, stopSweep := context.WithCancel(ctx)
+	defer stopSweep()
+	go server.expireReservations(sweepCtx)
+
+	errs := make(chan error, 2)
 	go func() {
-		for {
-			tcpConn, err := listener.Accept()
-			if err != nil {
+		errs <- server.serveSSH(sshListener)
+	}()
+	go func() {
+		errs <- server.HTTP.Serve(httpListener)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.ShutdownTimeout)
+	defer cancel()
+
+	if shutdownErr := server.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// ServeHTTPS accepts HTTPS connections on the listener, terminating TLS with
+// the given config, and routing requests to the same sites as the HTTP
+// listener passed to Run. It returns when the server is shut down.
+func (server *Server) ServeHTTPS(listener net.Listener, tlsConfig *tls.Config) error {
+	if server.HTTP == nil {
+		return fmt.Errorf("server not created with NewServer")
+	}
+	listener = server.ProxyProtocol.wrap(server.ProxyProtocol.HTTPS, listener)
+	return server.HTTP.ServeTLS(listener, tlsConfig)
+}
+
+func (server *Server) serveSSH(listener net.Listener) error {
+	server.lock.Lock()
+	if server.closing {
+		server.lock.Unlock()
+		listener.Close()
+		return nil
+	}
+	server.listener = listener
+	server.lock.Unlock()
+
+	log.Printf("Listening for SSH connections on %s...", listener.Addr())
+	var tempDelay time.Duration
+	for {
+		tcpConn, err := listener.Accept()
+		if err != nil {
+			if server.isClosing() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off, like net/http, rather than spinning while the
+				// error persists (such as running out of file descriptors)
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				time.Sleep(tempDelay)
 				continue
 			}
+			return err
+		}
+		tempDelay = 0
+
+		ip := audit.SourceIP(tcpConn.RemoteAddr())
+		if server.Config.Throttle.Blocked(ip) {
+			tcpConn.Close()
+			continue
+		}
+		if server.MaxSessions > 0 && server.sessionCount() >= server.MaxSessions {
+			log.Printf("Rejecting connection from %s: too many sessions", tcpConn.RemoteAddr())
+			tcpConn.Close()
+			continue
+		}
+		if !server.startHandshake() {
+			log.Printf("Rejecting connection from %s: too many unauthenticated connections", tcpConn.RemoteAddr())
+			tcpConn.Close()
+			continue
+		}
+
+		go func() {
+			if server.HandshakeTimeout > 0 {
+				tcpConn.SetDeadline(time.Now().Add(server.HandshakeTimeout))
+			}
 
-			sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, server.Config.SSHConfig)
+			// the connection only counts as one failure, however many keys
+			// the client tried before giving up, or finding one that works
+			sshConfig := *server.Config.SSHConfig
+			failed, login := false, ""
+			sshConfig.AuthLogCallback = func(c ssh.ConnMetadata, method string, err error) {
+				if err != nil && method != "none" {
+					failed, login = true, c.User()
+				}
+			}
+
+			sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, &sshConfig)
+			server.finishHandshake()
 			if err != nil {
-				continue
+				if failed {
+					server.authFailure(ip, login)
+				}
+				tcpConn.Close()
+				return
+			}
+			tcpConn.SetDeadline(time.Time{})
+			server.auditAuthSuccess(sshConn)
+			if server.isClosing() {
+				sshConn.Close()
+				return
 			}
 
-			session := server.launchSession(sshConn, chans, reqs)
+			server.launchSession(sshConn, chans, reqs)
+		}()
+	}
+}
 
-			sessions <- session
+// Shutdown gracefully shuts down the server. It stops accepting new SSH
+// connections, notifies every session, waits for in-flight forwarded
+// connections to finish (or for the context to expire), and then closes all
+// SSH connections.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.lock.Lock()
+	server.closing = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	http := server.HTTP
+	sessions := make(map[*ssh.ServerConn]*Session, len(server.sessions))
+	for conn, session := range server.sessions {
+		sessions[conn] = session
+	}
+	server.lock.Unlock()
+
+	errs := make(chan error, len(sessions)+1)
+	go func() {
+		if http == nil {
+			errs <- nil
+			return
 		}
+		errs <- http.Shutdown(ctx)
 	}()
+	for _, session := range sessions {
+		go func(session *Session) {
+			errs <- session.Shutdown(ctx)
+		}(session)
+	}
 
-	return sessions
+	var err error
+	for i := 0; i < len(sessions)+1; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for conn := range sessions {
+		conn.Close()
+	}
+
+	return err
+}
+
+func (server *Server) isClosing() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.closing
+}
+
+// trustedProxies returns the proxies that raw tcp forwards should read
+// PROXY protocol headers from, if any.
+func (server *Server) trustedProxies() []*net.IPNet {
+	if !server.ProxyProtocol.TCP {
+		return nil
+	}
+	return server.ProxyProtocol.Trusted
+}
+
+// startHandshake counts a new unauthenticated connection, returning false if
+// there are already MaxUnauthenticated.
+func (server *Server) startHandshake() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.MaxUnauthenticated > 0 && server.handshakes >= server.MaxUnauthenticated {
+		return false
+	}
+	server.handshakes++
+	return true
+}
+
+func (server *Server) finishHandshake() {
+	server.lock.Lock()
+	server.handshakes--
+	server.lock.Unlock()
+}
+
+func (server *Server) sessionCount() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return len(server.sessions)
+}
+
+func (server *Server) trackSession(conn *ssh.ServerConn, session *Session) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.sessions == nil {
+		server.sessions = make(map[*ssh.ServerConn]*Session)
+	}
+	server.sessions[conn] = session
+}
+
+func (server *Server) untrackSession(conn *ssh.ServerConn) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	delete(server.sessions, conn)
 }
 
 func (server *Server) launchSession(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) *Session {
 	log.Printf("Incoming session from %s (%s)", conn.User(), conn.RemoteAddr())
 
 	views := make(chan View)
-	forwards := make(chan forward.Forwarder)
-	session := NewSession(views, forwards)
-
-	var closer sync.Once
-	closeChans := func() {
-		close(forwards)
+	session := NewSession(views)
+	session.Hold(server.sessionOptions(conn, forward.Options{}))
+	server.trackSession(conn, session)
+
+	// clients send their options after requesting forwards, if at all
+	settle := time.AfterFunc(optionsTimeout, session.Settle)
+
+	// OpenSSH clients send no-more-sessions@openssh.com after opening their
+	// session, so a client that hasn't opened one by then (like ssh -N)
+	// will never send options
+	noMoreSessions := make(chan struct{}, 1)
+
+	started := time.Now()
+	var historyLock sync.Mutex
+	var history []string
+	// reserved are the tcp forwards with reserved ports, which are refreshed
+	// when the session ends, so that they expire reservationTTL after their
+	// last use
+	var reserved []*forward.RawForwarder
+
+	// the views are closed once neither loop below can use the session
+	var loops sync.WaitGroup
+	loops.Add(2)
+	closeSession := func() {
+		settle.Stop()
+		session.Settle()
+		server.untrackSession(conn)
 		close(views)
 		log.Printf("Closing session from %s (%s)", conn.User(), conn.RemoteAddr())
+
+		historyLock.Lock()
+		perms := config.PermissionsFromSSH(conn.Permissions)
+		server.recordSession(conn, perms.Username, started, history)
+		for _, raw := range reserved {
+			server.reserveHost(perms.Username, raw.Hostname, raw.ListenerPort())
+		}
+		historyLock.Unlock()
+
+		server.audit(conn, audit.Event{
+			Type:     audit.SessionEnd,
+			Duration: time.Since(started).Seconds(),
+		})
 	}
 
+	go server.advertiseHostKeys(conn)
+
 	go func() {
 		for req := range reqs {
-			if req.Type == "tcpip-forward" {
-				forward, err := server.handleTCPForward(conn, req)
-				if err != nil {
-					fmt.Fprintf(session, "Could not establish forwarding: %s\n", err)
-					continue
+			var handler func(*ssh.ServerConn, *Session, *ssh.Request) (forward.Forwarder, error)
+			switch req.Type {
+			case "cancel-tcpip-forward", "cancel-streamlocal-forward@openssh.com":
+				server.handleCancelForward(conn, session, req)
+				continue
+			case "hostkeys-prove-00@openssh.com":
+				server.handleHostKeysProve(conn, req)
+				continue
+			case "no-more-sessions@openssh.com":
+				select {
+				case noMoreSessions <- struct{}{}:
+				default:
 				}
-				forward.AttachClientLog(session)
-				forwards <- forward
-			} else {
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+				continue
+			case "tcpip-forward":
+				handler = server.handleTCPForward
+			case "streamlocal-forward@openssh.com":
+				handler = server.handleStreamLocalForward
+			case forward.UDPForwardRequestType:
+				handler = server.handleUDPForward
+			default:
 				// discard request
 				if req.WantReply {
 					req.Reply(false, nil)
 				}
+				continue
+			}
+
+			if server.isClosing() {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				server.auditForwardReject(conn, req, "server is shutting down")
+				fmt.Fprintf(session, "Could not establish forwarding: server is shutting down\n")
+				continue
+			}
+			if !session.reserveForward(server.MaxForwardsPerSession) {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				server.auditForwardReject(conn, req, "too many forwards")
+				fmt.Fprintf(session, "Could not establish forwarding: too many forwards\n")
+				continue
+			}
+
+			fwd, err := handler(conn, session, req)
+			if err != nil {
+				session.releaseForward()
+				server.auditForwardReject(conn, req, err.Error())
+				fmt.Fprintf(session, "Could not establish forwarding: %s\n", err)
+				continue
+			}
+			historyLock.Lock()
+			history = append(history, fwd.ListenerAddress())
+			if raw, ok := reservedForward(req, fwd); ok {
+				reserved = append(reserved, raw)
 			}
+			historyLock.Unlock()
 		}
 
-		closer.Do(closeChans)
+		loops.Done()
 	}()
 	go func() {
-		for newChannel := range chans {
-			if t := newChannel.ChannelType(); t == "session" {
-				view, err := server.handleSessionChannel(conn, newChannel)
+		defer loops.Done()
+
+		opened, closed := false, false
+		for {
+			var newChannel ssh.NewChannel
+			select {
+			case nc, ok := <-chans:
+				if !ok {
+					return
+				}
+				newChannel = nc
+			case <-noMoreSessions:
+				// channels are queued in the order they were sent, so a
+				// session opened before the request is either handled
+				// already, or still queued
+				closed = true
+				if !opened && len(chans) == 0 {
+					session.Settle()
+				}
+				continue
+			}
+
+			switch t := newChannel.ChannelType(); t {
+			case "session":
+				if closed {
+					newChannel.Reject(ssh.Prohibited, "no more sessions")
+					continue
+				}
+				opened = true
+				view, err := server.handleSessionChannel(conn, session, newChannel)
 				if err != nil {
 					log.Printf("internal error: %s", err)
 					continue
 				}
 				views <- view
-			} else {
+			case "direct-tcpip":
+				go server.handleDirectTCPIP(conn, newChannel)
+			default:
 				newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 			}
 		}
+	}()
 
-		closer.Do(closeChans)
+	go func() {
+		loops.Wait()
+		closeSession()
 	}()
 
 	return session
 }
 
-func (server *Server) handleSessionChannel(conn *ssh.ServerConn, newChannel ssh.NewChannel) (View, error) {
-	session, requests, err := newChannel.Accept()
+func (server *Server) handleSessionChannel(conn *ssh.ServerConn, session *Session, newChannel ssh.NewChannel) (View, error) {
+	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		return nil, err
 	}
+	view := newPendingView(NewStatusView(channel))
 
 	go func() {
 		for req := range requests {
@@ -119,14 +546,160 @@ func (server *Server) handleSessionChannel(conn *ssh.ServerConn, newChannel ssh.
 				if len(req.Payload) == 0 {
 					req.Reply(true, nil)
 				}
+				view.Open()
+				session.Settle()
+			case "exec":
+				payload := req.Payload
+				command, err := helpers.UnpackString(&payload)
+				if err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				view.Open()
+
+				if isCommand(command) {
+					session.Settle()
+					server.runCommand(conn, channel, command)
+					continue
+				}
+
+				opts, err := forward.ParseOptions(command)
+				if err != nil {
+					fmt.Fprintf(view, "Could not parse options: %s\n", err)
+					session.Settle()
+					continue
+				}
+				session.Configure(server.sessionOptions(conn, opts))
+			case "subsystem":
+				payload := req.Payload
+				name, err := helpers.UnpackString(&payload)
+				if err != nil || name != "sftp" || server.Sites == nil || config.PermissionsFromSSH(conn.Permissions).Guest() {
+					req.Reply(false, nil)
+					continue
+				}
+				view.Discard()
+				session.Settle()
+				req.Reply(true, nil)
+
+				go server.serveSFTP(conn, channel)
 			}
 		}
 	}()
 
-	return NewStatusView(session), nil
+	return view, nil
 }
 
-func (server *Server) handleTCPForward(conn *ssh.ServerConn, req *ssh.Request) (forward.Forwarder, error) {
+// serveSFTP gives the connection's user access to their sites over SFTP,
+// closing the channel once the client is done.
+func (server *Server) serveSFTP(conn *ssh.ServerConn, channel ssh.Channel) {
+	perms := config.PermissionsFromSSH(conn.Permissions)
+
+	status := uint32(0)
+	err := server.Sites.Serve(perms.Username, channel)
+	if err != nil {
+		log.Printf("SFTP session for %s (%s) failed: %s", conn.User(), conn.RemoteAddr(), err)
+		status = 1
+	}
+
+	var payload []byte
+	helpers.PackInt(&payload, status)
+	channel.SendRequest("exit-status", false, payload)
+	channel.Close()
+}
+
+// serveSite serves the site for a request to a host without a tunnel,
+// applying the same visitor filters as the owner's tunnels.
+func (server *Server) serveSite(w http.ResponseWriter, r *http.Request) {
+	_, username, ok := server.Sites.Lookup(r.Host)
+	if ok {
+		var opts forward.Options
+		if filter, ok := server.visitorFilter(username); ok {
+			opts.Visitors = append(opts.Visitors, filter)
+		}
+		if !opts.AllowsVisitor(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	server.Sites.ServeHTTP(w, r)
+}
+
+// sessionOptions adds the restrictions set by admins for the connection's
+// user to the options chosen by the user.
+func (server *Server) sessionOptions(conn *ssh.ServerConn, opts forward.Options) forward.Options {
+	perms := config.PermissionsFromSSH(conn.Permissions)
+	if filter, ok := server.visitorFilter(perms.Username); ok {
+		opts.Visitors = append(opts.Visitors, filter)
+	}
+	return opts
+}
+
+// visitorFilter returns the admin's filter for the user's tunnels and sites.
+// Usernames are matched ignoring case, since sites only know the username
+// from the hostname.
+func (server *Server) visitorFilter(username string) (forward.IPFilter, bool) {
+	for name, filter := range server.VisitorFilters {
+		if strings.EqualFold(name, username) {
+			return filter, true
+		}
+	}
+	return forward.IPFilter{}, false
+}
+
+func (server *Server) handleDirectTCPIP(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+	dr, err := forward.ParseDirectRequest(newChannel.ExtraData())
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+
+	fwd, ok := server.private.Lookup(dr.Host, dr.Port)
+	if !ok {
+		newChannel.Reject(ssh.Prohibited, "no such private tunnel")
+		return
+	}
+
+	// guests may only forward, so they can't reach the owner's private
+	// tunnels through the owner's name
+	perms := config.PermissionsFromSSH(conn.Permissions)
+	if perms.Guest() || (!perms.Admin && !fwd.Allows(perms.Username)) {
+		log.Printf("Denied private connection from %s (%s) to %s:%d", conn.User(), conn.RemoteAddr(), dr.Host, dr.Port)
+		server.audit(conn, audit.Event{
+			Type:    audit.PrivateReject,
+			Forward: fwd.ListenerAddress(),
+			Reason:  "not permitted",
+		})
+		newChannel.Reject(ssh.Prohibited, "no such private tunnel")
+		return
+	}
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	remoteAddress, remotePortStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	remotePort, _ := strconv.Atoi(remotePortStr)
+	err = fwd.Splice(channel, remoteAddress, uint32(remotePort), perms.Username)
+	if err != nil {
+		log.Printf("Could not connect private tunnel %s:%d: %s", dr.Host, dr.Port, err)
+		return
+	}
+
+	log.Printf("Private connection from %s (%s) to %s:%d", conn.User(), conn.RemoteAddr(), dr.Host, dr.Port)
+	event := audit.Event{
+		Type:    audit.PrivateConnect,
+		Forward: fwd.ListenerAddress(),
+	}
+	if perms.Admin && !fwd.Allows(perms.Username) {
+		event.Reason = "admin override"
+	}
+	server.audit(conn, event)
+}
+
+func (server *Server) handleTCPForward(conn *ssh.ServerConn, session *Session, req *ssh.Request) (forward.Forwarder, error) {
 	fr, err := forward.ParseForwardRequest(req.Payload)
 	if err != nil {
 		if req.WantReply {
@@ -135,63 +708,239 @@ func (server *Server) handleTCPForward(conn *ssh.ServerConn, req *ssh.Request) (
 		return nil, err
 	}
 
-	user, parts, ok := server.Config.Users.LookupUser(conn.User())
-	if !ok {
-		panic("Internal error: user should exist")
+	hostname, err := server.forwardHost(conn, fr.Host)
+	if err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return nil, err
 	}
 
-	hostname := server.generateHost(user, parts)
-
 	var fwd forward.Forwarder
 	switch fr.Port {
 	case 80:
-		fwd = forward.NewHTTPForwarder(hostname, conn, fr)
+		fwd = forward.NewHTTPForwarder(server.HTTP, hostname, conn, fr)
+		return fwd, server.startForward(conn, session, req, fwd, "http", false)
+	case 443:
+		fwd = forward.NewHTTPForwarder(server.HTTP, hostname, conn, fr).UseTLS(true)
+		return fwd, server.startForward(conn, session, req, fwd, "https", false)
+	case 0:
+		// hand out the same port as last time, so that addresses stay stable
+		// across reconnects
+		perms := config.PermissionsFromSSH(conn.Permissions)
+		raw := forward.NewRawForwarder(hostname, conn, fr)
+		raw.PreferredPort = server.reservedPort(perms.Username, hostname)
+		raw.TrustedProxies = server.trustedProxies()
+		return raw, server.startForward(conn, session, req, raw, "tcp", true)
+	default:
+		perms := config.PermissionsFromSSH(conn.Permissions)
+		fwd = forward.NewPrivateForwarder(server.private, hostname, perms.Username, conn, fr)
+		return fwd, server.startForward(conn, session, req, fwd, "private tcp", false)
+	}
+}
 
-		err := fwd.Serve()
-		if err != nil {
+// handleStreamLocalForward handles forwards from unix sockets, where the
+// name of the remote socket chooses the kind of tunnel to publish (http,
+// https or tcp), for example:
+//
+//	ssh -R /http:/path/to/app.sock user@apparea.dev
+//	ssh -R /api/http:/path/to/app.sock user@apparea.dev
+func (server *Server) handleStreamLocalForward(conn *ssh.ServerConn, session *Session, req *ssh.Request) (forward.Forwarder, error) {
+	fr, err := forward.ParseStreamLocalForwardRequest(req.Payload)
+	if err != nil {
+		if req.WantReply {
 			req.Reply(false, nil)
-			return nil, err
 		}
+		return nil, err
+	}
 
-		log.Printf("Forwarding http from %s (%s)", conn.User(), conn.RemoteAddr())
-		req.Reply(true, nil)
-	case 443:
-		fwd = forward.NewHTTPForwarder(hostname, conn, fr).UseTLS(true)
-
-		err := fwd.Serve()
-		if err != nil {
+	// the subdomain can be chosen with a parent directory, as in
+	// /api/http:/path/to/app.sock
+	bind := ""
+	if dir := path.Dir(fr.SocketPath); dir != "/" && dir != "." {
+		bind = path.Base(dir)
+	}
+	hostname, err := server.forwardHost(conn, bind)
+	if err != nil {
+		if req.WantReply {
 			req.Reply(false, nil)
-			return nil, err
 		}
+		return nil, err
+	}
 
-		log.Printf("Forwarding https from %s (%s)", conn.User(), conn.RemoteAddr())
-		req.Reply(true, nil)
-	case 0:
-		fwd = forward.NewRawForwarder(hostname, conn, fr)
+	var fwd forward.Forwarder
+	switch path.Base(fr.SocketPath) {
+	case "http":
+		fwd = forward.NewHTTPForwarder(server.HTTP, hostname, conn, fr)
+		return fwd, server.startForward(conn, session, req, fwd, "http", false)
+	case "https":
+		fwd = forward.NewHTTPForwarder(server.HTTP, hostname, conn, fr).UseTLS(true)
+		return fwd, server.startForward(conn, session, req, fwd, "https", false)
+	case "tcp":
+		raw := forward.NewRawForwarder(hostname, conn, fr)
+		raw.TrustedProxies = server.trustedProxies()
+		fwd = raw
+		return fwd, server.startForward(conn, session, req, fwd, "tcp", false)
+	default:
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return nil, fmt.Errorf("Forward request invalid socket (expected http, https or tcp)")
+	}
+}
 
-		err := fwd.Serve()
-		if err != nil {
+func (server *Server) handleCancelForward(conn *ssh.ServerConn, session *Session, req *ssh.Request) {
+	var fr forward.ForwardRequest
+	var err error
+	if req.Type == "cancel-tcpip-forward" {
+		fr, err = forward.ParseForwardRequest(req.Payload)
+	} else {
+		fr, err = forward.ParseStreamLocalForwardRequest(req.Payload)
+	}
+	if err != nil {
+		if req.WantReply {
 			req.Reply(false, nil)
-			return nil, err
 		}
+		return
+	}
 
-		log.Printf("Forwarding tcp from %s (%s) to :%d", conn.User(), conn.RemoteAddr(), fwd.ListenerPort())
+	ok := session.CancelForward(fr)
+	if ok {
+		log.Printf("Cancelled forwarding from %s (%s)", conn.User(), conn.RemoteAddr())
+		address := fr.Address()
+		if len(fr.SocketPath) > 0 {
+			address = fr.SocketPath
+		}
+		server.audit(conn, audit.Event{
+			Type:    audit.ForwardCancel,
+			Request: req.Type,
+			Forward: address,
+		})
+	}
+	if req.WantReply {
+		req.Reply(ok, nil)
+	}
+}
 
-		bs := make([]byte, 0)
+// startForward starts serving the forwarder, adds it to the session, and
+// replies to the forward request, including the port that was listened on if
+// requested. The ports of tcp forwards are reserved before replying.
+func (server *Server) startForward(conn *ssh.ServerConn, session *Session, req *ssh.Request, fwd forward.Forwarder, kind string, replyPort bool) error {
+	session.prepareForward(fwd)
+	err := fwd.Serve()
+	if err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return err
+	}
+
+	session.addForward(fwd)
+	if raw, ok := reservedForward(req, fwd); ok {
+		perms := config.PermissionsFromSSH(conn.Permissions)
+		server.reserveHost(perms.Username, raw.Hostname, raw.ListenerPort())
+	}
+	log.Printf("Forwarding %s from %s (%s) on %s", kind, conn.User(), conn.RemoteAddr(), fwd.ListenerAddress())
+	server.audit(conn, audit.Event{
+		Type:    audit.ForwardCreate,
+		Request: req.Type,
+		Forward: fwd.ListenerAddress(),
+	})
+
+	var bs []byte
+	if replyPort {
 		helpers.PackInt(&bs, fwd.ListenerPort())
+	}
+	if req.WantReply {
 		req.Reply(true, bs)
-	default:
-		req.Reply(false, nil)
+	}
+
+	return nil
+}
+
+func (server *Server) handleUDPForward(conn *ssh.ServerConn, session *Session, req *ssh.Request) (forward.Forwarder, error) {
+	fr, err := forward.ParseForwardRequest(req.Payload)
+	if err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return nil, err
+	}
+
+	if fr.Port != 0 {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
 		return nil, fmt.Errorf("Forward request invalid port")
 	}
 
-	return fwd, nil
+	hostname, err := server.forwardHost(conn, fr.Host)
+	if err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return nil, err
+	}
+
+	fwd := forward.NewUDPForwarder(hostname, conn, fr)
+	return fwd, server.startForward(conn, session, req, fwd, "udp", true)
+}
+
+// forwardHost returns the hostname that the connection's forwards should be
+// published on, checking that the user is permitted to use it.
+//
+// If the bind address of the forward names a subdomain, that subdomain is
+// used, otherwise the subdomain is taken from the user's login name.
+func (server *Server) forwardHost(conn *ssh.ServerConn, bind string) (string, error) {
+	perms := config.PermissionsFromSSH(conn.Permissions)
+	_, parts, ok := config.SplitUsername(conn.User())
+	if !ok {
+		panic("Internal error: user should be valid")
+	}
+
+	if !forward.IsWildcardHost(bind) {
+		subdomain, err := server.parseBindSubdomain(perms.Username, bind)
+		if err != nil {
+			return "", err
+		}
+		parts = nil
+		if len(subdomain) > 0 {
+			parts = []string{subdomain}
+		}
+	}
+
+	if !perms.AllowsSubdomain(strings.Join(parts, "-")) {
+		return "", fmt.Errorf("Not permitted to use this subdomain")
+	}
+
+	return server.generateHost(perms.Username, parts), nil
+}
+
+var isValidSubdomain = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`).MatchString
+
+// parseBindSubdomain extracts the subdomain from a forward's bind address,
+// which is either just the subdomain ("api"), or a full hostname within the
+// user's namespace ("api-user.apparea.dev").
+func (server *Server) parseBindSubdomain(username string, bind string) (string, error) {
+	name := strings.ToLower(bind)
+	name = strings.TrimSuffix(name, "."+strings.ToLower(server.Hostname))
+
+	suffix := strings.ToLower(username)
+	if name == suffix {
+		return "", nil
+	}
+	name = strings.TrimSuffix(name, "-"+suffix)
+
+	if !isValidSubdomain(name) {
+		return "", fmt.Errorf("Invalid subdomain %q in bind address", bind)
+	}
+	return name, nil
 }
 
-func (server Server) generateHost(user config.User, parts []string) string {
+func (server *Server) generateHost(username string, parts []string) string {
 	if len(parts) == 0 {
-		return fmt.Sprintf("%s.%s", user.Username, server.Hostname)
+		return fmt.Sprintf("%s.%s", username, server.Hostname)
 	} else {
-		return fmt.Sprintf("%s-%s.%s", strings.Join(parts, "-"), user.Username, server.Hostname)
+		return fmt.Sprintf("%s-%s.%s", strings.Join(parts, "-"), username, server.Hostname)
 	}
 }
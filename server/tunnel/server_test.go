@@ -0,0 +1,810 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jedevc/apparea/server/config"
+	"github.com/jedevc/apparea/server/forward"
+	"github.com/jedevc/apparea/server/helpers"
+	"github.com/jedevc/apparea/server/sites"
+	"github.com/jedevc/apparea/server/store"
+	"github.com/jedevc/apparea/server/throttle"
+	"golang.org/x/crypto/ssh"
+)
+
+const testHostname = "apparea.test"
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestDirectory(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "apparea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// testServer is a server running on local listeners, with a single user
+// "alice", who may also hand out guest access tokens.
+type testServer struct {
+	*Server
+
+	sshAddress  string
+	httpAddress string
+	alice       ssh.Signer
+	tokens      *config.TokenStore
+
+	// stop cancels Run, returning its error once it has returned
+	stop func() error
+}
+
+func newTestServer(t *testing.T, setup func(server *Server)) *testServer {
+	t.Helper()
+
+	alice := newTestSigner(t)
+	cfg, err := config.NewConfig(config.Users{
+		"alice": {Username: "alice", Keys: []ssh.PublicKey{alice.PublicKey()}},
+	}, newTestSigner(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := config.NewTokenStore(filepath.Join(newTestDirectory(t), "tokens.json"))
+	cfg.Tokens = tokens
+
+	server := NewServer(cfg, testHostname)
+	if setup != nil {
+		setup(server)
+	}
+
+	sshListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var runErr error
+	go func() {
+		runErr = server.Run(ctx, sshListener, httpListener)
+		close(done)
+	}()
+	stop := func() error {
+		cancel()
+		<-done
+		return runErr
+	}
+	t.Cleanup(func() { stop() })
+
+	return &testServer{
+		Server:      server,
+		sshAddress:  sshListener.Addr().String(),
+		httpAddress: httpListener.Addr().String(),
+		alice:       alice,
+		tokens:      tokens,
+		stop:        stop,
+	}
+}
+
+func (server *testServer) dial(t *testing.T, login string, auth ssh.AuthMethod) *ssh.Client {
+	t.Helper()
+
+	client, err := ssh.Dial("tcp", server.sshAddress, &ssh.ClientConfig{
+		User:            login,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// dialAlice connects with alice's own key.
+func (server *testServer) dialAlice(t *testing.T) *ssh.Client {
+	return server.dial(t, "alice", ssh.PublicKeys(server.alice))
+}
+
+// dialGuest connects with a new guest access token for alice, limited to the
+// given subdomains.
+func (server *testServer) dialGuest(t *testing.T, subdomains ...string) *ssh.Client {
+	secret, _, err := server.tokens.Create("alice", subdomains, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.dial(t, "alice", ssh.Password(secret))
+}
+
+// remoteForward requests a forward of host:port, returning whether the
+// server accepted it.
+func remoteForward(t *testing.T, client *ssh.Client, host string, port uint32) bool {
+	t.Helper()
+
+	var payload []byte
+	helpers.PackString(&payload, host)
+	helpers.PackInt(&payload, port)
+	ok, _, err := client.SendRequest("tcpip-forward", true, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// echoForwards echoes back the data sent on every forwarded connection.
+func echoForwards(client *ssh.Client) {
+	channels := client.HandleChannelOpen("forwarded-tcpip")
+	go func() {
+		for newChannel := range channels {
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(ch, ch)
+				ch.Close()
+			}()
+		}
+	}()
+}
+
+func TestGuestPrivateTunnels(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	owner := server.dialAlice(t)
+	echoForwards(owner)
+	if !remoteForward(t, owner, "devbox", 22) {
+		t.Fatal("private forward was refused")
+	}
+	address := "devbox-alice." + testHostname + ":22"
+
+	tests := []struct {
+		name    string
+		client  *ssh.Client
+		allowed bool
+	}{
+		{"owner", server.dialAlice(t), true},
+		{"guest", server.dialGuest(t), false},
+		{"scoped guest", server.dialGuest(t, "devbox"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := test.client.Dial("tcp", address)
+			if !test.allowed {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected connection to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected connection to be allowed, got %s", err)
+			}
+			defer conn.Close()
+
+			conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("expected echo, got %q (%v)", buf, err)
+			}
+		})
+	}
+}
+
+func TestGuestSFTP(t *testing.T) {
+	server := newTestServer(t, func(server *Server) {
+		server.EnableSites(sites.New(newTestDirectory(t), testHostname, 0))
+	})
+
+	tests := []struct {
+		name    string
+		client  *ssh.Client
+		allowed bool
+	}{
+		{"owner", server.dialAlice(t), true},
+		{"guest", server.dialGuest(t), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, err := test.client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			err = session.RequestSubsystem("sftp")
+			if test.allowed && err != nil {
+				t.Errorf("expected sftp to be allowed, got %s", err)
+			}
+			if !test.allowed && err == nil {
+				t.Error("expected sftp to be refused")
+			}
+		})
+	}
+}
+
+// get requests / from the HTTP tunnel at host, returning the status code.
+func (server *testServer) get(t *testing.T, host string) int {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", "http://"+server.httpAddress+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func denyLocal(t *testing.T) forward.IPFilter {
+	t.Helper()
+
+	networks, err := forward.ParseCIDRs([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forward.IPFilter{Deny: networks}
+}
+
+// shortOptionsTimeout stops visitors being held back for long by sessions
+// that never send options.
+func shortOptionsTimeout(t *testing.T) {
+	timeout := optionsTimeout
+	optionsTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { optionsTimeout = timeout })
+}
+
+func TestAdminVisitorFilters(t *testing.T) {
+	shortOptionsTimeout(t)
+
+	// usernames in the settings match regardless of case
+	for _, username := range []string{"alice", "Alice"} {
+		server := newTestServer(t, func(server *Server) {
+			server.VisitorFilters = map[string]forward.IPFilter{username: denyLocal(t)}
+		})
+
+		// without sending any options, as with ssh -N
+		client := server.dialAlice(t)
+		echoForwards(client)
+		if !remoteForward(t, client, "0.0.0.0", 80) {
+			t.Fatal("http forward was refused")
+		}
+
+		if status := server.get(t, "alice."+testHostname); status != http.StatusForbidden {
+			t.Errorf("%s: expected visitor to be forbidden, got %d", username, status)
+		}
+	}
+}
+
+func TestVisitorsHeldForOptions(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	client := server.dialAlice(t)
+	echoForwards(client)
+	if !remoteForward(t, client, "0.0.0.0", 80) {
+		t.Fatal("http forward was refused")
+	}
+
+	// the visitor arrives before the owner's filters
+	statuses := make(chan int, 1)
+	go func() {
+		statuses <- server.get(t, "alice."+testHostname)
+	}()
+
+	select {
+	case status := <-statuses:
+		t.Fatalf("expected visitor to be held back, got %d", status)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.Start("deny-ips=127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := <-statuses; status != http.StatusForbidden {
+		t.Errorf("expected visitor to be forbidden, got %d", status)
+	}
+}
+
+func TestNoMoreSessions(t *testing.T) {
+	tests := []struct {
+		name    string
+		session bool
+		held    bool
+	}{
+		// as with ssh -N, which will never send options
+		{"no session", false, false},
+		{"session", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, nil)
+
+			client := server.dialAlice(t)
+			echoForwards(client)
+			if !remoteForward(t, client, "0.0.0.0", 80) {
+				t.Fatal("http forward was refused")
+			}
+			var session *ssh.Session
+			if test.session {
+				var err error
+				session, err = client.NewSession()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer session.Close()
+			}
+			if _, _, err := client.SendRequest("no-more-sessions@openssh.com", false, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			statuses := make(chan int, 1)
+			go func() {
+				statuses <- server.get(t, "alice."+testHostname)
+			}()
+
+			select {
+			case status := <-statuses:
+				if test.held {
+					t.Fatalf("expected visitor to be held back, got %d", status)
+				}
+				return
+			case <-time.After(time.Second):
+				if !test.held {
+					t.Fatal("expected visitor not to be held back")
+				}
+			}
+
+			// no further sessions can be opened
+			if _, err := client.NewSession(); err == nil {
+				t.Error("expected another session to be refused")
+			}
+			if err := session.Start("deny-ips=127.0.0.0/8"); err != nil {
+				t.Fatal(err)
+			}
+			if status := <-statuses; status != http.StatusForbidden {
+				t.Errorf("expected visitor to be forbidden, got %d", status)
+			}
+		})
+	}
+}
+
+// serveForwards answers every forwarded connection with a 200 response, once
+// the request has been passed to received and release is closed.
+func serveForwards(client *ssh.Client, received chan<- struct{}, release <-chan struct{}) {
+	channels := client.HandleChannelOpen("forwarded-tcpip")
+	go func() {
+		for newChannel := range channels {
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				defer ch.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(ch)); err != nil {
+					return
+				}
+				received <- struct{}{}
+				<-release
+				io.WriteString(ch, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}()
+		}
+	}()
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		drained bool
+	}{
+		{"drain", time.Minute, true},
+		{"timeout", 100 * time.Millisecond, false},
+	}
+	shortOptionsTimeout(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, func(server *Server) {
+				server.ShutdownTimeout = test.timeout
+			})
+			client := server.dialAlice(t)
+			received := make(chan struct{}, 1)
+			release := make(chan struct{})
+			t.Cleanup(func() {
+				select {
+				case <-release:
+				default:
+					close(release)
+				}
+			})
+			serveForwards(client, received, release)
+			if !remoteForward(t, client, "0.0.0.0", 80) {
+				t.Fatal("http forward was refused")
+			}
+
+			statuses := make(chan int, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "http://"+server.httpAddress+"/", nil)
+				req.Host = "alice." + testHostname
+				resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+			<-received
+
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- server.stop()
+			}()
+
+			// new connections are refused while the request drains
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				conn, err := net.DialTimeout("tcp", server.sshAddress, time.Second)
+				if err != nil {
+					break
+				}
+				conn.Close()
+				if time.Now().After(deadline) {
+					t.Fatal("expected new ssh connections to be refused")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if test.drained {
+				select {
+				case err := <-stopped:
+					t.Fatalf("expected shutdown to wait for the request, returned %v", err)
+				case <-time.After(100 * time.Millisecond):
+				}
+				close(release)
+				if status := <-statuses; status != http.StatusOK {
+					t.Errorf("expected in-flight request to finish, got %d", status)
+				}
+				if err := <-stopped; err != nil {
+					t.Errorf("expected a clean shutdown, got %s", err)
+				}
+				return
+			}
+
+			select {
+			case err := <-stopped:
+				if err == nil {
+					t.Error("expected shutdown to report the timeout")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected shutdown to give up after the timeout")
+			}
+			if status := <-statuses; status == http.StatusOK {
+				t.Error("expected the unfinished request to be cut off")
+			}
+		})
+	}
+}
+
+// globalForward sends a forward (or cancel) request for host:port, returning
+// whether the server accepted it, and the port it replied with.
+func globalForward(t *testing.T, client *ssh.Client, reqType string, host string, port uint32) (bool, uint32) {
+	t.Helper()
+
+	var payload []byte
+	helpers.PackString(&payload, host)
+	helpers.PackInt(&payload, port)
+	ok, reply, err := client.SendRequest(reqType, true, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyPort, _ := helpers.UnpackInt(&reply)
+	return ok, replyPort
+}
+
+func TestCancelForward(t *testing.T) {
+	shortOptionsTimeout(t)
+	server := newTestServer(t, nil)
+	client := server.dialAlice(t)
+	echoForwards(client)
+
+	tests := []struct {
+		name    string
+		host    string
+		port    uint32
+		stopped func(port uint32) bool
+	}{
+		{"http", "0.0.0.0", 80, func(uint32) bool {
+			return server.get(t, "alice."+testHostname) == http.StatusNotFound
+		}},
+		{"tcp", "0.0.0.0", 0, func(port uint32) bool {
+			conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+			if err == nil {
+				conn.Close()
+			}
+			return err != nil
+		}},
+		{"private", "devbox", 22, func(uint32) bool {
+			conn, err := client.Dial("tcp", "devbox-alice."+testHostname+":22")
+			if err == nil {
+				conn.Close()
+			}
+			return err != nil
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, port := globalForward(t, client, "tcpip-forward", test.host, test.port)
+			if !ok {
+				t.Fatal("forward was refused")
+			}
+			if test.port != 0 {
+				port = test.port
+			}
+
+			// cancelled straight after the reply, as clients may do
+			if ok, _ := globalForward(t, client, "cancel-tcpip-forward", test.host, port); !ok {
+				t.Fatal("expected cancel to succeed")
+			}
+			if !test.stopped(port) {
+				t.Error("expected the tunnel to be stopped")
+			}
+			if ok, _ := globalForward(t, client, "cancel-tcpip-forward", test.host, port); ok {
+				t.Error("expected a second cancel to fail")
+			}
+		})
+	}
+
+	if ok, _ := globalForward(t, client, "cancel-tcpip-forward", "0.0.0.0", 443); ok {
+		t.Error("expected cancelling an unknown forward to fail")
+	}
+}
+
+func TestParseBindSubdomain(t *testing.T) {
+	server := &Server{Hostname: testHostname}
+
+	tests := []struct {
+		bind      string
+		subdomain string
+		ok        bool
+	}{
+		{"api", "api", true},
+		{"my-api2", "my-api2", true},
+		{"api-alice", "api", true},
+		{"api-alice." + testHostname, "api", true},
+		{"API-Alice.Apparea.Test", "api", true},
+		{"alice", "", true},
+		{"alice." + testHostname, "", true},
+		// other users' names are just part of the subdomain
+		{"api-bob", "api-bob", true},
+		{"api_v2", "", false},
+		{"api.v2", "", false},
+		{"-api", "", false},
+		{"api-", "", false},
+		{"api.example.com", "", false},
+		{"api-alice.example.com", "", false},
+	}
+	for _, test := range tests {
+		subdomain, err := server.parseBindSubdomain("alice", test.bind)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("parseBindSubdomain(%q): expected an error, got %q", test.bind, subdomain)
+			}
+			continue
+		}
+		if err != nil || subdomain != test.subdomain {
+			t.Errorf("parseBindSubdomain(%q) = %q, %v, expected %q", test.bind, subdomain, err, test.subdomain)
+		}
+	}
+}
+
+func TestForwardHost(t *testing.T) {
+	shortOptionsTimeout(t)
+	server := newTestServer(t, nil)
+
+	tests := []struct {
+		name    string
+		dial    func() *ssh.Client
+		bind    string
+		host    string
+		allowed bool
+	}{
+		{"wildcard", func() *ssh.Client { return server.dialAlice(t) }, "0.0.0.0", "alice", true},
+		{"localhost", func() *ssh.Client { return server.dialAlice(t) }, "localhost", "alice", true},
+		{"login subdomain", func() *ssh.Client {
+			return server.dial(t, "alice.web", ssh.PublicKeys(server.alice))
+		}, "", "web-alice", true},
+		{"bind overrides login", func() *ssh.Client {
+			return server.dial(t, "alice.web", ssh.PublicKeys(server.alice))
+		}, "api", "api-alice", true},
+		{"bare username", func() *ssh.Client { return server.dialAlice(t) }, "alice", "alice", true},
+		{"name", func() *ssh.Client { return server.dialAlice(t) }, "docs", "docs-alice", true},
+		{"hostname", func() *ssh.Client { return server.dialAlice(t) }, "blog-alice." + testHostname, "blog-alice", true},
+		{"invalid", func() *ssh.Client { return server.dialAlice(t) }, "bad_name", "", false},
+		{"guest allowed", func() *ssh.Client { return server.dialGuest(t, "demo") }, "demo", "demo-alice", true},
+		{"guest other subdomain", func() *ssh.Client { return server.dialGuest(t, "demo") }, "admin", "", false},
+		{"guest own domain", func() *ssh.Client { return server.dialGuest(t, "demo") }, "0.0.0.0", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := test.dial()
+			echoForwards(client)
+
+			ok := remoteForward(t, client, test.bind, 80)
+			if ok != test.allowed {
+				t.Fatalf("expected forward allowed %v, got %v", test.allowed, ok)
+			}
+			if !ok {
+				return
+			}
+			defer globalForward(t, client, "cancel-tcpip-forward", test.bind, 80)
+
+			if status := server.get(t, test.host+"."+testHostname); status == http.StatusNotFound {
+				t.Errorf("expected the tunnel to be published on %s", test.host)
+			}
+		})
+	}
+}
+
+func TestReservations(t *testing.T) {
+	state, err := store.Open(filepath.Join(newTestDirectory(t), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.Close() })
+
+	server := newTestServer(t, func(server *Server) {
+		server.Store = state
+	})
+	client := server.dialAlice(t)
+
+	// only tcp forwards are reserved, once they've started
+	if !remoteForward(t, client, "web", 80) {
+		t.Fatal("expected the http forward to be accepted")
+	}
+	if ok, _ := globalForward(t, client, forward.UDPForwardRequestType, "game", 5000); ok {
+		t.Fatal("expected the udp forward with a fixed port to be refused")
+	}
+	for _, hostname := range []string{"web-alice." + testHostname, "game-alice." + testHostname} {
+		if _, ok, _ := state.Reservation(hostname); ok {
+			t.Errorf("expected no reservation of %s", hostname)
+		}
+	}
+
+	ok, port := globalForward(t, client, "tcpip-forward", "", 0)
+	if !ok {
+		t.Fatal("expected the tcp forward to be accepted")
+	}
+	hostname := "alice." + testHostname
+	reservation, ok, err := state.Reservation(hostname)
+	if err != nil || !ok || reservation.Port != port {
+		t.Fatalf("expected %s reserved with port %d, got %+v (%v, %v)", hostname, port, reservation, ok, err)
+	}
+
+	// the reservation is refreshed once the forward ends
+	client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		refreshed, _, err := state.Reservation(hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refreshed.LastUsed.After(reservation.LastUsed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the reservation to be refreshed when the session ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and the same port is handed out again
+	client = server.dialAlice(t)
+	if ok, again := globalForward(t, client, "tcpip-forward", "", 0); !ok || again != port {
+		t.Errorf("expected port %d again, got %d (%v)", port, again, ok)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	tracker := throttle.NewTracker()
+	tracker.FreeAttempts = 100
+	tracker.BanAfter = 3
+	server := newTestServer(t, func(server *Server) {
+		server.Config.Throttle = tracker
+	})
+
+	// like an agent with many keys, each key is tried in turn
+	var wrong []ssh.Signer
+	for i := 0; i < 5; i++ {
+		wrong = append(wrong, newTestSigner(t))
+	}
+	login := func(signers ...ssh.Signer) error {
+		client, err := ssh.Dial("tcp", server.sshAddress, &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	steps := []struct {
+		name    string
+		signers []ssh.Signer
+		ok      bool
+	}{
+		{"many keys", append(wrong, server.alice), true},
+		{"failure", wrong, false},
+		// succeeding doesn't forget the failures
+		{"success", []ssh.Signer{server.alice}, true},
+		{"failure", wrong, false},
+		{"ban", wrong, false},
+	}
+	for _, step := range steps {
+		if err := login(step.signers...); (err == nil) != step.ok {
+			t.Fatalf("%s: expected login to succeed %v, got %v", step.name, step.ok, err)
+		}
+	}
+
+	// each failed connection counts once, however many keys it tried
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tracker.Bans()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the source to be banned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bans := tracker.Bans(); len(bans) != 1 || bans[0].Failures != 3 {
+		t.Fatalf("expected a ban after 3 failures, got %+v", bans)
+	}
+
+	if err := login(server.alice); err == nil {
+		t.Error("expected connections from a banned source to be refused")
+	}
+}
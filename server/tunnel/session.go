@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -12,19 +13,33 @@ type Session struct {
 	forwards []forward.Forwarder
 
 	messages [][]byte
+	options  forward.Options
+
+	// pending is closed once the session's options are final
+	pending chan struct{}
+	settle  sync.Once
+
+	// reserved counts forwards that are being set up, but haven't been
+	// handled yet
+	reserved int
 
 	lock *sync.Mutex
+
+	// output orders writes to the views, without holding lock, so that a
+	// slow view can't hold up the session's forwards
+	output sync.Mutex
 }
 
-func NewSession(views chan View, forwards chan forward.Forwarder) *Session {
+// NewSession creates a session that shows its output on each view sent on
+// views, and closes its forwarders once views is closed.
+func NewSession(views chan View) *Session {
 	session := Session{
 		views:    []View{},
 		lock:     new(sync.Mutex),
 		messages: make([][]byte, 0),
+		pending:  make(chan struct{}),
 	}
 
-	var once sync.Once
-
 	go func() {
 		for {
 			view, ok := <-views
@@ -34,34 +49,29 @@ func NewSession(views chan View, forwards chan forward.Forwarder) *Session {
 			go session.handleView(view)
 		}
 
-		once.Do(session.Close)
-	}()
-	go func() {
-		for {
-			forward, ok := <-forwards
-			if !ok {
-				break
-			}
-			go session.handleForwarder(forward)
-		}
-
-		once.Do(session.Close)
+		session.Close()
 	}()
 
 	return &session
 }
 
 func (session *Session) Write(msg []byte) (n int, err error) {
-	session.messages = append(session.messages, msg)
+	session.output.Lock()
+	defer session.output.Unlock()
 
+	// copy the message, since callers (like fmt.Fprintf) may reuse the buffer
+	msg = append([]byte(nil), msg...)
 	session.lock.Lock()
-	for _, view := range session.views {
+	session.messages = append(session.messages, msg)
+	views := append([]View(nil), session.views...)
+	session.lock.Unlock()
+
+	for _, view := range views {
 		_, err = view.Write(msg)
 		if err != nil {
 			return
 		}
 	}
-	session.lock.Unlock()
 	n = len(msg)
 
 	return
@@ -77,17 +87,154 @@ func (session *Session) Close() {
 	session.lock.Unlock()
 }
 
+// Shutdown stops all of the session's forwarders from accepting new
+// connections, and waits for their in-flight connections to finish, or for
+// the context to expire.
+func (session *Session) Shutdown(ctx context.Context) error {
+	fmt.Fprintf(session, ">>> Server is shutting down, closing tunnels...\n")
+
+	session.lock.Lock()
+	forwards := append([]forward.Forwarder{}, session.forwards...)
+	session.lock.Unlock()
+
+	errs := make(chan error, len(forwards))
+	for _, fwd := range forwards {
+		go func(fwd forward.Forwarder) {
+			errs <- fwd.Shutdown(ctx)
+		}(fwd)
+	}
+
+	var err error
+	for range forwards {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func (session *Session) handleView(view View) {
+	session.output.Lock()
+	defer session.output.Unlock()
+
 	session.lock.Lock()
 	session.views = append(session.views, view)
-	for _, message := range session.messages {
+	messages := append([][]byte(nil), session.messages...)
+	session.lock.Unlock()
+
+	for _, message := range messages {
 		view.Write(message)
 	}
+}
+
+// httpForwarders returns the session's HTTP forwarders.
+func (session *Session) httpForwarders() []*forward.HTTPForwarder {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	var forwarders []*forward.HTTPForwarder
+	for _, fwd := range session.forwards {
+		if http, ok := fwd.(*forward.HTTPForwarder); ok {
+			forwarders = append(forwarders, http)
+		}
+	}
+	return forwarders
+}
+
+// Hold applies provisional options to the session's forwarders, which hold
+// back visitors until the final options are given to Configure, or the
+// session is settled without them.
+func (session *Session) Hold(opts forward.Options) {
+	opts.Pending = session.pending
+	session.apply(opts)
+}
+
+// Configure applies the options to all of the session's current and future
+// forwarders.
+func (session *Session) Configure(opts forward.Options) {
+	opts.Pending = nil
+	session.apply(opts)
+	session.Settle()
+}
+
+// Settle lets visitors through to the session's forwarders with the options
+// they already have.
+func (session *Session) Settle() {
+	session.settle.Do(func() {
+		close(session.pending)
+	})
+}
+
+func (session *Session) apply(opts forward.Options) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	session.options = opts
+	for _, forward := range session.forwards {
+		forward.Configure(opts)
+	}
+}
+
+// prepareForward gives a new forwarder the session's options and log, before
+// it starts accepting visitors.
+func (session *Session) prepareForward(forward forward.Forwarder) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	forward.AttachClientLog(session)
+	forward.Configure(session.options)
+}
+
+// CancelForward removes the forwarder created by the forward request from
+// the session, and closes it.
+func (session *Session) CancelForward(fr forward.ForwardRequest) bool {
+	session.lock.Lock()
+	var cancelled forward.Forwarder
+	for i, forward := range session.forwards {
+		if forward.Matches(fr) {
+			cancelled = forward
+			session.forwards = append(session.forwards[:i], session.forwards[i+1:]...)
+			break
+		}
+	}
+	session.lock.Unlock()
+
+	if cancelled == nil {
+		return false
+	}
+
+	cancelled.Close()
+	fmt.Fprintf(session, ">>> Stopped listening on %s\n", cancelled.ListenerAddress())
+	return true
+}
+
+// reserveForward reserves space for a new forwarder, returning false if the
+// session already has max forwarders (or zero for unlimited). The
+// reservation is released when the forwarder is added, or by releaseForward
+// if it's never created.
+func (session *Session) reserveForward(max int) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if max > 0 && len(session.forwards)+session.reserved >= max {
+		return false
+	}
+	session.reserved++
+	return true
+}
+
+func (session *Session) releaseForward() {
+	session.lock.Lock()
+	session.reserved--
 	session.lock.Unlock()
 }
 
-func (session *Session) handleForwarder(forward forward.Forwarder) {
+// addForward adds a forwarder that is serving to the session, so that it can
+// be cancelled as soon as the client hears about it.
+func (session *Session) addForward(forward forward.Forwarder) {
 	session.lock.Lock()
+	session.reserved--
+	forward.Configure(session.options)
 	session.forwards = append(session.forwards, forward)
 	session.lock.Unlock()
 
@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jedevc/apparea/server/forward"
+)
+
+// blockedView is a view whose client has stopped reading.
+type blockedView chan struct{}
+
+func (view blockedView) Write(p []byte) (int, error) {
+	<-view
+	return len(p), nil
+}
+
+func TestSlowView(t *testing.T) {
+	views := make(chan View)
+	session := NewSession(views)
+	defer close(views)
+
+	view := make(blockedView)
+	defer close(view)
+	session.handleView(view)
+	go fmt.Fprintf(session, "stuck\n")
+
+	done := make(chan struct{})
+	go func() {
+		session.Configure(forward.Options{})
+		session.reserveForward(0)
+		session.releaseForward()
+		session.CancelForward(forward.ForwardRequest{Host: "0.0.0.0", Port: 80})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a blocked view not to hold up the session")
+	}
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jedevc/apparea/server/forward"
+	"github.com/jedevc/apparea/server/store"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// reservationTTL is how long a reservation is kept after its tunnel was
+	// last used
+	reservationTTL = 30 * 24 * time.Hour
+
+	reservationSweep = time.Hour
+)
+
+// reserveHost records the public port of the user's tcp tunnel on the
+// hostname, or refreshes the reservation's last use. Reservations only keep
+// ports stable across reconnects: hostnames already include the username, so
+// they can't be taken by other users. Errors are only logged, so that a
+// broken store doesn't take down every tunnel.
+func (server *Server) reserveHost(username string, hostname string, port uint32) {
+	if server.Store == nil {
+		return
+	}
+
+	err := server.Store.Reserve(hostname, username, port)
+	if err != nil {
+		log.Printf("Could not save reservation of %s: %s", hostname, err)
+	}
+}
+
+// reservedForward returns the forwarder if its port is reserved, which is
+// only done for tcp forwards requested with tcpip-forward.
+func reservedForward(req *ssh.Request, fwd forward.Forwarder) (*forward.RawForwarder, bool) {
+	raw, ok := fwd.(*forward.RawForwarder)
+	return raw, ok && req.Type == "tcpip-forward"
+}
+
+// reservedPort returns the public port last used by the user for a tcp
+// tunnel on the hostname, or zero if there isn't one.
+func (server *Server) reservedPort(username string, hostname string) uint32 {
+	if server.Store == nil {
+		return 0
+	}
+
+	reservation, ok, err := server.Store.Reservation(hostname)
+	if err != nil {
+		log.Printf("Could not load reservation of %s: %s", hostname, err)
+		return 0
+	}
+	if !ok || reservation.Username != username {
+		return 0
+	}
+	return reservation.Port
+}
+
+// expireReservations removes the reservations that haven't been used for
+// reservationTTL, every reservationSweep until the context is cancelled.
+func (server *Server) expireReservations(ctx context.Context) {
+	if server.Store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(reservationSweep)
+	defer ticker.Stop()
+	for {
+		expired, err := server.Store.ExpireReservations(time.Now().Add(-reservationTTL))
+		if err != nil {
+			log.Printf("Could not expire reservations: %s", err)
+		} else if expired > 0 {
+			log.Printf("Expired %d unused reservation(s)", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordSession saves the history of a finished session, and adds it to the
+// user's usage totals.
+func (server *Server) recordSession(conn *ssh.ServerConn, username string, started time.Time, forwards []string) {
+	if server.Store == nil {
+		return
+	}
+
+	ended := time.Now()
+	err := server.Store.RecordSession(store.SessionRecord{
+		Username:   username,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Started:    started,
+		Ended:      ended,
+		Forwards:   forwards,
+	})
+	if err != nil {
+		log.Printf("Could not save session history for %s: %s", username, err)
+	}
+
+	err = server.Store.AddUsage(username, store.Usage{
+		Sessions:  1,
+		Forwards:  uint64(len(forwards)),
+		Connected: ended.Sub(started),
+		LastSeen:  ended,
+	})
+	if err != nil {
+		log.Printf("Could not save usage for %s: %s", username, err)
+	}
+}
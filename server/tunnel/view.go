@@ -1,7 +1,9 @@
 package tunnel
 
 import (
+	"bytes"
 	"io"
+	"sync"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -21,3 +23,66 @@ func NewStatusView(raw io.ReadWriter) StatusView {
 func (view StatusView) Write(p []byte) (int, error) {
 	return view.term.Write(p)
 }
+
+// pendingView holds back the output for a session channel until the client
+// asks for a shell or command, so that nothing is written into channels used
+// for subsystems like SFTP.
+type pendingView struct {
+	view View
+
+	lock    sync.Mutex
+	state   int
+	pending bytes.Buffer
+}
+
+// maxPendingView limits the output held back for a channel, beyond which it
+// is dropped.
+const maxPendingView = 64 << 10
+
+const (
+	viewPending = iota
+	viewOpen
+	viewDiscarded
+)
+
+func newPendingView(view View) *pendingView {
+	return &pendingView{view: view}
+}
+
+func (view *pendingView) Write(p []byte) (int, error) {
+	view.lock.Lock()
+	defer view.lock.Unlock()
+
+	switch view.state {
+	case viewPending:
+		if view.pending.Len()+len(p) > maxPendingView {
+			return len(p), nil
+		}
+		return view.pending.Write(p)
+	case viewOpen:
+		return view.view.Write(p)
+	}
+	return len(p), nil
+}
+
+// Open writes any held back output, and passes through all later output.
+func (view *pendingView) Open() {
+	view.lock.Lock()
+	defer view.lock.Unlock()
+
+	if view.state != viewPending {
+		return
+	}
+	view.state = viewOpen
+	view.view.Write(view.pending.Bytes())
+	view.pending.Reset()
+}
+
+// Discard drops all output, past and future.
+func (view *pendingView) Discard() {
+	view.lock.Lock()
+	defer view.lock.Unlock()
+
+	view.state = viewDiscarded
+	view.pending.Reset()
+}